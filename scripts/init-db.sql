@@ -1,4 +1,31 @@
 -- scripts/init-db.sql
+
+-- Each user's directory tree. A user's root has no parent and an empty
+-- name; names are unique within a directory, across directories and files.
+CREATE TABLE IF NOT EXISTS directories (
+    dir_id VARCHAR(255) PRIMARY KEY,
+    parent_id VARCHAR(255) REFERENCES directories(dir_id),
+    name VARCHAR(255) NOT NULL,
+    user_id VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- dir_id is NULL for files uploaded without a path, which are outside
+-- the tree.
+-- Each row is one immutable version of a logical file. logical_id is the
+-- file_id of its first version and is the file's stable ID; the current
+-- version is the newest completed one. Pruned versions keep their row
+-- without chunks.
+-- A deleted file stays in the trash, with deleted_at set on every version,
+-- until it is purged. trashed_from is the path of its directory when it
+-- was deleted, to restore it to if that directory is gone by then.
+-- Staged files, such as the parts of an S3 multipart upload, are created
+-- in the trash and never listed there. etag is the S3 ETag of files
+-- written through the S3 API.
+-- content_sha256 is the SHA-256 of the file's bytes, taken as they stream
+-- through the upload service. It is NULL for resumable and S3 multipart
+-- uploads, whose chunks arrive separately and in any order.
 CREATE TABLE IF NOT EXISTS files (
     file_id VARCHAR(255) PRIMARY KEY,
     file_name VARCHAR(255) NOT NULL,
@@ -6,6 +33,16 @@ CREATE TABLE IF NOT EXISTS files (
     chunk_count INT DEFAULT 0,
     status VARCHAR(50) DEFAULT 'uploading',
     user_id VARCHAR(255),
+    tenant_id VARCHAR(255),
+    dir_id VARCHAR(255) REFERENCES directories(dir_id) ON DELETE SET NULL,
+    logical_id VARCHAR(255) NOT NULL,
+    version INT NOT NULL DEFAULT 1,
+    deleted_at TIMESTAMP,
+    trashed_from TEXT,
+    staged BOOLEAN NOT NULL DEFAULT false,
+    etag VARCHAR(64),
+    content_sha256 VARCHAR(64),
+    storage_policy VARCHAR(20) NOT NULL DEFAULT 'replicated',
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
@@ -19,15 +56,161 @@ CREATE TABLE IF NOT EXISTS chunks (
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
+-- Chunk data is stored once per distinct checksum, named by the checksum.
+-- ref_count is the number of chunks rows that point at the object.
+-- data_shards = 0 means whole copies; otherwise the object is erasure-coded
+-- into data_shards + parity_shards shards.
+CREATE TABLE IF NOT EXISTS chunk_objects (
+    checksum VARCHAR(64) PRIMARY KEY,
+    chunk_size BIGINT NOT NULL,
+    ref_count INT NOT NULL DEFAULT 0,
+    data_shards INT NOT NULL DEFAULT 0,
+    parity_shards INT NOT NULL DEFAULT 0,
+    last_verified_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- One row per copy (shard_index -1) or erasure-coded shard of a chunk
+-- object; shard_checksum is the SHA-256 of the shard.
 CREATE TABLE IF NOT EXISTS chunk_locations (
     chunk_id VARCHAR(64),
     node_id VARCHAR(50),
+    shard_index INT NOT NULL DEFAULT -1,
     storage_path TEXT,
+    shard_checksum VARCHAR(64),
     is_primary BOOLEAN DEFAULT false,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    PRIMARY KEY (chunk_id, node_id)
+    PRIMARY KEY (chunk_id, node_id, shard_index)
+);
+
+CREATE TABLE IF NOT EXISTS upload_sessions (
+    session_id VARCHAR(255) PRIMARY KEY,
+    file_id VARCHAR(255) REFERENCES files(file_id) ON DELETE CASCADE,
+    chunk_size BIGINT NOT NULL,
+    total_chunks INT NOT NULL,
+    status VARCHAR(50) DEFAULT 'active',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Where the scrubber is in its walk over chunk_objects and then the chunks
+-- from before content addressing; last_checksum is "legacy:<chunk_id>" in
+-- the second part of a pass.
+CREATE TABLE IF NOT EXISTS scrub_progress (
+    scrubber_id VARCHAR(50) PRIMARY KEY,
+    last_checksum VARCHAR(80) NOT NULL DEFAULT '',
+    pass_started_at TIMESTAMP,
+    passes_completed INT NOT NULL DEFAULT 0,
+    chunks_verified BIGINT NOT NULL DEFAULT 0,
+    chunks_missing BIGINT NOT NULL DEFAULT 0,
+    chunks_corrupted BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Long-lived credentials for machine clients. Only the SHA-256 of the
+-- secret part is kept; the full key is shown once when it is created.
+-- s3_secret is the key's S3 secret access key, if it was given one. SigV4
+-- signatures can only be checked with the secret itself, so it is kept
+-- encrypted with the gateway's S3_SECRET_KEY rather than hashed.
+CREATE TABLE IF NOT EXISTS api_keys (
+    key_id VARCHAR(32) PRIMARY KEY,
+    key_hash VARCHAR(64) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    user_id VARCHAR(255) NOT NULL,
+    tenant_id VARCHAR(255),
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    created_by VARCHAR(255),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP,
+    last_used_at TIMESTAMP,
+    revoked_at TIMESTAMP,
+    s3_secret TEXT
+);
+
+-- Storage quotas for a user or a tenant (scope 'user' or 'tenant'); 0
+-- means unlimited. Without a row the gateway's configured defaults apply.
+CREATE TABLE IF NOT EXISTS quotas (
+    scope VARCHAR(10) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    max_bytes BIGINT NOT NULL DEFAULT 0,
+    max_files BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (scope, subject)
+);
+
+-- Completed files counted towards quota usage, one row per file so upload
+-- and delete events are applied exactly once.
+CREATE TABLE IF NOT EXISTS quota_charges (
+    file_id VARCHAR(255) PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL,
+    tenant_id VARCHAR(255),
+    bytes BIGINT NOT NULL,
+    charged_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Running totals of quota_charges per user and tenant
+CREATE TABLE IF NOT EXISTS quota_usage (
+    scope VARCHAR(10) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    bytes_used BIGINT NOT NULL DEFAULT 0,
+    file_count BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (scope, subject)
+);
+
+-- S3 multipart uploads in progress. Each part is a staged file; completing
+-- the upload joins their chunks into the object's file.
+CREATE TABLE IF NOT EXISTS s3_multipart_uploads (
+    upload_id VARCHAR(64) PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL,
+    bucket VARCHAR(255) NOT NULL,
+    object_key TEXT NOT NULL,
+    storage_policy VARCHAR(20) NOT NULL DEFAULT 'replicated',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS s3_multipart_parts (
+    upload_id VARCHAR(64) REFERENCES s3_multipart_uploads(upload_id) ON DELETE CASCADE,
+    part_number INT NOT NULL,
+    file_id VARCHAR(255) REFERENCES files(file_id) ON DELETE CASCADE,
+    etag VARCHAR(64) NOT NULL,
+    part_size BIGINT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (upload_id, part_number)
+);
+
+-- Events to publish to Kafka, written in the same transaction as the
+-- changes they describe. txid is that transaction's ID: rows are relayed
+-- in (txid, id) order once no older transaction is still open.
+CREATE TABLE IF NOT EXISTS outbox (
+    id BIGSERIAL PRIMARY KEY,
+    txid XID8 NOT NULL DEFAULT pg_current_xact_id(),
+    topic VARCHAR(255) NOT NULL,
+    event_key VARCHAR(255) NOT NULL,
+    event_type VARCHAR(100) NOT NULL,
+    payload BYTEA NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMP,
+    published_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
 CREATE INDEX idx_files_status ON files(status);
 CREATE INDEX idx_files_user ON files(user_id);
-CREATE INDEX idx_chunks_file ON chunks(file_id);
\ No newline at end of file
+CREATE INDEX idx_files_tenant ON files(tenant_id);
+CREATE INDEX idx_files_created ON files(created_at, file_id);
+CREATE INDEX idx_files_user_created ON files(user_id, created_at, file_id);
+CREATE INDEX idx_files_name ON files(file_name text_pattern_ops, file_id);
+CREATE UNIQUE INDEX idx_files_dir_name ON files(dir_id, file_name)
+    WHERE status <> 'failed' AND file_id = logical_id AND deleted_at IS NULL;
+CREATE UNIQUE INDEX idx_files_logical_version ON files(logical_id, version);
+CREATE INDEX idx_files_deleted ON files(deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE UNIQUE INDEX idx_directories_root ON directories(user_id) WHERE parent_id IS NULL;
+CREATE UNIQUE INDEX idx_directories_name ON directories(parent_id, name);
+CREATE INDEX idx_chunks_file ON chunks(file_id);
+CREATE INDEX idx_chunks_checksum ON chunks(checksum);
+CREATE INDEX idx_upload_sessions_file ON upload_sessions(file_id);
+CREATE INDEX idx_api_keys_user ON api_keys(user_id);
+CREATE INDEX idx_outbox_pending ON outbox(txid, id) WHERE published_at IS NULL;
+CREATE INDEX idx_outbox_published ON outbox(published_at) WHERE published_at IS NOT NULL;
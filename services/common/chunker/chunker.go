@@ -0,0 +1,82 @@
+// services/common/chunker/chunker.go
+package chunker
+
+import (
+	"fmt"
+	"io"
+)
+
+type Mode string
+
+const (
+	// ModeFixed splits a stream into equal-size chunks.
+	ModeFixed Mode = "fixed"
+	// ModeCDC places chunk boundaries by content (FastCDC), so an insert or
+	// delete only changes the chunks around the edit.
+	ModeCDC Mode = "cdc"
+)
+
+type Options struct {
+	Mode Mode
+
+	// Size is the chunk size in fixed mode.
+	Size int
+
+	// MinSize, AvgSize and MaxSize bound chunk sizes in CDC mode.
+	MinSize int
+	AvgSize int
+	MaxSize int
+}
+
+// Chunker splits a stream into chunks. Next returns io.EOF once the stream
+// is exhausted. The returned slice is only valid until the next call.
+type Chunker interface {
+	Next() ([]byte, error)
+}
+
+// New returns a chunker for r configured by opts.
+func New(r io.Reader, opts Options) (Chunker, error) {
+	switch opts.Mode {
+	case ModeFixed, "":
+		if opts.Size <= 0 {
+			return nil, fmt.Errorf("chunker: fixed chunk size must be positive, got %d", opts.Size)
+		}
+		return NewFixed(r, opts.Size), nil
+	case ModeCDC:
+		return NewFastCDC(r, opts.MinSize, opts.AvgSize, opts.MaxSize)
+	default:
+		return nil, fmt.Errorf("chunker: unknown mode %q", opts.Mode)
+	}
+}
+
+// MaxChunkSize returns the largest chunk a chunker built from opts can emit.
+func (o Options) MaxChunkSize() int {
+	if o.Mode == ModeCDC {
+		return o.MaxSize
+	}
+	return o.Size
+}
+
+type fixed struct {
+	r   io.Reader
+	buf []byte
+}
+
+// NewFixed returns a chunker that emits size-byte chunks; only the last may
+// be shorter.
+func NewFixed(r io.Reader, size int) Chunker {
+	return &fixed{r: r, buf: make([]byte, size)}
+}
+
+func (f *fixed) Next() ([]byte, error) {
+	n, err := io.ReadFull(f.r, f.buf)
+	switch {
+	case err == io.EOF:
+		return nil, io.EOF
+	case err == io.ErrUnexpectedEOF:
+		return f.buf[:n], nil
+	case err != nil:
+		return nil, err
+	}
+	return f.buf[:n], nil
+}
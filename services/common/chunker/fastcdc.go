@@ -0,0 +1,126 @@
+// services/common/chunker/fastcdc.go
+package chunker
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// gear maps each byte to a pseudo-random 64-bit value for the rolling hash.
+// It is derived from a fixed seed: changing it moves every chunk boundary
+// and defeats deduplication against data already stored.
+var gear [256]uint64
+
+func init() {
+	seed := uint64(0x41746c6173465321) // "AtlasFS!"
+	for i := range gear {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+type fastCDC struct {
+	r io.Reader
+
+	minSize int
+	avgSize int
+
+	// Before the average size a boundary needs more zero bits (maskS), after
+	// it fewer (maskL). This normalizes chunk sizes around the average.
+	maskS uint64
+	maskL uint64
+
+	buf        []byte // holds up to MaxSize bytes of unconsumed input
+	start, end int    // unconsumed data is buf[start:end]
+	eof        bool
+}
+
+// NewFastCDC returns a content-defined chunker using FastCDC with
+// normalized chunking. Chunks are at least minSize bytes (except possibly
+// the last), at most maxSize, and average around avgSize.
+func NewFastCDC(r io.Reader, minSize, avgSize, maxSize int) (Chunker, error) {
+	if minSize <= 0 || minSize >= avgSize || avgSize >= maxSize {
+		return nil, fmt.Errorf("chunker: need 0 < min < avg < max, got %d/%d/%d", minSize, avgSize, maxSize)
+	}
+
+	b := bits.Len(uint(avgSize)) - 1 // log2(avgSize), rounded down
+	return &fastCDC{
+		r:       r,
+		minSize: minSize,
+		avgSize: avgSize,
+		maskS:   topBits(b + 1),
+		maskL:   topBits(b - 1),
+		buf:     make([]byte, maxSize),
+	}, nil
+}
+
+// topBits returns a mask of the n most significant bits. The gear hash
+// shifts left, so its high bits are the ones mixed over the whole window.
+func topBits(n int) uint64 {
+	if n <= 0 {
+		return 0
+	}
+	if n >= 64 {
+		return ^uint64(0)
+	}
+	return ^uint64(0) << (64 - n)
+}
+
+func (c *fastCDC) Next() ([]byte, error) {
+	if c.start > 0 {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+	}
+
+	if !c.eof && c.end < len(c.buf) {
+		n, err := io.ReadFull(c.r, c.buf[c.end:])
+		c.end += n
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			c.eof = true
+		case err != nil:
+			return nil, err
+		}
+	}
+
+	if c.end == 0 {
+		return nil, io.EOF
+	}
+
+	c.start = c.cut(c.buf[:c.end])
+	return c.buf[:c.start], nil
+}
+
+// cut returns the length of the next chunk at the start of data.
+func (c *fastCDC) cut(data []byte) int {
+	n := len(data)
+	if n <= c.minSize {
+		return n
+	}
+
+	normal := c.avgSize
+	if n < normal {
+		normal = n
+	}
+
+	var hash uint64
+	i := c.minSize
+	for ; i < normal; i++ {
+		hash = (hash << 1) + gear[data[i]]
+		if hash&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		hash = (hash << 1) + gear[data[i]]
+		if hash&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
@@ -0,0 +1,77 @@
+package chunker
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func split(t *testing.T, data []byte, minSize, avgSize, maxSize int) [][]byte {
+	t.Helper()
+	c, err := NewFastCDC(bytes.NewReader(data), minSize, avgSize, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks [][]byte
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, bytes.Clone(chunk))
+	}
+}
+
+func TestFastCDC(t *testing.T) {
+	cases := []struct {
+		name                      string
+		size                      int
+		minSize, avgSize, maxSize int
+	}{
+		{"small", 64 << 10, 256, 1 << 10, 4 << 10},
+		{"default", 4 << 20, 16 << 10, 64 << 10, 256 << 10},
+		{"narrow", 256 << 10, 1 << 10, 2 << 10, 3 << 10},
+		{"shorter than min", 100, 256, 1 << 10, 4 << 10},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			data := make([]byte, tc.size)
+			rand.New(rand.NewSource(1)).Read(data)
+
+			chunks := split(t, data, tc.minSize, tc.avgSize, tc.maxSize)
+			if got := bytes.Join(chunks, nil); !bytes.Equal(got, data) {
+				t.Fatalf("chunks join to %d bytes, want the %d bytes split", len(got), len(data))
+			}
+			for i, chunk := range chunks {
+				last := i == len(chunks)-1
+				if len(chunk) > tc.maxSize || len(chunk) < tc.minSize && !last {
+					t.Errorf("chunk %d of %d is %d bytes, want %d to %d",
+						i, len(chunks), len(chunk), tc.minSize, tc.maxSize)
+				}
+			}
+
+			// Inserting bytes mid-stream may only change the chunks
+			// around the insert; the rest are found again unchanged.
+			at := tc.size / 2
+			edited := append(append(bytes.Clone(data[:at]), "inserted bytes"...), data[at:]...)
+			seen := make(map[string]bool)
+			for _, chunk := range split(t, edited, tc.minSize, tc.avgSize, tc.maxSize) {
+				seen[string(chunk)] = true
+			}
+			changed := 0
+			for _, chunk := range chunks {
+				if !seen[string(chunk)] {
+					changed++
+				}
+			}
+			if changed > 2 {
+				t.Errorf("%d of %d chunks changed after an insert, want at most 2", changed, len(chunks))
+			}
+		})
+	}
+}
@@ -3,7 +3,9 @@ package config
 
 import (
 	"os"
+	"runtime"
 	"strconv"
+	"time"
 )
 
 type Config struct {
@@ -26,6 +28,122 @@ type Config struct {
 	MinioSecretKey string
 	MinioUseSSL    bool
 
+	// Storage nodes chunk objects are replicated across, as
+	// "<node_id>=<location>,..."; empty means a single node for
+	// StorageDriver ("minio", "local" or "memory")
+	StorageDriver     string
+	StorageLocalPath  string
+	StorageNodes      string
+	ReplicationFactor int
+	RepairInterval    time.Duration
+
+	// Default storage policy for new files: "replicated", "ec" or
+	// "ec:<k>+<m>"; "ec" uses ECDataShards+ECParityShards
+	StoragePolicy  string
+	ECDataShards   int
+	ECParityShards int
+
+	// Chunking: "fixed" or "cdc" (content-defined, sizes in bytes)
+	ChunkingMode string
+	CDCMinSize   int
+	CDCAvgSize   int
+	CDCMaxSize   int
+
+	// Number of chunks the upload service stores in parallel per upload
+	UploadConcurrency int
+
+	// Gateway upload and download proxying: the deadline is base +
+	// size/throughput, capped at max (which also applies when the size is
+	// unknown)
+	UploadTimeoutBase   time.Duration
+	UploadTimeoutMax    time.Duration
+	UploadMinThroughput int64 // bytes per second
+
+	// Garbage collection of unreferenced chunk objects
+	GCSweepInterval time.Duration
+	GCGracePeriod   time.Duration
+
+	// Scrubber: re-reads stored chunks to detect bit rot and lost objects
+	ScrubEnabled        bool
+	ScrubBytesPerSecond int64
+	ScrubPassInterval   time.Duration
+
+	// JWT authentication on the gateway. The gateway will not start
+	// without a key unless AuthDisabled is set, which makes every request
+	// without an API key the anonymous admin.
+	AuthDisabled     bool
+	JWTSecret        string // HS256 shared secret
+	JWTPublicKeyFile string // RS256 public key, PEM
+	JWTJWKSFile      string // RS256 keys by kid, JWKS JSON
+	JWTIssuer        string
+	JWTAudience      string
+	JWTTenantClaim   string
+	AdminScope       string
+
+	// Share links: signed with ShareLinkSecret (a random per-process key
+	// if unset, so links only work on the replica that made them) and
+	// valid for ShareLinkDefaultTTL unless asked otherwise, up to
+	// ShareLinkMaxTTL. PublicURL is the gateway's address in the links.
+	ShareLinkSecret     string
+	ShareLinkDefaultTTL time.Duration
+	ShareLinkMaxTTL     time.Duration
+	PublicURL           string
+
+	// S3-compatible API, served by the gateway on its own port only when
+	// S3Enabled is set. API keys' S3 secret access keys are encrypted at
+	// rest with S3SecretKey, and cannot be issued without it.
+	S3Enabled   bool
+	S3Port      string
+	S3SecretKey string
+
+	// Gateway rate limits, as token buckets in Redis keyed by principal
+	// (or client IP when anonymous). RateLimitIP counts every request by
+	// client IP before its credentials are checked. Request limits are per
+	// RateLimitWindow, byte limits per RateLimitBytesWindow; 0 disables a
+	// limit. RateLimitOverrides sets limits for single principals as
+	// "<principal>.<limit>=<n>,...", e.g. "ci.write=5000,ip:10.0.0.9.read=0".
+	RateLimitEnabled       bool
+	RateLimitWindow        time.Duration
+	RateLimitIP            int
+	RateLimitRead          int
+	RateLimitWrite         int
+	RateLimitAdmin         int
+	RateLimitBytesWindow   time.Duration
+	RateLimitUploadBytes   int64
+	RateLimitDownloadBytes int64
+	RateLimitOverrides     string
+
+	// Default storage quotas per user and per tenant, overridden by rows
+	// in the quotas table; 0 means unlimited. Usage is recomputed from the
+	// files table every QuotaReconcileInterval.
+	QuotaUserBytes         int64
+	QuotaUserFiles         int64
+	QuotaTenantBytes       int64
+	QuotaTenantFiles       int64
+	QuotaReconcileInterval time.Duration
+
+	// File version retention: old versions beyond the newest
+	// VersionRetentionCount, or older than VersionRetentionAge, are pruned
+	// every VersionPruneInterval; 0 keeps them. The current version is
+	// always kept.
+	VersionRetentionCount int
+	VersionRetentionAge   time.Duration
+	VersionPruneInterval  time.Duration
+
+	// Trash: deleted files are purged TrashRetention after deletion, checked
+	// every TrashPurgeInterval; 0 keeps them until purged by hand.
+	TrashRetention     time.Duration
+	TrashPurgeInterval time.Duration
+
+	// Event outbox: the relay polls for unpublished events every
+	// OutboxPollInterval and sends up to OutboxBatchSize at a time. Failed
+	// sends are retried with a backoff doubling up to OutboxMaxBackoff.
+	// Published events are kept for OutboxRetention.
+	OutboxPollInterval time.Duration
+	OutboxBatchSize    int
+	OutboxMaxBackoff   time.Duration
+	OutboxRetention    time.Duration
+
 	// Service
 	Port        string
 	Environment string
@@ -71,6 +189,92 @@ func Load() *Config {
 	cfg.MinioSecretKey = getEnv("MINIO_SECRET_KEY", "")
 	cfg.MinioUseSSL = getEnvBool("MINIO_USE_SSL", false)
 
+	// Replication configuration
+	cfg.StorageDriver = getEnv("STORAGE_DRIVER", "minio")
+	cfg.StorageLocalPath = getEnv("STORAGE_LOCAL_PATH", "/var/lib/atlasfs/chunks")
+	cfg.StorageNodes = getEnv("STORAGE_NODES", "")
+	cfg.ReplicationFactor = getEnvInt("REPLICATION_FACTOR", 1)
+	cfg.RepairInterval = getEnvDuration("REPAIR_INTERVAL", 10*time.Minute)
+	cfg.StoragePolicy = getEnv("STORAGE_POLICY", "replicated")
+	cfg.ECDataShards = getEnvInt("EC_DATA_SHARDS", 4)
+	cfg.ECParityShards = getEnvInt("EC_PARITY_SHARDS", 2)
+
+	// Chunking configuration
+	cfg.ChunkingMode = getEnv("CHUNKING_MODE", "fixed")
+	cfg.CDCMinSize = getEnvInt("CDC_MIN_SIZE", 1*1024*1024)
+	cfg.CDCAvgSize = getEnvInt("CDC_AVG_SIZE", 4*1024*1024)
+	cfg.CDCMaxSize = getEnvInt("CDC_MAX_SIZE", 16*1024*1024)
+	cfg.UploadConcurrency = getEnvInt("UPLOAD_CONCURRENCY", 2*runtime.NumCPU())
+
+	// Upload proxy configuration
+	cfg.UploadTimeoutBase = getEnvDuration("UPLOAD_TIMEOUT_BASE", time.Minute)
+	cfg.UploadTimeoutMax = getEnvDuration("UPLOAD_TIMEOUT_MAX", 12*time.Hour)
+	cfg.UploadMinThroughput = int64(getEnvInt("UPLOAD_MIN_THROUGHPUT", 1024*1024))
+
+	// Garbage collection configuration
+	cfg.GCSweepInterval = getEnvDuration("GC_SWEEP_INTERVAL", time.Hour)
+	cfg.GCGracePeriod = getEnvDuration("GC_GRACE_PERIOD", time.Hour)
+
+	// Scrubber configuration
+	cfg.ScrubEnabled = getEnvBool("SCRUB_ENABLED", true)
+	cfg.ScrubBytesPerSecond = int64(getEnvInt("SCRUB_BYTES_PER_SECOND", 16*1024*1024))
+	cfg.ScrubPassInterval = getEnvDuration("SCRUB_PASS_INTERVAL", 24*time.Hour)
+
+	// Authentication configuration
+	cfg.AuthDisabled = getEnvBool("AUTH_DISABLED", false)
+	cfg.JWTSecret = getEnv("JWT_SECRET", "")
+	cfg.JWTPublicKeyFile = getEnv("JWT_PUBLIC_KEY_FILE", "")
+	cfg.JWTJWKSFile = getEnv("JWT_JWKS_FILE", "")
+	cfg.JWTIssuer = getEnv("JWT_ISSUER", "")
+	cfg.JWTAudience = getEnv("JWT_AUDIENCE", "")
+	cfg.JWTTenantClaim = getEnv("JWT_TENANT_CLAIM", "tenant")
+	cfg.AdminScope = getEnv("ADMIN_SCOPE", "admin")
+
+	// Share link configuration
+	cfg.ShareLinkSecret = getEnv("SHARE_LINK_SECRET", "")
+	cfg.ShareLinkDefaultTTL = getEnvDuration("SHARE_LINK_DEFAULT_TTL", 24*time.Hour)
+	cfg.ShareLinkMaxTTL = getEnvDuration("SHARE_LINK_MAX_TTL", 30*24*time.Hour)
+	cfg.PublicURL = getEnv("PUBLIC_URL", "")
+
+	// S3 API configuration
+	cfg.S3Enabled = getEnvBool("S3_ENABLED", false)
+	cfg.S3Port = getEnv("S3_PORT", "8086")
+	cfg.S3SecretKey = getEnv("S3_SECRET_KEY", "")
+
+	// Rate limiting configuration
+	cfg.RateLimitEnabled = getEnvBool("RATE_LIMIT_ENABLED", true)
+	cfg.RateLimitWindow = getEnvDuration("RATE_LIMIT_WINDOW", time.Minute)
+	cfg.RateLimitIP = getEnvInt("RATE_LIMIT_IP", 1200)
+	cfg.RateLimitRead = getEnvInt("RATE_LIMIT_READ", 600)
+	cfg.RateLimitWrite = getEnvInt("RATE_LIMIT_WRITE", 300)
+	cfg.RateLimitAdmin = getEnvInt("RATE_LIMIT_ADMIN", 60)
+	cfg.RateLimitBytesWindow = getEnvDuration("RATE_LIMIT_BYTES_WINDOW", time.Hour)
+	cfg.RateLimitUploadBytes = int64(getEnvInt("RATE_LIMIT_UPLOAD_BYTES", 20*1024*1024*1024))
+	cfg.RateLimitDownloadBytes = int64(getEnvInt("RATE_LIMIT_DOWNLOAD_BYTES", 100*1024*1024*1024))
+	cfg.RateLimitOverrides = getEnv("RATE_LIMIT_OVERRIDES", "")
+
+	// Quota configuration
+	cfg.QuotaUserBytes = int64(getEnvInt("QUOTA_USER_BYTES", 0))
+	cfg.QuotaUserFiles = int64(getEnvInt("QUOTA_USER_FILES", 0))
+	cfg.QuotaTenantBytes = int64(getEnvInt("QUOTA_TENANT_BYTES", 0))
+	cfg.QuotaTenantFiles = int64(getEnvInt("QUOTA_TENANT_FILES", 0))
+	cfg.QuotaReconcileInterval = getEnvDuration("QUOTA_RECONCILE_INTERVAL", 15*time.Minute)
+
+	// Version retention configuration
+	cfg.VersionRetentionCount = getEnvInt("VERSION_RETENTION_COUNT", 0)
+	cfg.VersionRetentionAge = getEnvDuration("VERSION_RETENTION_AGE", 0)
+	cfg.VersionPruneInterval = getEnvDuration("VERSION_PRUNE_INTERVAL", time.Hour)
+
+	// Trash configuration
+	cfg.TrashRetention = getEnvDuration("TRASH_RETENTION", 30*24*time.Hour)
+	cfg.TrashPurgeInterval = getEnvDuration("TRASH_PURGE_INTERVAL", time.Hour)
+
+	// Outbox configuration
+	cfg.OutboxPollInterval = getEnvDuration("OUTBOX_POLL_INTERVAL", time.Second)
+	cfg.OutboxBatchSize = getEnvInt("OUTBOX_BATCH_SIZE", 100)
+	cfg.OutboxMaxBackoff = getEnvDuration("OUTBOX_MAX_BACKOFF", 5*time.Minute)
+	cfg.OutboxRetention = getEnvDuration("OUTBOX_RETENTION", 24*time.Hour)
+
 	return cfg
 }
 
@@ -98,3 +302,12 @@ func getEnvBool(key string, defaultValue bool) bool {
 	}
 	return defaultValue
 }
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if durationVal, err := time.ParseDuration(value); err == nil {
+			return durationVal
+		}
+	}
+	return defaultValue
+}
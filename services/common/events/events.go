@@ -1,42 +1,217 @@
 // services/common/events/events.go
 package events
 
+//go:generate go run ./gen -out schemas
+
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"reflect"
 	"time"
 )
 
 type EventType string
 
 const (
-	FileUploadStarted   EventType = "file.upload.started"
-	FileUploadCompleted EventType = "file.upload.completed"
-	FileChunkCreated    EventType = "file.chunk.created"
-	FileChunkStored     EventType = "file.chunk.stored"
-	FileDeleted         EventType = "file.deleted"
+	FileUploadStarted     EventType = "file.upload.started"
+	FileUploadCompleted   EventType = "file.upload.completed"
+	FileChunkCreated      EventType = "file.chunk.created"
+	FileChunkStored       EventType = "file.chunk.stored" // reserved, not yet published
+	FileChunkCorrupted    EventType = "file.chunk.corrupted"
+	FileChunkMissing      EventType = "file.chunk.missing"
+	FileDeleted           EventType = "file.deleted"
+	FileDownloadCompleted EventType = "file.download.completed"
+	TestEvent             EventType = "test.event"
 )
 
+// Payload is the data of one type of event. Each type has its own struct
+// in payloads.go, which is its contract with consumers.
+type Payload interface {
+	EventType() EventType
+}
+
+// A payload struct's fields are required unless tagged omitempty, and a
+// required string must not be empty. Any change to a struct other than
+// adding an optional field needs a new schema version.
+var registry = map[EventType]struct {
+	version int
+	new     func() Payload
+}{
+	FileUploadStarted:     {1, func() Payload { return &UploadStartedData{} }},
+	FileUploadCompleted:   {1, func() Payload { return &UploadCompletedData{} }},
+	FileChunkCreated:      {1, func() Payload { return &ChunkCreatedData{} }},
+	FileChunkCorrupted:    {1, func() Payload { return &ChunkCorruptedData{} }},
+	FileChunkMissing:      {1, func() Payload { return &ChunkMissingData{} }},
+	FileDeleted:           {1, func() Payload { return &FileDeletedData{} }},
+	FileDownloadCompleted: {1, func() Payload { return &DownloadCompletedData{} }},
+	TestEvent:             {1, func() Payload { return &TestData{} }},
+}
+
+var (
+	ErrUnknownType        = errors.New("unknown event type")
+	ErrUnsupportedVersion = errors.New("unsupported schema version")
+	ErrInvalid            = errors.New("invalid event")
+)
+
+// Types returns every event type that has a payload.
+func Types() []EventType {
+	types := make([]EventType, 0, len(registry))
+	for t := range registry {
+		types = append(types, t)
+	}
+	return types
+}
+
+// SchemaVersion returns the version of an event type's payload that this
+// build produces and accepts, or 0 for an unknown type.
+func SchemaVersion(t EventType) int {
+	return registry[t].version
+}
+
 type Event struct {
-	ID        string                 `json:"id"`
-	Type      EventType              `json:"type"`
-	Timestamp time.Time              `json:"timestamp"`
-	Source    string                 `json:"source"`
-	Data      map[string]interface{} `json:"data"`
+	ID            string          `json:"id"`
+	Type          EventType       `json:"type"`
+	SchemaVersion int             `json:"schema_version"`
+	Timestamp     time.Time       `json:"timestamp"`
+	Source        string          `json:"source"`
+	Data          json.RawMessage `json:"data"`
+
+	payload Payload
 }
 
-// This signature matches what your gateway expects: (eventType, source, data)
-func NewEvent(eventType EventType, source string, data map[string]interface{}) *Event {
+// NewEvent wraps a payload in an event from source. It is encoded, and
+// checked, by ToJSON.
+func NewEvent(source string, payload Payload) *Event {
 	return &Event{
-		ID:        fmt.Sprintf("evt_%d", time.Now().UnixNano()),
-		Type:      eventType,
-		Timestamp: time.Now(),
-		Source:    source,
-		Data:      data,
+		ID:            fmt.Sprintf("evt_%d", time.Now().UnixNano()),
+		Type:          payload.EventType(),
+		SchemaVersion: SchemaVersion(payload.EventType()),
+		Timestamp:     time.Now(),
+		Source:        source,
+		payload:       payload,
 	}
 }
 
-// Add the ToJSON method that gateway uses
+// ToJSON validates the event and encodes it.
 func (e *Event) ToJSON() ([]byte, error) {
+	if e.payload == nil {
+		return nil, fmt.Errorf("%w: %s has no payload", ErrInvalid, e.Type)
+	}
+	if err := e.check(); err != nil {
+		return nil, err
+	}
+	if err := validate(reflect.ValueOf(e.payload), nil); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalid, e.Type, err)
+	}
+	data, err := json.Marshal(e.payload)
+	if err != nil {
+		return nil, err
+	}
+	e.Data = data
 	return json.Marshal(e)
 }
+
+// Decode parses and validates an event. Its payload is available from
+// Payload. Events from before payloads were versioned, which have no
+// schema_version, are read as version 1. Events of types or versions this
+// build does not know are rejected with ErrUnknownType or
+// ErrUnsupportedVersion; other problems with ErrInvalid.
+func Decode(b []byte) (*Event, error) {
+	var e Event
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	legacy := e.SchemaVersion == 0
+	if legacy {
+		e.SchemaVersion = 1
+	}
+	if err := e.check(); err != nil {
+		return nil, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(e.Data, &fields); err != nil || fields == nil {
+		return nil, fmt.Errorf("%w: %s data is not an object", ErrInvalid, e.Type)
+	}
+	if legacy {
+		upcastLegacy(e.Type, fields)
+		e.Data, _ = json.Marshal(fields)
+	}
+	payload := registry[e.Type].new()
+	if err := json.Unmarshal(e.Data, payload); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalid, e.Type, err)
+	}
+	if err := validate(reflect.ValueOf(payload), fields); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalid, e.Type, err)
+	}
+	e.payload = reflect.ValueOf(payload).Elem().Interface().(Payload)
+	return &e, nil
+}
+
+// Payload returns the event's data, one of the structs in payloads.go.
+func (e *Event) Payload() Payload {
+	return e.payload
+}
+
+// upcastLegacy renames the fields of an unversioned event's data to those
+// of version 1.
+func upcastLegacy(t EventType, fields map[string]json.RawMessage) {
+	rename := func(from, to string) {
+		if v, ok := fields[from]; ok {
+			if _, exists := fields[to]; !exists {
+				fields[to] = v
+			}
+			delete(fields, from)
+		}
+	}
+	switch t {
+	case FileUploadCompleted:
+		rename("filename", "file_name")
+	case FileChunkCorrupted, FileChunkMissing:
+		// Only the scrubber named itself; the chunk's checksum was left out
+		// when a download found a corrupt whole copy, which it matches
+		rename("source", "detected_by")
+		if _, ok := fields["detected_by"]; !ok {
+			fields["detected_by"] = json.RawMessage(`"download"`)
+		}
+		if _, ok := fields["checksum"]; !ok && string(fields["shard_index"]) == "-1" {
+			fields["checksum"] = fields["expected_checksum"]
+		}
+	}
+}
+
+func (e *Event) check() error {
+	entry, ok := registry[e.Type]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownType, e.Type)
+	}
+	if e.SchemaVersion != entry.version {
+		return fmt.Errorf("%w: %s v%d", ErrUnsupportedVersion, e.Type, e.SchemaVersion)
+	}
+	if e.ID == "" || e.Source == "" || e.Timestamp.IsZero() {
+		return fmt.Errorf("%w: %s is missing its id, source or timestamp", ErrInvalid, e.Type)
+	}
+	return nil
+}
+
+// validate checks a payload's required fields. When decoding, present
+// holds the keys that were in the data, since a missing number or bool
+// cannot be told from a zero one once decoded.
+func validate(v reflect.Value, present map[string]json.RawMessage) error {
+	v = reflect.Indirect(v)
+	for _, f := range payloadFields(v.Type()) {
+		if !f.required {
+			continue
+		}
+		if present != nil {
+			if raw, ok := present[f.name]; !ok || string(raw) == "null" {
+				return fmt.Errorf("%s is required", f.name)
+			}
+		}
+		if fv := v.Field(f.index); fv.Kind() == reflect.String && fv.Len() == 0 {
+			return fmt.Errorf("%s must not be empty", f.name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package events
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// envelope wraps data in an event of type t. A version of 0 leaves out
+// schema_version, as events from before payloads were versioned did.
+func envelope(t EventType, version int, data string) []byte {
+	schemaVersion := ""
+	if version > 0 {
+		schemaVersion = fmt.Sprintf(`"schema_version": %d, `, version)
+	}
+	return []byte(fmt.Sprintf(`{"id": "evt_1", "type": %q, %s"timestamp": "2024-01-02T03:04:05Z", "source": "test", "data": %s}`,
+		t, schemaVersion, data))
+}
+
+func TestDecode(t *testing.T) {
+	cases := []struct {
+		name    string
+		event   []byte
+		want    Payload
+		wantErr error
+	}{
+		{
+			name:  "upload completed v0",
+			event: envelope(FileUploadCompleted, 0, `{"file_id": "f1", "filename": "a.txt", "size": 10, "chunk_count": 1}`),
+			want:  UploadCompletedData{FileID: "f1", FileName: "a.txt", Size: 10, ChunkCount: 1},
+		},
+		{
+			name:  "upload completed v1",
+			event: envelope(FileUploadCompleted, 1, `{"file_id": "f1", "file_name": "a.txt", "size": 10, "chunk_count": 1}`),
+			want:  UploadCompletedData{FileID: "f1", FileName: "a.txt", Size: 10, ChunkCount: 1},
+		},
+		{
+			name: "chunk corrupted v0 from a download",
+			event: envelope(FileChunkCorrupted, 0, `{"node_id": "n1", "storage_path": "p", "shard_index": -1,
+				"expected_checksum": "abc", "actual_checksum": "def", "expected_size": 5}`),
+			want: ChunkCorruptedData{Checksum: "abc", NodeID: "n1", StoragePath: "p", ShardIndex: -1,
+				ExpectedChecksum: "abc", ActualChecksum: "def", ExpectedSize: 5, DetectedBy: "download"},
+		},
+		{
+			name: "chunk corrupted v0 from the scrubber",
+			event: envelope(FileChunkCorrupted, 0, `{"checksum": "abc", "node_id": "n1", "storage_path": "p", "shard_index": 2,
+				"expected_checksum": "s2", "actual_checksum": "def", "expected_size": 5, "source": "scrubber"}`),
+			want: ChunkCorruptedData{Checksum: "abc", NodeID: "n1", StoragePath: "p", ShardIndex: 2,
+				ExpectedChecksum: "s2", ActualChecksum: "def", ExpectedSize: 5, DetectedBy: "scrubber"},
+		},
+		{
+			name: "chunk corrupted v1",
+			event: envelope(FileChunkCorrupted, 1, `{"checksum": "abc", "node_id": "n1", "storage_path": "p", "shard_index": -1,
+				"expected_checksum": "abc", "actual_checksum": "def", "expected_size": 5, "detected_by": "scrubber"}`),
+			want: ChunkCorruptedData{Checksum: "abc", NodeID: "n1", StoragePath: "p", ShardIndex: -1,
+				ExpectedChecksum: "abc", ActualChecksum: "def", ExpectedSize: 5, DetectedBy: "scrubber"},
+		},
+		{
+			name: "chunk missing v0",
+			event: envelope(FileChunkMissing, 0, `{"checksum": "abc", "node_id": "n1", "storage_path": "p",
+				"shard_index": -1, "expected_size": 5, "source": "scrubber"}`),
+			want: ChunkMissingData{Checksum: "abc", NodeID: "n1", StoragePath: "p", ShardIndex: -1,
+				ExpectedSize: 5, DetectedBy: "scrubber"},
+		},
+		{
+			name: "chunk missing v1",
+			event: envelope(FileChunkMissing, 1, `{"checksum": "abc", "node_id": "n1", "storage_path": "p",
+				"shard_index": -1, "expected_size": 5, "detected_by": "download"}`),
+			want: ChunkMissingData{Checksum: "abc", NodeID: "n1", StoragePath: "p", ShardIndex: -1,
+				ExpectedSize: 5, DetectedBy: "download"},
+		},
+
+		// A v1 event is not upcast, so the old names do not stand in
+		{
+			name:    "upload completed v1 with the v0 file name",
+			event:   envelope(FileUploadCompleted, 1, `{"file_id": "f1", "filename": "a.txt", "size": 10, "chunk_count": 1}`),
+			wantErr: ErrInvalid,
+		},
+		{
+			name:    "missing number",
+			event:   envelope(FileUploadCompleted, 1, `{"file_id": "f1", "file_name": "a.txt", "chunk_count": 1}`),
+			wantErr: ErrInvalid,
+		},
+		{
+			name:    "empty string",
+			event:   envelope(FileUploadCompleted, 1, `{"file_id": "", "file_name": "a.txt", "size": 10, "chunk_count": 1}`),
+			wantErr: ErrInvalid,
+		},
+		{
+			name: "null field",
+			event: envelope(FileChunkMissing, 1, `{"checksum": "abc", "node_id": "n1", "storage_path": "p",
+				"shard_index": null, "expected_size": 5, "detected_by": "download"}`),
+			wantErr: ErrInvalid,
+		},
+		{
+			name: "chunk corrupted v0 shard without its checksum",
+			event: envelope(FileChunkCorrupted, 0, `{"node_id": "n1", "storage_path": "p", "shard_index": 2,
+				"expected_checksum": "s2", "actual_checksum": "def", "expected_size": 5}`),
+			wantErr: ErrInvalid,
+		},
+		{
+			name:    "unknown version",
+			event:   envelope(FileUploadCompleted, 2, `{"file_id": "f1", "file_name": "a.txt", "size": 10, "chunk_count": 1}`),
+			wantErr: ErrUnsupportedVersion,
+		},
+		{
+			name:    "unknown type",
+			event:   envelope("file.renamed", 1, `{}`),
+			wantErr: ErrUnknownType,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			e, err := Decode(tc.event)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("Decode() error = %v, want %v", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if e.SchemaVersion != 1 {
+				t.Errorf("SchemaVersion = %d, want 1", e.SchemaVersion)
+			}
+			if got := e.Payload(); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Payload() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
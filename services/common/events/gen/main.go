@@ -0,0 +1,34 @@
+// services/common/events/gen/main.go
+
+// Command gen writes the JSON Schema of every event type, one file per
+// type and version, for consumers outside this module.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"atlasfs/services/common/events"
+)
+
+func main() {
+	out := flag.String("out", "schemas", "directory to write the schemas to")
+	flag.Parse()
+
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		log.Fatal(err)
+	}
+	for _, t := range events.Types() {
+		schema, err := events.Schema(t)
+		if err != nil {
+			log.Fatal(err)
+		}
+		name := fmt.Sprintf("%s.v%d.json", t, events.SchemaVersion(t))
+		if err := os.WriteFile(filepath.Join(*out, name), append(schema, '\n'), 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
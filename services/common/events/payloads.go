@@ -0,0 +1,111 @@
+// services/common/events/payloads.go
+package events
+
+// UploadStartedData is published when a resumable upload session opens.
+type UploadStartedData struct {
+	FileID      string `json:"file_id"`
+	SessionID   string `json:"session_id"`
+	Size        int64  `json:"size"`
+	TotalChunks int    `json:"total_chunks"`
+}
+
+func (UploadStartedData) EventType() EventType { return FileUploadStarted }
+
+// UploadCompletedData is published when a file or a new version of one is
+// complete: uploaded, assembled from S3 parts or restored from an older
+// version.
+type UploadCompletedData struct {
+	FileID     string `json:"file_id"`
+	FileName   string `json:"file_name"`
+	Size       int64  `json:"size"`
+	ChunkCount int    `json:"chunk_count"`
+
+	LogicalID    string `json:"logical_id,omitempty"`    // set for a restored version
+	RestoredFrom string `json:"restored_from,omitempty"` // the version it was restored from
+	Parts        int    `json:"parts,omitempty"`         // set for an S3 multipart upload
+}
+
+func (UploadCompletedData) EventType() EventType { return FileUploadCompleted }
+
+// ChunkCreatedData is published when a chunk of a file is stored.
+type ChunkCreatedData struct {
+	FileID   string `json:"file_id"`
+	ChunkID  string `json:"chunk_id"`
+	Index    int    `json:"index"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+}
+
+func (ChunkCreatedData) EventType() EventType { return FileChunkCreated }
+
+// ChunkCorruptedData is published when a copy or shard of a chunk does not
+// match its checksum, found either while serving a download, which knows
+// the file, or by the scrubber, which lists the files using the chunk.
+type ChunkCorruptedData struct {
+	Checksum         string `json:"checksum"` // the chunk's, which names its objects
+	NodeID           string `json:"node_id"`
+	StoragePath      string `json:"storage_path"`
+	ShardIndex       int    `json:"shard_index"` // -1 for a whole copy
+	ExpectedChecksum string `json:"expected_checksum"`
+	ActualChecksum   string `json:"actual_checksum"`
+	ExpectedSize     int64  `json:"expected_size"`
+	DetectedBy       string `json:"detected_by"` // "download" or "scrubber"
+
+	FileID     string   `json:"file_id,omitempty"`
+	ChunkID    string   `json:"chunk_id,omitempty"`
+	Index      *int     `json:"index,omitempty"`
+	ActualSize *int64   `json:"actual_size,omitempty"`
+	FileIDs    []string `json:"file_ids,omitempty"`
+}
+
+func (ChunkCorruptedData) EventType() EventType { return FileChunkCorrupted }
+
+// ChunkMissingData is published by the scrubber when a copy or shard of a
+// chunk is not on the node it is recorded on, or a chunk has no copies.
+type ChunkMissingData struct {
+	Checksum     string `json:"checksum"`
+	NodeID       string `json:"node_id"`
+	StoragePath  string `json:"storage_path"`
+	ShardIndex   int    `json:"shard_index"` // -1 for a whole copy
+	ExpectedSize int64  `json:"expected_size"`
+	DetectedBy   string `json:"detected_by"`
+
+	FileIDs []string `json:"file_ids,omitempty"`
+}
+
+func (ChunkMissingData) EventType() EventType { return FileChunkMissing }
+
+// FileDeletedData is published when a file version is deleted or pruned.
+// Checksums are the chunk objects it referenced, for the collector.
+type FileDeletedData struct {
+	FileID   string `json:"file_id"`
+	FileName string `json:"file_name"`
+	Size     int64  `json:"size"`
+
+	UserID    string   `json:"user_id,omitempty"`
+	Checksums []string `json:"checksums,omitempty"`
+	LogicalID string   `json:"logical_id,omitempty"` // set for a pruned version
+	Version   int      `json:"version,omitempty"`
+	Pruned    bool     `json:"pruned,omitempty"`
+}
+
+func (FileDeletedData) EventType() EventType { return FileDeleted }
+
+// DownloadCompletedData is published when a file has been sent in full.
+type DownloadCompletedData struct {
+	FileID     string `json:"file_id"`
+	FileName   string `json:"file_name"`
+	BytesSent  int64  `json:"bytes_sent"`
+	ChunkCount int    `json:"chunk_count"`
+	ClientIP   string `json:"client_ip"`
+}
+
+func (DownloadCompletedData) EventType() EventType { return FileDownloadCompleted }
+
+// TestData is published by the gateway's Kafka check.
+type TestData struct {
+	Test      bool  `json:"test"`
+	Timestamp int64 `json:"timestamp"`
+}
+
+func (TestData) EventType() EventType { return TestEvent }
@@ -0,0 +1,95 @@
+// services/common/events/schema.go
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+type payloadField struct {
+	name     string
+	index    int
+	required bool
+}
+
+// payloadFields lists a payload struct's JSON fields.
+func payloadFields(t reflect.Type) []payloadField {
+	var fields []payloadField
+	for i := 0; i < t.NumField(); i++ {
+		name, opts, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" || !t.Field(i).IsExported() {
+			continue
+		}
+		fields = append(fields, payloadField{
+			name:     name,
+			index:    i,
+			required: opts != "omitempty" && t.Field(i).Type.Kind() != reflect.Pointer,
+		})
+	}
+	return fields
+}
+
+// Schema returns the JSON Schema of an event type at its current version,
+// describing the whole event with its data.
+func Schema(t EventType) ([]byte, error) {
+	entry, ok := registry[t]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownType, t)
+	}
+
+	payload := reflect.TypeOf(entry.new()).Elem()
+	properties := map[string]interface{}{}
+	required := []string{}
+	for _, f := range payloadFields(payload) {
+		property := typeSchema(payload.Field(f.index).Type)
+		if f.required {
+			required = append(required, f.name)
+			if property["type"] == "string" {
+				property["minLength"] = 1
+			}
+		}
+		properties[f.name] = property
+	}
+
+	schema := map[string]interface{}{
+		"$schema":  "https://json-schema.org/draft/2020-12/schema",
+		"$id":      fmt.Sprintf("urn:atlasfs:event:%s:v%d", t, entry.version),
+		"title":    string(t),
+		"type":     "object",
+		"required": []string{"id", "type", "schema_version", "timestamp", "source", "data"},
+		"properties": map[string]interface{}{
+			"id":             map[string]interface{}{"type": "string", "minLength": 1},
+			"type":           map[string]interface{}{"const": string(t)},
+			"schema_version": map[string]interface{}{"const": entry.version},
+			"timestamp":      map[string]interface{}{"type": "string", "format": "date-time"},
+			"source":         map[string]interface{}{"type": "string", "minLength": 1},
+			"data": map[string]interface{}{
+				"type":       "object",
+				"required":   required,
+				"properties": properties,
+			},
+		},
+	}
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return typeSchema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	}
+	panic(fmt.Sprintf("events: no JSON Schema for %s", t))
+}
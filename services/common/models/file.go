@@ -11,6 +11,8 @@ const (
 	StatusProcessing FileStatus = "processing"
 	StatusCompleted  FileStatus = "completed"
 	StatusFailed     FileStatus = "failed"
+	StatusDegraded   FileStatus = "degraded" // a chunk has no intact copy left
+	StatusPruned     FileStatus = "pruned"   // an old version whose chunks were released
 )
 
 type File struct {
@@ -0,0 +1,251 @@
+// services/common/outbox/outbox.go
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/segmentio/kafka-go"
+
+	"atlasfs/services/common/config"
+	"atlasfs/services/common/events"
+)
+
+// Events are not written to Kafka directly. Add records an event in the
+// outbox table in the same transaction as the change it describes, so
+// the event exists if and only if the change was committed, and a Relay
+// publishes the table to Kafka at least once. Consumers must therefore
+// tolerate duplicates.
+//
+// Row ids are assigned at insert, not at commit, so each row also records
+// the ID of the transaction that added it, and is only relayed once every
+// transaction with a lower ID has finished. Events go out in transaction
+// ID order, then in the order they were added, and one that commits late
+// is never skipped past. A transaction gets its ID at its first write, so
+// this is commit order for transactions that lock the rows they contend
+// for before writing. A transaction left open holds back every event
+// after it.
+
+// Topic is where file events are published.
+const Topic = "file.events"
+
+// lockID is the advisory lock a relay holds while it publishes, so only
+// one relay across every service and replica sends at a time and events
+// go out in order.
+const lockID = 0x6f7574626f78 // "outbox"
+
+// Execer is satisfied by both *sql.DB and *sql.Tx.
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Add records event to be published under key. q should be the
+// transaction making the change the event describes.
+func Add(ctx context.Context, q Execer, key string, event *events.Event) error {
+	payload, err := event.ToJSON()
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, `
+        INSERT INTO outbox (topic, event_key, event_type, payload)
+        VALUES ($1, $2, $3, $4)
+    `, Topic, key, string(event.Type), payload)
+	return err
+}
+
+// Record adds an event that does not go with a change to the database,
+// such as a finished download, logging rather than returning a failure.
+// Without a database the event is dropped.
+func Record(db *sql.DB, key string, event *events.Event) {
+	if db == nil {
+		return
+	}
+	if err := Add(context.Background(), db, key, event); err != nil {
+		log.Printf("Failed to record %s event for %s: %v", event.Type, key, err)
+	}
+}
+
+// Relay publishes the outbox to Kafka.
+type Relay struct {
+	db     *sql.DB
+	writer *kafka.Writer
+	config *config.Config
+}
+
+// NewRelay returns a relay for the outbox in db. Its writer partitions by
+// key, so the events about one file or chunk keep their order in Kafka.
+func NewRelay(cfg *config.Config, db *sql.DB) *Relay {
+	return &Relay{
+		db: db,
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(cfg.KafkaBrokers...),
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			BatchSize:    max(cfg.OutboxBatchSize, 1),
+			BatchTimeout: 10 * time.Millisecond,
+		},
+		config: cfg,
+	}
+}
+
+// Run publishes pending events every poll interval until ctx is done,
+// and removes published events once they are past retention.
+func (r *Relay) Run(ctx context.Context) {
+	defer r.writer.Close()
+	log.Printf("✅ Outbox relay publishing to %s", Topic)
+
+	ticker := time.NewTicker(r.config.OutboxPollInterval)
+	defer ticker.Stop()
+
+	var cleaned time.Time
+	for {
+		// A full batch means there may be more waiting
+		for {
+			n, err := r.relayBatch(ctx)
+			if err != nil {
+				log.Printf("Outbox relay failed: %v", err)
+			}
+			if err != nil || n < r.writer.BatchSize {
+				break
+			}
+		}
+
+		if r.config.OutboxRetention > 0 && time.Since(cleaned) > time.Hour {
+			if err := r.cleanup(ctx); err != nil {
+				log.Printf("Outbox cleanup failed: %v", err)
+			}
+			cleaned = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type pending struct {
+	id       int64
+	topic    string
+	key      string
+	payload  []byte
+	attempts int
+	waiting  bool
+}
+
+// relayBatch publishes the oldest unpublished events and returns how many
+// it published. A batch that fails is retried as a whole after a backoff,
+// and nothing after it is published meanwhile, to keep the order.
+func (r *Relay) relayBatch(ctx context.Context) (int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRowContext(ctx, `SELECT pg_try_advisory_xact_lock($1)`, lockID).Scan(&locked); err != nil {
+		return 0, err
+	}
+	if !locked {
+		return 0, nil // another relay is publishing
+	}
+
+	// Rows of transactions still in progress are not visible yet; those of
+	// later ones that committed wait for them
+	rows, err := tx.QueryContext(ctx, `
+        SELECT id, topic, event_key, payload, attempts, COALESCE(next_attempt_at > NOW(), false)
+        FROM outbox
+        WHERE published_at IS NULL AND txid < pg_snapshot_xmin(pg_current_snapshot())
+        ORDER BY txid, id
+        LIMIT $1
+    `, r.writer.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var batch []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.topic, &p.key, &p.payload, &p.attempts, &p.waiting); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(batch) == 0 || batch[0].waiting {
+		return 0, nil
+	}
+
+	ids := make([]int64, len(batch))
+	messages := make([]kafka.Message, len(batch))
+	for i, p := range batch {
+		ids[i] = p.id
+		messages[i] = kafka.Message{Topic: p.topic, Key: []byte(p.key), Value: p.payload}
+	}
+
+	if sendErr := r.writer.WriteMessages(ctx, messages...); sendErr != nil {
+		attempts := batch[0].attempts + 1
+		backoff := r.backoff(attempts)
+		_, err := tx.ExecContext(ctx, `
+            UPDATE outbox
+            SET attempts = attempts + 1, last_error = $2, next_attempt_at = NOW() + make_interval(secs => $3)
+            WHERE id = ANY($1)
+        `, pq.Array(ids), sendErr.Error(), backoff.Seconds())
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("Failed to record outbox delivery failure: %v", err)
+		}
+		return 0, fmt.Errorf("publish %d events from %d (attempt %d, next in %s): %w",
+			len(batch), batch[0].id, attempts, backoff, sendErr)
+	}
+
+	// Should this fail the events are published again, which at least
+	// once allows
+	_, err = tx.ExecContext(ctx, `
+        UPDATE outbox
+        SET attempts = attempts + 1, last_error = NULL, next_attempt_at = NULL, published_at = NOW()
+        WHERE id = ANY($1)
+    `, pq.Array(ids))
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return 0, fmt.Errorf("mark %d events published: %w", len(batch), err)
+	}
+	return len(batch), nil
+}
+
+// backoff doubles from the poll interval with each failed attempt, up to
+// the maximum.
+func (r *Relay) backoff(attempts int) time.Duration {
+	backoff := r.config.OutboxPollInterval
+	for i := 1; i < attempts && backoff < r.config.OutboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, r.config.OutboxMaxBackoff)
+}
+
+// cleanup deletes events published longer ago than the retention period.
+func (r *Relay) cleanup(ctx context.Context) error {
+	result, err := r.db.ExecContext(ctx, `
+        DELETE FROM outbox WHERE published_at < $1
+    `, time.Now().Add(-r.config.OutboxRetention))
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("🧹 Removed %d published events from the outbox", n)
+	}
+	return nil
+}
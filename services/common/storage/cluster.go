@@ -0,0 +1,212 @@
+// services/common/storage/cluster.go
+package storage
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sort"
+	"strings"
+
+	"atlasfs/services/common/config"
+)
+
+// Cluster is the set of storage nodes chunk objects are replicated across.
+type Cluster struct {
+	Nodes []*Node
+
+	byID     map[string]*Node
+	replicas int
+}
+
+// Storage drivers, selected per node by URL scheme or, for nodes without
+// one, by STORAGE_DRIVER.
+const (
+	DriverMinio  = "minio"
+	DriverLocal  = "local"
+	DriverMemory = "memory"
+)
+
+// NewCluster builds the cluster described by STORAGE_NODES, a comma
+// separated list of "<node_id>=<location>" entries. A location is
+// "minio://<endpoint>[/<bucket>]", "local://<directory>" or "memory://";
+// without a scheme it is read according to STORAGE_DRIVER. MinIO nodes
+// share the MinIO credentials. Without STORAGE_NODES the cluster is a
+// single node for the configured driver: MINIO_ENDPOINT as "minio-0", so
+// existing deployments keep reading the default bucket, STORAGE_LOCAL_PATH
+// as "local-0", or "memory-0".
+func NewCluster(cfg *config.Config) (*Cluster, error) {
+	spec := cfg.StorageNodes
+	if spec == "" {
+		switch cfg.StorageDriver {
+		case DriverLocal:
+			spec = "local-0=" + cfg.StorageLocalPath
+		case DriverMemory:
+			spec = "memory-0=memory://"
+		default:
+			spec = "minio-0=" + cfg.MinioEndpoint
+		}
+	}
+
+	c := &Cluster{byID: make(map[string]*Node)}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, location, ok := strings.Cut(entry, "=")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("storage: bad node %q, want <node_id>=<location>", entry)
+		}
+		if _, dup := c.byID[id]; dup {
+			return nil, fmt.Errorf("storage: node %s listed twice", id)
+		}
+
+		store, err := openStore(cfg, location)
+		if err != nil {
+			return nil, fmt.Errorf("storage: node %s: %w", id, err)
+		}
+		node := NewNode(id, store)
+		c.Nodes = append(c.Nodes, node)
+		c.byID[id] = node
+	}
+	if len(c.Nodes) == 0 {
+		return nil, fmt.Errorf("storage: no nodes configured")
+	}
+
+	c.replicas = min(max(cfg.ReplicationFactor, 1), len(c.Nodes))
+	if c.replicas < cfg.ReplicationFactor {
+		log.Printf("⚠️ Replication factor %d exceeds the %d storage nodes, using %d",
+			cfg.ReplicationFactor, len(c.Nodes), c.replicas)
+	}
+	if shards := cfg.ECDataShards + cfg.ECParityShards; shards > len(c.Nodes) {
+		log.Printf("⚠️ Erasure coding with %d shards on %d storage nodes puts several shards on one node",
+			shards, len(c.Nodes))
+	}
+	return c, nil
+}
+
+// Replicas is the number of copies each chunk object should have.
+func (c *Cluster) Replicas() int {
+	return c.replicas
+}
+
+// Node returns the node with the given ID, or nil if it is not configured.
+func (c *Cluster) Node(id string) *Node {
+	return c.byID[id]
+}
+
+// openStore opens the ChunkStore a node location describes.
+func openStore(cfg *config.Config, location string) (ChunkStore, error) {
+	driver, rest, ok := strings.Cut(location, "://")
+	if !ok {
+		driver, rest = cfg.StorageDriver, location
+	}
+
+	switch driver {
+	case DriverMinio, "s3":
+		endpoint, bucket, _ := strings.Cut(rest, "/")
+		if endpoint == "" {
+			return nil, fmt.Errorf("minio location %q has no endpoint", location)
+		}
+		return NewMinioStore(endpoint, bucket, cfg.MinioAccessKey, cfg.MinioSecretKey, cfg.MinioUseSSL)
+	case DriverLocal, "file":
+		return NewLocalStore(rest)
+	case DriverMemory:
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", driver)
+	}
+}
+
+// EnsureBuckets creates missing buckets on every MinIO node, logging
+// failures so one unreachable node does not stop the service from starting.
+func (c *Cluster) EnsureBuckets(ctx context.Context) {
+	for _, node := range c.Nodes {
+		store, ok := node.Store.(*MinioStore)
+		if !ok {
+			continue
+		}
+		created, err := store.EnsureBucket(ctx)
+		switch {
+		case err != nil:
+			log.Printf("Failed to create bucket %s on node %s: %v", store.bucket, node.ID, err)
+		case created:
+			log.Printf("✅ Created bucket %s on node %s", store.bucket, node.ID)
+		}
+	}
+}
+
+// Placement orders every node by preference for storing key, using
+// rendezvous hashing so a key keeps its nodes when others are added or
+// removed. Healthy nodes come first; the first Replicas() that accept a
+// write hold the object.
+func (c *Cluster) Placement(key string) []*Node {
+	type ranked struct {
+		node    *Node
+		healthy bool
+		score   uint64
+	}
+	ranking := make([]ranked, len(c.Nodes))
+	for i, node := range c.Nodes {
+		h := fnv.New64a()
+		h.Write([]byte(node.ID))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		ranking[i] = ranked{node: node, healthy: node.Healthy(), score: h.Sum64()}
+	}
+	sort.Slice(ranking, func(i, j int) bool {
+		if ranking[i].healthy != ranking[j].healthy {
+			return ranking[i].healthy
+		}
+		return ranking[i].score > ranking[j].score
+	})
+
+	nodes := make([]*Node, len(ranking))
+	for i, r := range ranking {
+		nodes[i] = r.node
+	}
+	return nodes
+}
+
+// Health pings every node and reports "healthy" or "unhealthy" per node ID.
+func (c *Cluster) Health(ctx context.Context) map[string]string {
+	health := make(map[string]string, len(c.Nodes))
+	for _, node := range c.Nodes {
+		if err := node.Ping(ctx); err != nil {
+			health[node.ID] = "unhealthy"
+		} else {
+			health[node.ID] = "healthy"
+		}
+	}
+	return health
+}
+
+// Summarize folds per-node health into one value: "healthy" if every node
+// is, "degraded" if only some are and "unhealthy" if none are.
+func Summarize(health map[string]string) string {
+	healthy := 0
+	for _, status := range health {
+		if status == "healthy" {
+			healthy++
+		}
+	}
+	switch {
+	case healthy == len(health):
+		return "healthy"
+	case healthy > 0:
+		return "degraded"
+	default:
+		return "unhealthy"
+	}
+}
+
+// ResolvePolicy parses a file's storage policy, falling back to the
+// configured default when name is empty.
+func ResolvePolicy(cfg *config.Config, name string) (Policy, error) {
+	if name == "" {
+		name = cfg.StoragePolicy
+	}
+	return ParsePolicy(name, Policy{DataShards: cfg.ECDataShards, ParityShards: cfg.ECParityShards})
+}
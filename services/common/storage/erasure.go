@@ -0,0 +1,171 @@
+// services/common/storage/erasure.go
+package storage
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// PolicyReplicated stores whole copies of every chunk object, as many as
+// the replication factor.
+const PolicyReplicated = "replicated"
+
+// NoShard is the shard index recorded for a whole copy of a chunk object.
+const NoShard = -1
+
+// Policy describes how a chunk object is laid out on the storage nodes:
+// whole copies when DataShards is zero, otherwise DataShards Reed-Solomon
+// data shards plus ParityShards parity shards, any DataShards of which
+// rebuild the chunk.
+type Policy struct {
+	DataShards   int
+	ParityShards int
+}
+
+// ParsePolicy parses "replicated", "ec" (erasure coding with the default
+// shard counts) or "ec:<k>+<m>". The empty string is "replicated".
+func ParsePolicy(s string, defaultEC Policy) (Policy, error) {
+	switch s {
+	case "", PolicyReplicated:
+		return Policy{}, nil
+	case "ec":
+		return defaultEC, defaultEC.validate()
+	}
+
+	spec, ok := strings.CutPrefix(s, "ec:")
+	if !ok {
+		return Policy{}, fmt.Errorf("storage: unknown policy %q, want %q, \"ec\" or \"ec:<k>+<m>\"", s, PolicyReplicated)
+	}
+	k, m, ok := strings.Cut(spec, "+")
+	data, err1 := strconv.Atoi(k)
+	parity, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil {
+		return Policy{}, fmt.Errorf("storage: bad erasure coding policy %q, want \"ec:<k>+<m>\"", s)
+	}
+	p := Policy{DataShards: data, ParityShards: parity}
+	return p, p.validate()
+}
+
+func (p Policy) validate() error {
+	if p.DataShards < 1 || p.ParityShards < 1 || p.DataShards+p.ParityShards > 256 {
+		return fmt.Errorf("storage: erasure coding needs k >= 1, m >= 1 and k+m <= 256, got %d+%d",
+			p.DataShards, p.ParityShards)
+	}
+	return nil
+}
+
+// Erasure reports whether the policy erasure-codes chunks.
+func (p Policy) Erasure() bool {
+	return p.DataShards > 0
+}
+
+// Shards is the number of shards a chunk is split into.
+func (p Policy) Shards() int {
+	return p.DataShards + p.ParityShards
+}
+
+func (p Policy) String() string {
+	if !p.Erasure() {
+		return PolicyReplicated
+	}
+	return fmt.Sprintf("ec:%d+%d", p.DataShards, p.ParityShards)
+}
+
+// ShardSize is the size of each shard of a chunk of the given size.
+func (p Policy) ShardSize(size int64) int64 {
+	k := int64(p.DataShards)
+	return (size + k - 1) / k
+}
+
+// ShardKey is the object name a shard is stored under. Whole copies are
+// stored under the checksum itself.
+func ShardKey(checksum string, shard int) string {
+	if shard == NoShard {
+		return checksum
+	}
+	return checksum + "." + strconv.Itoa(shard)
+}
+
+// ParseKey splits an object name into the chunk checksum and shard index.
+// ok is false for a name that is not a SHA-256 checksum with an optional
+// shard index, such as a chunk stored before content addressing.
+func ParseKey(key string) (checksum string, shard int, ok bool) {
+	checksum, shard = key, NoShard
+	if name, index, found := strings.Cut(key, "."); found {
+		n, err := strconv.Atoi(index)
+		if err != nil || n < 0 || strconv.Itoa(n) != index {
+			return "", 0, false
+		}
+		checksum, shard = name, n
+	}
+	if len(checksum) != 64 {
+		return "", 0, false
+	}
+	for _, c := range checksum {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return "", 0, false
+		}
+	}
+	return checksum, shard, true
+}
+
+var encoders sync.Map // Policy -> reedsolomon.Encoder
+
+func (p Policy) encoder() (reedsolomon.Encoder, error) {
+	if enc, ok := encoders.Load(p); ok {
+		return enc.(reedsolomon.Encoder), nil
+	}
+	enc, err := reedsolomon.New(p.DataShards, p.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	actual, _ := encoders.LoadOrStore(p, enc)
+	return actual.(reedsolomon.Encoder), nil
+}
+
+// Encode splits data into the policy's data shards and computes the parity
+// shards. data is not modified.
+func (p Policy) Encode(data []byte) ([][]byte, error) {
+	enc, err := p.encoder()
+	if err != nil {
+		return nil, err
+	}
+	// Capping the capacity makes Split copy the tail into fresh padding
+	// instead of zeroing bytes past len(data).
+	shards, err := enc.Split(data[:len(data):len(data)])
+	if err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(shards); err != nil {
+		return nil, err
+	}
+	return shards, nil
+}
+
+// Reconstruct fills in the nil entries of shards from the others. At least
+// DataShards entries must be present.
+func (p Policy) Reconstruct(shards [][]byte) error {
+	enc, err := p.encoder()
+	if err != nil {
+		return err
+	}
+	return enc.Reconstruct(shards)
+}
+
+// Decode writes the size bytes of chunk data held by shards to dst,
+// rebuilding missing data shards first. nil entries mark missing shards.
+func (p Policy) Decode(dst io.Writer, shards [][]byte, size int64) error {
+	enc, err := p.encoder()
+	if err != nil {
+		return err
+	}
+	if err := enc.ReconstructData(shards); err != nil {
+		return err
+	}
+	return enc.Join(dst, shards, int(size))
+}
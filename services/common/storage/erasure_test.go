@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseKey(t *testing.T) {
+	sum := strings.Repeat("0123456789abcdef", 4)
+	cases := []struct {
+		key      string
+		checksum string
+		shard    int
+		ok       bool
+	}{
+		{sum, sum, NoShard, true},
+		{sum + ".0", sum, 0, true},
+		{sum + ".13", sum, 13, true},
+
+		// Chunks from before content addressing, and other objects
+		{"3f2a9c1e-5b7d-4e8f-9a0b-1c2d3e4f5a6b_chunk_0", "", 0, false},
+		{"backup.tar", "", 0, false},
+		{sum[:63], "", 0, false},
+		{strings.ToUpper(sum), "", 0, false},
+		{sum + ".", "", 0, false},
+		{sum + ".-1", "", 0, false},
+		{sum + ".01", "", 0, false},
+		{sum + ".1.2", "", 0, false},
+	}
+
+	for _, tc := range cases {
+		checksum, shard, ok := ParseKey(tc.key)
+		if checksum != tc.checksum || shard != tc.shard || ok != tc.ok {
+			t.Errorf("ParseKey(%q) = %q, %d, %v; want %q, %d, %v",
+				tc.key, checksum, shard, ok, tc.checksum, tc.shard, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// services/common/storage/local.go
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LocalStore keeps chunk objects as files under a directory, fanned out
+// into subdirectories by the first two characters of the key.
+type LocalStore struct {
+	root string
+}
+
+func NewLocalStore(root string) (*LocalStore, error) {
+	if root == "" {
+		return nil, errors.New("storage: local store needs a directory")
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+	return &LocalStore{root: root}, nil
+}
+
+func (s *LocalStore) path(key string) (string, error) {
+	if len(key) < 3 || strings.ContainsAny(key, `/\`) || strings.HasPrefix(key, ".") {
+		return "", fmt.Errorf("storage: invalid key %q", key)
+	}
+	return filepath.Join(s.root, key[:2], key), nil
+}
+
+// Put writes to a temporary file and renames it into place, so readers
+// never see a partial object.
+func (s *LocalStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	written, err := io.Copy(tmp, r)
+	if err == nil && size >= 0 && written != size {
+		err = fmt.Errorf("storage: wrote %d bytes of %s, expected %d", written, key, size)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *LocalStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.GetRange(ctx, key, 0, -1)
+}
+
+func (s *LocalStore) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, localError(err)
+	}
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+func (s *LocalStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	return localError(os.Remove(path))
+}
+
+func (s *LocalStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return ObjectInfo{}, localError(err)
+	}
+	return ObjectInfo{Key: key, Size: info.Size(), LastModified: info.ModTime()}, nil
+}
+
+func (s *LocalStore) List(ctx context.Context, fn func(ObjectInfo) error) error {
+	return filepath.WalkDir(s.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil // removed while listing
+			}
+			return err
+		}
+		return fn(ObjectInfo{Key: d.Name(), Size: info.Size(), LastModified: info.ModTime()})
+	})
+}
+
+func (s *LocalStore) Ping(ctx context.Context) error {
+	_, err := os.Stat(s.root)
+	return err
+}
+
+func (s *LocalStore) Location(key string) string {
+	if path, err := s.path(key); err == nil {
+		return path
+	}
+	return filepath.Join(s.root, key)
+}
+
+func localError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
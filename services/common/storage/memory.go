@@ -0,0 +1,106 @@
+// services/common/storage/memory.go
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps chunk objects in memory. It is meant for development
+// and tests; everything is lost on restart.
+type MemoryStore struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data     []byte
+	modified time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{objects: make(map[string]memoryObject)}
+}
+
+func (s *MemoryStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if size >= 0 && int64(len(data)) != size {
+		return fmt.Errorf("storage: read %d bytes of %s, expected %d", len(data), key, size)
+	}
+
+	s.mu.Lock()
+	s.objects[key] = memoryObject{data: data, modified: time.Now()}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.GetRange(ctx, key, 0, -1)
+}
+
+// GetRange returns a reader over the stored slice. Objects are replaced,
+// never modified in place, so the slice stays valid after a later Put.
+func (s *MemoryStore) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	s.mu.RLock()
+	obj, ok := s.objects[key]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	data := obj.data[min(offset, int64(len(obj.data))):]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.objects[key]; !ok {
+		return ErrNotFound
+	}
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *MemoryStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	s.mu.RLock()
+	obj, ok := s.objects[key]
+	s.mu.RUnlock()
+	if !ok {
+		return ObjectInfo{}, ErrNotFound
+	}
+	return ObjectInfo{Key: key, Size: int64(len(obj.data)), LastModified: obj.modified}, nil
+}
+
+// List walks a snapshot of the keys in order, so fn may modify the store.
+func (s *MemoryStore) List(ctx context.Context, fn func(ObjectInfo) error) error {
+	s.mu.RLock()
+	infos := make([]ObjectInfo, 0, len(s.objects))
+	for key, obj := range s.objects {
+		infos = append(infos, ObjectInfo{Key: key, Size: int64(len(obj.data)), LastModified: obj.modified})
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	for _, info := range infos {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Location(key string) string {
+	return "memory/" + key
+}
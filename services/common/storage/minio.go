@@ -0,0 +1,147 @@
+// services/common/storage/minio.go
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// DefaultBucket is the bucket chunk objects live in unless a node names
+// another one.
+const DefaultBucket = "atlasfs-chunks"
+
+// MinioStore keeps chunk objects in a bucket on a MinIO or other
+// S3-compatible endpoint.
+type MinioStore struct {
+	client *minio.Client
+	bucket string
+}
+
+func NewMinioStore(endpoint, bucket, accessKey, secretKey string, useSSL bool) (*MinioStore, error) {
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure: useSSL,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if bucket == "" {
+		bucket = DefaultBucket
+	}
+	return &MinioStore{client: client, bucket: bucket}, nil
+}
+
+// EnsureBucket creates the bucket if it does not exist yet.
+func (s *MinioStore) EnsureBucket(ctx context.Context) (created bool, err error) {
+	exists, err := s.client.BucketExists(ctx, s.bucket)
+	if err != nil || exists {
+		return false, err
+	}
+	return true, s.client.MakeBucket(ctx, s.bucket, minio.MakeBucketOptions{})
+}
+
+func (s *MinioStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	_, err := s.client.PutObject(ctx, s.bucket, key, r, size,
+		minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	return minioError(err)
+}
+
+func (s *MinioStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.GetRange(ctx, key, 0, -1)
+}
+
+func (s *MinioStore) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		// A range cannot be empty; only check the object exists
+		if _, err := s.Stat(ctx, key); err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	opts := minio.GetObjectOptions{}
+	if offset > 0 || length >= 0 {
+		end := int64(0) // to the end
+		if length >= 0 {
+			end = offset + length - 1
+		}
+		if err := opts.SetRange(offset, end); err != nil {
+			return nil, err
+		}
+	}
+	obj, err := s.client.GetObject(ctx, s.bucket, key, opts)
+	if err != nil {
+		return nil, minioError(err)
+	}
+	return minioReader{obj}, nil
+}
+
+func (s *MinioStore) Delete(ctx context.Context, key string) error {
+	return minioError(s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{}))
+}
+
+func (s *MinioStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, minioError(err)
+	}
+	return ObjectInfo{Key: info.Key, Size: info.Size, LastModified: info.LastModified}, nil
+}
+
+func (s *MinioStore) List(ctx context.Context, fn func(ObjectInfo) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Recursive: true}) {
+		if obj.Err != nil {
+			return minioError(obj.Err)
+		}
+		if err := fn(ObjectInfo{Key: obj.Key, Size: obj.Size, LastModified: obj.LastModified}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MinioStore) Ping(ctx context.Context) error {
+	_, err := s.client.BucketExists(ctx, s.bucket)
+	return err
+}
+
+func (s *MinioStore) Location(key string) string {
+	return s.bucket + "/" + key
+}
+
+// minioError maps a missing object onto ErrNotFound.
+func minioError(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NoSuchObject":
+		return ErrNotFound
+	}
+	return err
+}
+
+// minioReader maps errors from a lazily fetched object, which is where a
+// missing key first shows up.
+type minioReader struct {
+	obj *minio.Object
+}
+
+func (r minioReader) Read(p []byte) (int, error) {
+	n, err := r.obj.Read(p)
+	if err != nil && err != io.EOF {
+		err = minioError(err)
+	}
+	return n, err
+}
+
+func (r minioReader) Close() error {
+	return r.obj.Close()
+}
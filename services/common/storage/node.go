@@ -0,0 +1,116 @@
+// services/common/storage/node.go
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// unhealthyCooldown is how long a node that failed a request is passed
+// over before it is tried first again.
+const unhealthyCooldown = 30 * time.Second
+
+// Node is one storage location for chunk objects: a ChunkStore plus the
+// health tracking the cluster uses to prefer nodes that are answering.
+type Node struct {
+	ID    string
+	Store ChunkStore
+
+	mu             sync.Mutex
+	unhealthyUntil time.Time
+}
+
+func NewNode(id string, store ChunkStore) *Node {
+	return &Node{ID: id, Store: store}
+}
+
+// StoragePath is the value recorded in chunk_locations.storage_path.
+func (n *Node) StoragePath(key string) string {
+	if l, ok := n.Store.(Locator); ok {
+		return l.Location(key)
+	}
+	return key
+}
+
+func (n *Node) Put(ctx context.Context, key string, data []byte) error {
+	return n.observe(n.Store.Put(ctx, key, bytes.NewReader(data), int64(len(data))))
+}
+
+// Get opens an object for reading. A missing object may only surface as
+// ErrNotFound from the first Read.
+func (n *Node) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	r, err := n.Store.Get(ctx, key)
+	if err != nil {
+		return nil, n.observe(err)
+	}
+	return &observedReader{ReadCloser: r, node: n}, nil
+}
+
+func (n *Node) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	r, err := n.Store.GetRange(ctx, key, offset, length)
+	if err != nil {
+		return nil, n.observe(err)
+	}
+	return &observedReader{ReadCloser: r, node: n}, nil
+}
+
+func (n *Node) Delete(ctx context.Context, key string) error {
+	return n.observe(n.Store.Delete(ctx, key))
+}
+
+func (n *Node) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := n.Store.Stat(ctx, key)
+	return info, n.observe(err)
+}
+
+// List calls fn for every object on the node until fn returns an error.
+func (n *Node) List(ctx context.Context, fn func(ObjectInfo) error) error {
+	return n.observe(n.Store.List(ctx, fn))
+}
+
+// Ping checks that the node is reachable. Stores that cannot tell are
+// assumed to be.
+func (n *Node) Ping(ctx context.Context) error {
+	if p, ok := n.Store.(Pinger); ok {
+		return n.observe(p.Ping(ctx))
+	}
+	return nil
+}
+
+// Healthy reports whether the node has served requests recently without
+// failing. Unhealthy nodes are still used, just tried last.
+func (n *Node) Healthy() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return time.Now().After(n.unhealthyUntil)
+}
+
+// observe updates the node's health: any error other than a missing object
+// or a cancelled request counts against it.
+func (n *Node) observe(err error) error {
+	if err == nil || errors.Is(err, ErrNotFound) || errors.Is(err, context.Canceled) {
+		return err
+	}
+
+	n.mu.Lock()
+	n.unhealthyUntil = time.Now().Add(unhealthyCooldown)
+	n.mu.Unlock()
+	return err
+}
+
+type observedReader struct {
+	io.ReadCloser
+	node *Node
+}
+
+func (r *observedReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = r.node.observe(err)
+	}
+	return n, err
+}
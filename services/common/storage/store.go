@@ -0,0 +1,45 @@
+// services/common/storage/store.go
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var ErrNotFound = errors.New("storage: object not found")
+
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// ChunkStore is a flat key/value store for chunk objects. Keys are chunk
+// checksums, optionally with a ".<shard>" suffix. Every method returns
+// ErrNotFound (possibly wrapped) for a missing key; for Get and GetRange
+// that may only surface from the first Read.
+type ChunkStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// GetRange reads length bytes starting at offset; a length below zero
+	// reads to the end.
+	GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// List calls fn for every object until fn returns an error.
+	List(ctx context.Context, fn func(ObjectInfo) error) error
+}
+
+// Pinger is implemented by stores that can cheaply check they are
+// reachable.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Locator is implemented by stores that can describe where a key lives,
+// for chunk_locations.storage_path.
+type Locator interface {
+	Location(key string) string
+}
@@ -0,0 +1,262 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+// storeDrivers are the ChunkStore implementations every test runs against.
+// MinIO needs a server, given by STORAGE_TEST_MINIO_ENDPOINT along with
+// STORAGE_TEST_MINIO_ACCESS_KEY and STORAGE_TEST_MINIO_SECRET_KEY, and is
+// skipped without one.
+var storeDrivers = []struct {
+	name string
+	new  func(t *testing.T) ChunkStore
+}{
+	{"memory", func(t *testing.T) ChunkStore {
+		return NewMemoryStore()
+	}},
+	{"local", func(t *testing.T) ChunkStore {
+		s, err := NewLocalStore(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}},
+	{"minio", func(t *testing.T) ChunkStore {
+		endpoint := os.Getenv("STORAGE_TEST_MINIO_ENDPOINT")
+		if endpoint == "" {
+			t.Skip("STORAGE_TEST_MINIO_ENDPOINT is not set")
+		}
+		s, err := NewMinioStore(endpoint, os.Getenv("STORAGE_TEST_MINIO_BUCKET"),
+			os.Getenv("STORAGE_TEST_MINIO_ACCESS_KEY"), os.Getenv("STORAGE_TEST_MINIO_SECRET_KEY"), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.EnsureBucket(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}},
+}
+
+// testKey returns a key no other test run uses, since a MinIO bucket may
+// be shared.
+func testKey(t *testing.T) string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// read reads a whole object, returning the error from opening it or from
+// reading it, where a missing key may first show up.
+func read(rc io.ReadCloser, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func putObject(t *testing.T, s ChunkStore, key string, data []byte) {
+	t.Helper()
+	if err := s.Put(context.Background(), key, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Put(%s): %v", key, err)
+	}
+	t.Cleanup(func() { s.Delete(context.Background(), key) })
+}
+
+func TestPutGetStat(t *testing.T) {
+	for _, driver := range storeDrivers {
+		t.Run(driver.name, func(t *testing.T) {
+			s := driver.new(t)
+			ctx := context.Background()
+			key := testKey(t)
+			data := []byte("the quick brown fox jumps over the lazy dog")
+			putObject(t, s, key, data)
+
+			got, err := read(s.Get(ctx, key))
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("Get = %q, %v; want %q", got, err, data)
+			}
+
+			info, err := s.Stat(ctx, key)
+			if err != nil {
+				t.Fatalf("Stat: %v", err)
+			}
+			if info.Key != key || info.Size != int64(len(data)) || info.LastModified.IsZero() {
+				t.Fatalf("Stat = %+v; want key %s, size %d and a modification time", info, key, len(data))
+			}
+
+			// Putting the key again replaces the object
+			putObject(t, s, key, []byte("replaced"))
+			if got, err := read(s.Get(ctx, key)); err != nil || string(got) != "replaced" {
+				t.Fatalf("Get after replacing = %q, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestPutSizeMismatch(t *testing.T) {
+	for _, driver := range storeDrivers {
+		t.Run(driver.name, func(t *testing.T) {
+			s := driver.new(t)
+			key := testKey(t)
+			t.Cleanup(func() { s.Delete(context.Background(), key) })
+
+			if err := s.Put(context.Background(), key, bytes.NewReader([]byte("short")), 10); err == nil {
+				t.Fatal("Put of fewer bytes than its size succeeded")
+			}
+		})
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+	cases := []struct {
+		name           string
+		offset, length int64
+		want           string
+	}{
+		{"whole", 0, -1, "0123456789abcdefghij"},
+		{"prefix", 0, 4, "0123"},
+		{"middle", 5, 5, "56789"},
+		{"to the end", 15, -1, "fghij"},
+		{"past the end", 18, 10, "ij"},
+		{"last byte", 19, 1, "j"},
+		{"empty", 3, 0, ""},
+	}
+
+	for _, driver := range storeDrivers {
+		t.Run(driver.name, func(t *testing.T) {
+			s := driver.new(t)
+			key := testKey(t)
+			putObject(t, s, key, data)
+
+			for _, tc := range cases {
+				t.Run(tc.name, func(t *testing.T) {
+					got, err := read(s.GetRange(context.Background(), key, tc.offset, tc.length))
+					if err != nil || string(got) != tc.want {
+						t.Fatalf("GetRange(%d, %d) = %q, %v; want %q", tc.offset, tc.length, got, err, tc.want)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	ops := []struct {
+		name string
+		call func(ctx context.Context, s ChunkStore, key string) error
+	}{
+		{"Get", func(ctx context.Context, s ChunkStore, key string) error {
+			_, err := read(s.Get(ctx, key))
+			return err
+		}},
+		{"GetRange", func(ctx context.Context, s ChunkStore, key string) error {
+			_, err := read(s.GetRange(ctx, key, 2, 4))
+			return err
+		}},
+		{"Stat", func(ctx context.Context, s ChunkStore, key string) error {
+			_, err := s.Stat(ctx, key)
+			return err
+		}},
+	}
+
+	for _, driver := range storeDrivers {
+		t.Run(driver.name, func(t *testing.T) {
+			s := driver.new(t)
+			key := testKey(t)
+
+			for _, op := range ops {
+				t.Run(op.name, func(t *testing.T) {
+					if err := op.call(context.Background(), s, key); !errors.Is(err, ErrNotFound) {
+						t.Fatalf("%s of a missing key = %v; want ErrNotFound", op.name, err)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestDelete(t *testing.T) {
+	for _, driver := range storeDrivers {
+		t.Run(driver.name, func(t *testing.T) {
+			s := driver.new(t)
+			ctx := context.Background()
+			key := testKey(t)
+			putObject(t, s, key, []byte("doomed"))
+
+			if err := s.Delete(ctx, key); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			if _, err := s.Stat(ctx, key); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("Stat after Delete = %v; want ErrNotFound", err)
+			}
+			if _, err := read(s.Get(ctx, key)); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("Get after Delete = %v; want ErrNotFound", err)
+			}
+
+			// S3 deletes succeed for missing keys, so either answer will do
+			if err := s.Delete(ctx, key); err != nil && !errors.Is(err, ErrNotFound) {
+				t.Fatalf("Delete of a missing key = %v; want nil or ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestList(t *testing.T) {
+	for _, driver := range storeDrivers {
+		t.Run(driver.name, func(t *testing.T) {
+			s := driver.new(t)
+			ctx := context.Background()
+			want := map[string]int64{}
+			for i := 0; i < 3; i++ {
+				key := testKey(t)
+				data := bytes.Repeat([]byte{'x'}, i+1)
+				putObject(t, s, key, data)
+				want[key] = int64(len(data))
+			}
+
+			// The bucket may hold other objects; only ours are checked
+			seen := map[string]bool{}
+			err := s.List(ctx, func(info ObjectInfo) error {
+				size, ok := want[info.Key]
+				if !ok {
+					return nil
+				}
+				if info.Size != size {
+					t.Errorf("List: %s has size %d; want %d", info.Key, info.Size, size)
+				}
+				seen[info.Key] = true
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("List: %v", err)
+			}
+			if len(seen) != len(want) {
+				t.Fatalf("List found %d of the %d objects", len(seen), len(want))
+			}
+
+			// An error from fn stops the listing and is returned
+			stop := errors.New("stop")
+			calls := 0
+			err = s.List(ctx, func(ObjectInfo) error {
+				calls++
+				return stop
+			})
+			if !errors.Is(err, stop) || calls != 1 {
+				t.Fatalf("List with a failing fn = %v after %d calls; want stop after 1", err, calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+// services/download/erasure.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// fetchErasureChunk rebuilds an erasure-coded chunk into a pooled buffer.
+// The data shards are read first, in parallel; only if some of them are
+// missing or fail their checksum are the parity shards read too. Any
+// DataShards verified shards are enough, and the rebuilt chunk is checked
+// against its own checksum before it is returned.
+func (d *DownloadService) fetchErasureChunk(ctx context.Context, fileID string, chunk ChunkInfo) (*bytes.Buffer, error) {
+	policy := chunk.Policy
+
+	// Every recorded copy of each shard, in preference order
+	byShard := make([][]chunkCopy, policy.Shards())
+	for _, cp := range d.chunkCopies(ctx, chunk) {
+		if cp.Shard >= 0 && cp.Shard < len(byShard) {
+			byShard[cp.Shard] = append(byShard[cp.Shard], cp)
+		}
+	}
+
+	shards := make([][]byte, policy.Shards())
+	buffers := make([]*bytes.Buffer, policy.Shards())
+	defer func() {
+		for _, buf := range buffers {
+			if buf != nil {
+				d.releaseBuffer(buf)
+			}
+		}
+	}()
+
+	readShards := func(from, to int) int {
+		var wg sync.WaitGroup
+		for i := from; i < to; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				buf := d.bufferPool.Get().(*bytes.Buffer)
+				for _, cp := range byShard[i] {
+					buf.Reset()
+					if d.readVerified(ctx, fileID, chunk, cp, buf) {
+						buffers[i], shards[i] = buf, buf.Bytes()
+						return
+					}
+				}
+				d.releaseBuffer(buf)
+			}()
+		}
+		wg.Wait()
+
+		n := 0
+		for i := from; i < to; i++ {
+			if shards[i] != nil {
+				n++
+			}
+		}
+		return n
+	}
+
+	available := readShards(0, policy.DataShards)
+	if available < policy.DataShards {
+		log.Printf("⚠️ Chunk %s has %d of %d data shards, reading parity", chunk.ChunkID, available, policy.DataShards)
+		available += readShards(policy.DataShards, policy.Shards())
+	}
+	if available < policy.DataShards {
+		return nil, fmt.Errorf("chunk %s: %d of %d shards readable: %w",
+			chunk.ChunkID, available, policy.DataShards, errChunkUnavailable)
+	}
+
+	out := d.bufferPool.Get().(*bytes.Buffer)
+	out.Reset()
+	out.Grow(int(chunk.ChunkSize))
+	if err := policy.Decode(out, shards, chunk.ChunkSize); err != nil {
+		d.releaseBuffer(out)
+		return nil, fmt.Errorf("chunk %s: rebuild: %w", chunk.ChunkID, err)
+	}
+
+	hash := sha256.Sum256(out.Bytes())
+	if checksum := hex.EncodeToString(hash[:]); checksum != chunk.Checksum {
+		d.releaseBuffer(out)
+		log.Printf("❌ Chunk %s rebuilt from shards has sha256 %s, want %s", chunk.ChunkID, checksum, chunk.Checksum)
+		return nil, fmt.Errorf("chunk %s: %w", chunk.ChunkID, errChunkUnavailable)
+	}
+	return out, nil
+}
@@ -2,64 +2,65 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	_ "github.com/lib/pq"
-	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
-	"github.com/segmentio/kafka-go"
 
 	"atlasfs/services/common/config"
 	"atlasfs/services/common/events"
+	"atlasfs/services/common/outbox"
+	"atlasfs/services/common/storage"
 )
 
-const BucketName = "atlasfs-chunks"
-
 type DownloadService struct {
-	config      *config.Config
-	minioClient *minio.Client
-	kafkaWriter *kafka.Writer
-	db          *sql.DB
-	router      *gin.Engine
+	config     *config.Config
+	cluster    *storage.Cluster
+	db         *sql.DB
+	router     *gin.Engine
+	bufferPool *sync.Pool
 }
 
 type ChunkInfo struct {
 	ChunkID    string
 	ChunkIndex int
 	ChunkSize  int64
-	Checksum   string
+	Checksum   string // also the chunk's object name on the storage nodes
+	Offset     int64  // position of the chunk's first byte within the file
+	Policy     storage.Policy
+	Legacy     bool // stored before content addressing, without a chunk_objects row
+}
+
+type FileInfo struct {
+	ID        string
+	Name      string
+	Size      int64
+	UpdatedAt time.Time
+	Chunks    []ChunkInfo
 }
 
+var errNoChunks = errors.New("no chunks found for file")
+
 func NewDownloadService() *DownloadService {
 	cfg := config.Load()
 
-	// Initialize MinIO client
-	minioClient, err := minio.New(cfg.MinioEndpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(cfg.MinioAccessKey, cfg.MinioSecretKey, ""),
-		Secure: cfg.MinioUseSSL,
-	})
+	// Initialize storage nodes
+	cluster, err := storage.NewCluster(cfg)
 	if err != nil {
-		log.Printf("Warning: Could not connect to MinIO: %v", err)
+		log.Printf("Warning: Could not configure storage nodes: %v", err)
 	} else {
-		log.Printf("✅ MinIO client initialized for %s", cfg.MinioEndpoint)
-	}
-
-	// Initialize Kafka writer
-	kafkaWriter := &kafka.Writer{
-		Addr:     kafka.TCP(cfg.KafkaBrokers...),
-		Topic:    "file.events",
-		Balancer: &kafka.LeastBytes{},
+		log.Printf("✅ %d storage nodes configured", len(cluster.Nodes))
 	}
-	log.Printf("✅ Kafka writer initialized")
 
 	// Initialize PostgreSQL
 	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
@@ -75,11 +76,13 @@ func NewDownloadService() *DownloadService {
 	}
 
 	return &DownloadService{
-		config:      cfg,
-		minioClient: minioClient,
-		kafkaWriter: kafkaWriter,
-		db:          db,
-		router:      gin.Default(),
+		config:  cfg,
+		cluster: cluster,
+		db:      db,
+		router:  gin.Default(),
+		bufferPool: &sync.Pool{
+			New: func() interface{} { return new(bytes.Buffer) },
+		},
 	}
 }
 
@@ -87,96 +90,128 @@ func (d *DownloadService) setupRoutes() {
 	d.router.GET("/health", d.healthCheck)
 	d.router.GET("/download/:id", d.downloadFile)
 	d.router.GET("/stream/:id", d.streamFile)
+	d.router.HEAD("/stream/:id", d.streamFile)
 	d.router.GET("/info/:id", d.getFileInfo)
+	d.router.GET("/scrub", d.getScrubStatus)
 }
 
-func (d *DownloadService) downloadFile(c *gin.Context) {
-	fileID := c.Param("id")
-
-	log.Printf("📥 Download request for file: %s", fileID)
-
-	// Get file metadata from PostgreSQL
-	var fileName string
-	var fileSize int64
-	var chunkCount int
+// loadFile fetches a completed file and its chunks in index order, with
+// each chunk's offset within the file filled in.
+func (d *DownloadService) loadFile(fileID string) (*FileInfo, error) {
+	file := &FileInfo{ID: fileID}
 	err := d.db.QueryRow(`
-        SELECT file_name, file_size, chunk_count 
+        SELECT file_name, file_size, updated_at
         FROM files 
-        WHERE file_id = $1 AND status = 'completed'
-    `, fileID).Scan(&fileName, &fileSize, &chunkCount)
-
+        WHERE file_id = $1 AND status IN ('completed', 'degraded')
+    `, fileID).Scan(&file.Name, &file.Size, &file.UpdatedAt)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
-		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
-		}
-		return
+		return nil, err
 	}
 
 	// Get all chunks for this file
 	rows, err := d.db.Query(`
-        SELECT chunk_id, chunk_index, chunk_size, checksum 
-        FROM chunks 
-        WHERE file_id = $1 
-        ORDER BY chunk_index
+        SELECT c.chunk_id, c.chunk_index, c.chunk_size, c.checksum,
+               COALESCE(co.data_shards, 0), COALESCE(co.parity_shards, 0), co.checksum IS NULL
+        FROM chunks c
+        LEFT JOIN chunk_objects co ON co.checksum = c.checksum
+        WHERE c.file_id = $1 
+        ORDER BY c.chunk_index
     `, fileID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get chunks"})
-		return
+		return nil, err
 	}
 	defer rows.Close()
 
 	// Collect chunk information
-	var chunks []ChunkInfo
 	for rows.Next() {
 		var chunk ChunkInfo
-		err := rows.Scan(&chunk.ChunkID, &chunk.ChunkIndex, &chunk.ChunkSize, &chunk.Checksum)
+		err := rows.Scan(&chunk.ChunkID, &chunk.ChunkIndex, &chunk.ChunkSize, &chunk.Checksum,
+			&chunk.Policy.DataShards, &chunk.Policy.ParityShards, &chunk.Legacy)
 		if err != nil {
-			log.Printf("Error scanning chunk: %v", err)
-			continue
+			return nil, err
 		}
-		chunks = append(chunks, chunk)
+		file.Chunks = append(file.Chunks, chunk)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-	if len(chunks) == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "No chunks found for file"})
-		return
+	if len(file.Chunks) == 0 {
+		return nil, errNoChunks
 	}
 
 	// Sort chunks by index (safety check)
-	sort.Slice(chunks, func(i, j int) bool {
-		return chunks[i].ChunkIndex < chunks[j].ChunkIndex
+	sort.Slice(file.Chunks, func(i, j int) bool {
+		return file.Chunks[i].ChunkIndex < file.Chunks[j].ChunkIndex
 	})
 
+	offset := int64(0)
+	for i := range file.Chunks {
+		file.Chunks[i].Offset = offset
+		offset += file.Chunks[i].ChunkSize
+	}
+	if offset != file.Size {
+		log.Printf("⚠️ File %s records %d bytes but its chunks hold %d", fileID, file.Size, offset)
+		file.Size = offset
+	}
+
+	return file, nil
+}
+
+// respondLoadError maps a loadFile error onto an HTTP response.
+func respondLoadError(c *gin.Context, err error) {
+	switch err {
+	case sql.ErrNoRows:
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+	case errNoChunks:
+		c.JSON(http.StatusNotFound, gin.H{"error": "No chunks found for file"})
+	default:
+		log.Printf("Failed to load file: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+}
+
+func (d *DownloadService) downloadFile(c *gin.Context) {
+	fileID := c.Param("id")
+
+	log.Printf("📥 Download request for file: %s", fileID)
+
+	// Get file metadata and chunks from PostgreSQL
+	file, err := d.loadFile(fileID)
+	if err != nil {
+		respondLoadError(c, err)
+		return
+	}
+
 	// Set response headers for file download
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", fileName))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", file.Name))
 	c.Header("Content-Type", "application/octet-stream")
-	c.Header("Content-Length", fmt.Sprintf("%d", fileSize))
+	c.Header("Content-Length", fmt.Sprintf("%d", file.Size))
+	c.Header("Accept-Ranges", "bytes")
 
-	// Stream chunks to client
-	ctx := context.Background()
+	// Stream chunks to client. Each chunk is verified before any of its
+	// bytes are written, so a bad copy is never passed on.
+	ctx := c.Request.Context()
 	bytesWritten := int64(0)
 
-	for _, chunk := range chunks {
+	for _, chunk := range file.Chunks {
 		log.Printf("Retrieving chunk %d: %s", chunk.ChunkIndex, chunk.ChunkID)
 
-		// Get chunk from MinIO
-		obj, err := d.minioClient.GetObject(ctx, BucketName, chunk.ChunkID, minio.GetObjectOptions{})
+		buf, err := d.fetchChunk(ctx, fileID, chunk)
 		if err != nil {
 			log.Printf("Failed to get chunk %s: %v", chunk.ChunkID, err)
+			failStream(c)
 			return
 		}
 
 		// Stream chunk data to client
-		written, err := io.Copy(c.Writer, obj)
+		written, err := c.Writer.Write(buf.Bytes())
+		d.releaseBuffer(buf)
 		if err != nil {
 			log.Printf("Failed to stream chunk %s: %v", chunk.ChunkID, err)
-			obj.Close()
 			return
 		}
-		bytesWritten += written
-		obj.Close()
+		bytesWritten += int64(written)
 
 		// Flush after each chunk for better streaming
 		if f, ok := c.Writer.(http.Flusher); ok {
@@ -187,45 +222,15 @@ func (d *DownloadService) downloadFile(c *gin.Context) {
 	log.Printf("✅ Successfully downloaded file %s (%d bytes)", fileID, bytesWritten)
 
 	// Publish download completed event
-	event := events.NewEvent(
-		"file.download.completed",
-		"download",
-		map[string]interface{}{
-			"file_id":     fileID,
-			"file_name":   fileName,
-			"bytes_sent":  bytesWritten,
-			"chunk_count": len(chunks),
-			"client_ip":   c.ClientIP(),
-		},
-	)
-
-	if eventData, _ := event.ToJSON(); eventData != nil {
-		d.kafkaWriter.WriteMessages(context.Background(),
-			kafka.Message{
-				Key:   []byte(fileID),
-				Value: eventData,
-			},
-		)
-	}
-}
-
-func (d *DownloadService) streamFile(c *gin.Context) {
-	// Similar to download but optimized for streaming (e.g., video)
-	fileID := c.Param("id")
-
-	// Support range requests for video streaming
-	rangeHeader := c.GetHeader("Range")
-	if rangeHeader != "" {
-		// Implement partial content support (206 response)
-		c.JSON(http.StatusNotImplemented, gin.H{
-			"message": "Range requests not yet implemented",
-			"file_id": fileID, // Now fileID is used
-		})
-		return
-	}
+	event := events.NewEvent("download", events.DownloadCompletedData{
+		FileID:     fileID,
+		FileName:   file.Name,
+		BytesSent:  bytesWritten,
+		ChunkCount: len(file.Chunks),
+		ClientIP:   c.ClientIP(),
+	})
 
-	// For now, just redirect to regular download
-	d.downloadFile(c)
+	outbox.Record(d.db, fileID, event)
 }
 
 func (d *DownloadService) getFileInfo(c *gin.Context) {
@@ -266,15 +271,12 @@ func (d *DownloadService) healthCheck(c *gin.Context) {
 		"timestamp": time.Now().Unix(),
 	}
 
-	// Check MinIO
-	if d.minioClient != nil {
-		ctx := context.Background()
-		_, err := d.minioClient.ListBuckets(ctx)
-		if err != nil {
-			health["minio"] = "unhealthy"
-		} else {
-			health["minio"] = "healthy"
-		}
+	// Check storage nodes
+	if d.cluster != nil {
+		nodes := d.cluster.Health(context.Background())
+		health["storage"] = storage.Summarize(nodes)
+		health["minio"] = health["storage"] // the key existing monitors check
+		health["storage_nodes"] = nodes
 	}
 
 	// Check PostgreSQL
@@ -294,9 +296,6 @@ func main() {
 
 	service := NewDownloadService()
 	defer func() {
-		if service.kafkaWriter != nil {
-			service.kafkaWriter.Close()
-		}
 		if service.db != nil {
 			service.db.Close()
 		}
@@ -304,6 +303,17 @@ func main() {
 
 	service.setupRoutes()
 
+	// Background integrity scrubbing of stored chunks
+	if service.config.ScrubEnabled && service.db != nil && service.cluster != nil {
+		go service.runScrubber(context.Background())
+	}
+
+	// Events recorded in the outbox are published to Kafka by whichever
+	// service's relay holds the lock
+	if service.db != nil {
+		go outbox.NewRelay(service.config, service.db).Run(context.Background())
+	}
+
 	port := getEnv("PORT", "8085")
 	log.Printf("✅ Download Service listening on port %s", port)
 
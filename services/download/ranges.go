@@ -0,0 +1,108 @@
+// services/download/ranges.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MaxRanges caps how many ranges a single request may ask for. Requests
+// over the limit are served as a plain 200 rather than fanned out.
+const MaxRanges = 64
+
+var (
+	errInvalidRange       = errors.New("invalid range")
+	errUnsatisfiableRange = errors.New("range not satisfiable")
+)
+
+// byteRange is a resolved range of length bytes starting at start.
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parses an RFC 7233 Range header against a representation of
+// size bytes. Syntactically invalid headers return errInvalidRange and
+// should be ignored; headers whose ranges all fall past the end return
+// errUnsatisfiableRange.
+func parseRange(header string, size int64) ([]byteRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return nil, errInvalidRange
+	}
+
+	var ranges []byteRange
+	noOverlap := false
+	for _, spec := range strings.Split(header[len(prefix):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		dash := strings.Index(spec, "-")
+		if dash < 0 {
+			return nil, errInvalidRange
+		}
+		first, last := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash+1:])
+
+		var r byteRange
+		if first == "" {
+			// Suffix range: the final N bytes.
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errInvalidRange
+			}
+			if n == 0 {
+				noOverlap = true
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r = byteRange{start: size - n, length: n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errInvalidRange
+			}
+			if start >= size {
+				noOverlap = true
+				continue
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, errInvalidRange
+				}
+				if end >= size {
+					end = size - 1
+				}
+			}
+			r = byteRange{start: start, length: end - start + 1}
+		}
+		ranges = append(ranges, r)
+	}
+
+	if len(ranges) == 0 {
+		if noOverlap {
+			return nil, errUnsatisfiableRange
+		}
+		return nil, errInvalidRange
+	}
+	return ranges, nil
+}
+
+// sumRanges returns the total number of bytes the ranges cover.
+func sumRanges(ranges []byteRange) int64 {
+	var total int64
+	for _, r := range ranges {
+		total += r.length
+	}
+	return total
+}
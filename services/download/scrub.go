@@ -0,0 +1,405 @@
+// services/download/scrub.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"atlasfs/services/common/events"
+	"atlasfs/services/common/models"
+	"atlasfs/services/common/outbox"
+	"atlasfs/services/common/storage"
+)
+
+const (
+	scrubberID    = "chunks"
+	scrubBatch    = 100
+	scrubLockID   = 0x7363727562 // "scrub"
+	scrubIdleWait = time.Minute
+
+	// legacyCursor prefixes the cursor once a pass has moved on to the
+	// chunks stored before content addressing, which are walked by chunk_id.
+	legacyCursor = "legacy:"
+)
+
+type scrubProgress struct {
+	Cursor          string     `json:"cursor"`
+	PassStartedAt   *time.Time `json:"pass_started_at"`
+	PassesCompleted int        `json:"passes_completed"`
+	ChunksVerified  int64      `json:"chunks_verified"`
+	ChunksMissing   int64      `json:"chunks_missing"`
+	ChunksCorrupted int64      `json:"chunks_corrupted"`
+	UpdatedAt       *time.Time `json:"updated_at"`
+}
+
+// runScrubber walks chunk_objects in checksum order, then the chunks rows
+// from before content addressing in chunk_id order, re-reading and
+// re-hashing every copy of each chunk at no more than ScrubBytesPerSecond.
+// Progress is kept in scrub_progress so a restart resumes mid-pass. Only
+// one download replica scrubs at a time.
+func (d *DownloadService) runScrubber(ctx context.Context) {
+	for {
+		ran, err := d.scrubPass(ctx)
+		if err != nil {
+			log.Printf("Scrub pass failed: %v", err)
+		}
+
+		wait := scrubIdleWait
+		if ran && err == nil {
+			wait = d.config.ScrubPassInterval
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// scrubPass runs the remainder of the current pass. It reports false if
+// another replica holds the scrub lock.
+func (d *DownloadService) scrubPass(ctx context.Context) (bool, error) {
+	conn, err := d.db.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, scrubLockID).Scan(&locked); err != nil {
+		return false, err
+	}
+	if !locked {
+		return false, nil
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, scrubLockID)
+
+	progress, err := d.loadScrubProgress(ctx)
+	if err != nil {
+		return true, err
+	}
+	if progress.Cursor == "" {
+		now := time.Now()
+		progress.PassStartedAt = &now
+		progress.ChunksVerified, progress.ChunksMissing, progress.ChunksCorrupted = 0, 0, 0
+		log.Printf("🔍 Starting scrub pass %d", progress.PassesCompleted+1)
+	} else {
+		log.Printf("🔍 Resuming scrub pass %d after %s", progress.PassesCompleted+1, progress.Cursor)
+	}
+
+	for {
+		batch, err := d.nextScrubBatch(ctx, progress.Cursor)
+		if err != nil {
+			return true, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		for _, chunk := range batch {
+			started := time.Now()
+			missing, corrupted := d.scrubChunk(ctx, chunk)
+			progress.ChunksVerified++
+			progress.ChunksMissing += int64(missing)
+			progress.ChunksCorrupted += int64(corrupted)
+			progress.Cursor = chunk.Checksum
+			if chunk.Legacy {
+				progress.Cursor = legacyCursor + chunk.ChunkID
+			}
+
+			// Rate limit by bytes read
+			if rate := d.config.ScrubBytesPerSecond; rate > 0 {
+				budget := time.Duration(float64(chunk.ChunkSize) / float64(rate) * float64(time.Second))
+				if sleep := budget - time.Since(started); sleep > 0 {
+					select {
+					case <-ctx.Done():
+						return true, ctx.Err()
+					case <-time.After(sleep):
+					}
+				}
+			}
+		}
+
+		if err := d.saveScrubProgress(ctx, progress); err != nil {
+			return true, err
+		}
+	}
+
+	log.Printf("✅ Scrub pass %d done: %d chunks verified, %d missing copies, %d corrupt copies",
+		progress.PassesCompleted+1, progress.ChunksVerified, progress.ChunksMissing, progress.ChunksCorrupted)
+
+	progress.Cursor = ""
+	progress.PassesCompleted++
+	return true, d.saveScrubProgress(ctx, progress)
+}
+
+// nextScrubBatch returns the chunk objects after the cursor and, once those
+// run out, the legacy chunks: rows with a checksum to verify against but no
+// chunk_objects row.
+func (d *DownloadService) nextScrubBatch(ctx context.Context, cursor string) ([]ChunkInfo, error) {
+	if after, ok := strings.CutPrefix(cursor, legacyCursor); ok {
+		return d.nextLegacyScrubBatch(ctx, after)
+	}
+
+	rows, err := d.db.QueryContext(ctx, `
+        SELECT checksum, chunk_size, data_shards, parity_shards
+        FROM chunk_objects
+        WHERE checksum > $1 AND ref_count > 0
+        ORDER BY checksum
+        LIMIT $2
+    `, cursor, scrubBatch)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []ChunkInfo
+	for rows.Next() {
+		var chunk ChunkInfo
+		if err := rows.Scan(&chunk.Checksum, &chunk.ChunkSize, &chunk.Policy.DataShards, &chunk.Policy.ParityShards); err != nil {
+			return nil, err
+		}
+		chunk.ChunkID = chunk.Checksum
+		batch = append(batch, chunk)
+	}
+	if err := rows.Err(); err != nil || len(batch) > 0 {
+		return batch, err
+	}
+	return d.nextLegacyScrubBatch(ctx, "")
+}
+
+func (d *DownloadService) nextLegacyScrubBatch(ctx context.Context, cursor string) ([]ChunkInfo, error) {
+	rows, err := d.db.QueryContext(ctx, `
+        SELECT c.chunk_id, c.chunk_size, c.checksum
+        FROM chunks c
+        WHERE c.chunk_id > $1 AND c.checksum IS NOT NULL
+          AND NOT EXISTS (SELECT 1 FROM chunk_objects co WHERE co.checksum = c.checksum)
+        ORDER BY c.chunk_id
+        LIMIT $2
+    `, cursor, scrubBatch)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []ChunkInfo
+	for rows.Next() {
+		chunk := ChunkInfo{Legacy: true}
+		if err := rows.Scan(&chunk.ChunkID, &chunk.ChunkSize, &chunk.Checksum); err != nil {
+			return nil, err
+		}
+		batch = append(batch, chunk)
+	}
+	return batch, rows.Err()
+}
+
+// scrubChunk verifies every copy or shard of a chunk object and reports
+// each bad one. While the chunk is still readable (an intact copy, or
+// DataShards intact shards) bad copies are dropped from chunk_locations so
+// the upload service's repairer replaces them. Files using the chunk are
+// marked degraded only once it is no longer readable. Legacy chunks have
+// no chunk_objects row for the repairer to work from, so their bad copies
+// are only reported.
+func (d *DownloadService) scrubChunk(ctx context.Context, chunk ChunkInfo) (missing, corrupted int) {
+	buf := d.bufferPool.Get().(*bytes.Buffer)
+	defer d.releaseBuffer(buf)
+
+	copies := d.chunkCopies(ctx, chunk)
+	if chunk.Legacy {
+		copies = append(copies, d.legacyCopies(chunk)...)
+	}
+	verified := make(map[int]bool) // shard indexes with an intact copy
+	unreadable, absent := 0, 0
+	var bad []chunkCopy
+	for _, cp := range copies {
+		buf.Reset()
+		checksum, err := d.readCopy(ctx, cp, buf)
+		switch {
+		case errors.Is(err, storage.ErrNotFound) && !cp.Recorded:
+			// Objects from before replication live on some node, not all.
+			absent++
+		case errors.Is(err, storage.ErrNotFound):
+			missing++
+			bad = append(bad, cp)
+			log.Printf("❌ Scrub: %s is missing from %s", cp.Object, cp.Node.ID)
+			d.reportScrubFinding(events.FileChunkMissing, chunk, cp, "")
+		case err != nil:
+			// Transient read failures are retried on the next pass.
+			log.Printf("Scrub: failed to read chunk %s from %s: %v", chunk.Checksum, cp.Node.ID, err)
+			unreadable++
+		case checksum != cp.Checksum || int64(buf.Len()) != cp.Size:
+			corrupted++
+			bad = append(bad, cp)
+			log.Printf("❌ Scrub: %s on %s is corrupt (sha256 %s)", cp.Object, cp.Node.ID, checksum)
+			d.reportScrubFinding(events.FileChunkCorrupted, chunk, cp, checksum)
+		default:
+			verified[cp.Shard] = true
+		}
+	}
+
+	if absent == len(copies) && len(copies) > 0 {
+		missing++
+		log.Printf("❌ Scrub: chunk %s is missing from every node", chunk.Checksum)
+		d.reportScrubFinding(events.FileChunkMissing, chunk, copies[0], "")
+	}
+
+	if len(verified) >= max(chunk.Policy.DataShards, 1) {
+		if chunk.Legacy {
+			return missing, corrupted
+		}
+		for _, cp := range bad {
+			d.dropCopy(ctx, chunk, cp)
+		}
+		_, err := d.db.ExecContext(ctx, `
+            UPDATE chunk_objects SET last_verified_at = $1 WHERE checksum = $2
+        `, time.Now(), chunk.Checksum)
+		if err != nil {
+			log.Printf("Failed to record verification of %s: %v", chunk.Checksum, err)
+		}
+		return missing, corrupted
+	}
+	if unreadable > 0 {
+		return missing, corrupted
+	}
+
+	_, err := d.db.ExecContext(ctx, `
+        UPDATE files SET status = $1, updated_at = $2
+        WHERE status = $3 AND file_id IN (SELECT file_id FROM chunks WHERE checksum = $4)
+    `, models.StatusDegraded, time.Now(), models.StatusCompleted, chunk.Checksum)
+	if err != nil {
+		log.Printf("Failed to mark files using %s as degraded: %v", chunk.Checksum, err)
+	}
+	return missing, corrupted
+}
+
+// dropCopy removes a bad copy and its chunk_locations row, leaving the
+// chunk under-replicated for the repairer to top up from a good copy.
+func (d *DownloadService) dropCopy(ctx context.Context, chunk ChunkInfo, cp chunkCopy) {
+	if err := cp.Node.Delete(ctx, cp.Object); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Printf("Failed to remove bad copy of %s from %s: %v", chunk.Checksum, cp.Node.ID, err)
+		return
+	}
+	_, err := d.db.ExecContext(ctx, `
+        DELETE FROM chunk_locations WHERE chunk_id = $1 AND node_id = $2 AND shard_index = $3
+    `, chunk.Checksum, cp.Node.ID, cp.Shard)
+	if err != nil {
+		log.Printf("Failed to drop location of %s on %s: %v", chunk.Checksum, cp.Node.ID, err)
+	}
+}
+
+func (d *DownloadService) reportScrubFinding(eventType events.EventType, chunk ChunkInfo, cp chunkCopy, actual string) {
+	fileIDs := d.filesUsingChunk(chunk.Checksum)
+	var data events.Payload = events.ChunkMissingData{
+		Checksum:     chunk.Checksum,
+		NodeID:       cp.Node.ID,
+		StoragePath:  cp.Node.StoragePath(cp.Object),
+		ShardIndex:   cp.Shard,
+		ExpectedSize: cp.Size,
+		DetectedBy:   "scrubber",
+		FileIDs:      fileIDs,
+	}
+	if eventType == events.FileChunkCorrupted {
+		data = events.ChunkCorruptedData{
+			Checksum:         chunk.Checksum,
+			NodeID:           cp.Node.ID,
+			StoragePath:      cp.Node.StoragePath(cp.Object),
+			ShardIndex:       cp.Shard,
+			ExpectedChecksum: cp.Checksum,
+			ActualChecksum:   actual,
+			ExpectedSize:     cp.Size,
+			DetectedBy:       "scrubber",
+			FileIDs:          fileIDs,
+		}
+	}
+	outbox.Record(d.db, chunk.Checksum, events.NewEvent("download", data))
+}
+
+func (d *DownloadService) filesUsingChunk(checksum string) []string {
+	fileIDs := []string{}
+	rows, err := d.db.Query(`SELECT DISTINCT file_id FROM chunks WHERE checksum = $1`, checksum)
+	if err != nil {
+		return fileIDs
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var fileID string
+		if rows.Scan(&fileID) == nil {
+			fileIDs = append(fileIDs, fileID)
+		}
+	}
+	return fileIDs
+}
+
+func (d *DownloadService) loadScrubProgress(ctx context.Context) (*scrubProgress, error) {
+	var p scrubProgress
+	err := d.db.QueryRowContext(ctx, `
+        SELECT last_checksum, pass_started_at, passes_completed, chunks_verified, chunks_missing, chunks_corrupted, updated_at
+        FROM scrub_progress WHERE scrubber_id = $1
+    `, scrubberID).Scan(&p.Cursor, &p.PassStartedAt, &p.PassesCompleted,
+		&p.ChunksVerified, &p.ChunksMissing, &p.ChunksCorrupted, &p.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return &p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (d *DownloadService) saveScrubProgress(ctx context.Context, p *scrubProgress) error {
+	now := time.Now()
+	p.UpdatedAt = &now
+	_, err := d.db.ExecContext(ctx, `
+        INSERT INTO scrub_progress (scrubber_id, last_checksum, pass_started_at, passes_completed,
+                                    chunks_verified, chunks_missing, chunks_corrupted, updated_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+        ON CONFLICT (scrubber_id) DO UPDATE SET
+            last_checksum = EXCLUDED.last_checksum,
+            pass_started_at = EXCLUDED.pass_started_at,
+            passes_completed = EXCLUDED.passes_completed,
+            chunks_verified = EXCLUDED.chunks_verified,
+            chunks_missing = EXCLUDED.chunks_missing,
+            chunks_corrupted = EXCLUDED.chunks_corrupted,
+            updated_at = EXCLUDED.updated_at
+    `, scrubberID, p.Cursor, p.PassStartedAt, p.PassesCompleted,
+		p.ChunksVerified, p.ChunksMissing, p.ChunksCorrupted, p.UpdatedAt)
+	return err
+}
+
+// getScrubStatus reports the scrubber's progress through the current pass.
+func (d *DownloadService) getScrubStatus(c *gin.Context) {
+	progress, err := d.loadScrubProgress(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load scrub progress"})
+		return
+	}
+
+	var total int64
+	var neverVerified int64
+	var oldest *time.Time
+	err = d.db.QueryRow(`
+        SELECT COUNT(*), COUNT(*) FILTER (WHERE last_verified_at IS NULL), MIN(last_verified_at)
+        FROM chunk_objects WHERE ref_count > 0
+    `).Scan(&total, &neverVerified, &oldest)
+	if err != nil {
+		log.Printf("Failed to load scrub statistics: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load scrub statistics"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":             d.config.ScrubEnabled,
+		"progress":            progress,
+		"total_chunks":        total,
+		"never_verified":      neverVerified,
+		"oldest_verification": oldest,
+	})
+}
@@ -0,0 +1,219 @@
+// services/download/stream.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// streamFile serves a file inline, or as an attachment when asked with
+// ?disposition=attachment, with RFC 7233 range support. Only the chunks
+// that overlap a requested range are fetched from MinIO. Each of
+// those is read and verified whole, since a partial read cannot be checked
+// against the chunk checksum, and only the requested bytes are sent.
+func (d *DownloadService) streamFile(c *gin.Context) {
+	fileID := c.Param("id")
+
+	file, err := d.loadFile(fileID)
+	if err != nil {
+		respondLoadError(c, err)
+		return
+	}
+
+	etag := fileETag(file)
+	contentType := mime.TypeByExtension(filepath.Ext(file.Name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	c.Header("Accept-Ranges", "bytes")
+	c.Header("ETag", etag)
+	c.Header("Last-Modified", file.UpdatedAt.UTC().Format(http.TimeFormat))
+	if c.Query("disposition") == "attachment" {
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", file.Name))
+	}
+
+	// A Range whose If-Range validator no longer matches gets the full file.
+	rangeHeader := c.GetHeader("Range")
+	if rangeHeader != "" && !ifRangeMatches(c.GetHeader("If-Range"), etag, file.UpdatedAt) {
+		rangeHeader = ""
+	}
+
+	var ranges []byteRange
+	if rangeHeader != "" {
+		ranges, err = parseRange(rangeHeader, file.Size)
+		switch {
+		case err == errUnsatisfiableRange:
+			c.Header("Content-Range", fmt.Sprintf("bytes */%d", file.Size))
+			c.JSON(http.StatusRequestedRangeNotSatisfiable, gin.H{"error": "Range not satisfiable"})
+			return
+		case err != nil, len(ranges) > MaxRanges, sumRanges(ranges) > file.Size:
+			// Malformed or abusive range sets are ignored, as RFC 7233 allows.
+			ranges = nil
+		}
+	}
+
+	ctx := c.Request.Context()
+	head := c.Request.Method == http.MethodHead
+
+	switch len(ranges) {
+	case 0:
+		c.Header("Content-Type", contentType)
+		c.Header("Content-Length", fmt.Sprintf("%d", file.Size))
+		c.Status(http.StatusOK)
+		if head {
+			return
+		}
+		if _, err := d.writeRange(ctx, c.Writer, fileID, file.Chunks, byteRange{start: 0, length: file.Size}); err != nil {
+			log.Printf("Failed to stream file %s: %v", fileID, err)
+			failStream(c)
+		}
+
+	case 1:
+		r := ranges[0]
+		c.Header("Content-Type", contentType)
+		c.Header("Content-Range", r.contentRange(file.Size))
+		c.Header("Content-Length", fmt.Sprintf("%d", r.length))
+		c.Status(http.StatusPartialContent)
+		if head {
+			return
+		}
+		if _, err := d.writeRange(ctx, c.Writer, fileID, file.Chunks, r); err != nil {
+			log.Printf("Failed to stream range %s of %s: %v", r.contentRange(file.Size), fileID, err)
+			failStream(c)
+		}
+
+	default:
+		mw := multipart.NewWriter(c.Writer)
+		c.Header("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+		c.Header("Content-Length", fmt.Sprintf("%d", multipartSize(ranges, contentType, file.Size, mw.Boundary())))
+		c.Status(http.StatusPartialContent)
+		if head {
+			return
+		}
+		for _, r := range ranges {
+			part, err := mw.CreatePart(rangePartHeader(r, contentType, file.Size))
+			if err != nil {
+				log.Printf("Failed to write part header for %s: %v", fileID, err)
+				return
+			}
+			if _, err := d.writeRange(ctx, part, fileID, file.Chunks, r); err != nil {
+				log.Printf("Failed to stream range %s of %s: %v", r.contentRange(file.Size), fileID, err)
+				return
+			}
+		}
+		mw.Close()
+	}
+}
+
+// writeRange copies r from the file's chunks to w. chunks must be sorted by
+// offset, as returned by loadFile.
+func (d *DownloadService) writeRange(ctx context.Context, w io.Writer, fileID string, chunks []ChunkInfo, r byteRange) (int64, error) {
+	first := sort.Search(len(chunks), func(i int) bool {
+		return chunks[i].Offset+chunks[i].ChunkSize > r.start
+	})
+
+	pos := r.start
+	remaining := r.length
+	written := int64(0)
+	for i := first; i < len(chunks) && remaining > 0; i++ {
+		chunk := chunks[i]
+		from := pos - chunk.Offset
+		to := min(chunk.ChunkSize, from+remaining)
+
+		buf, err := d.fetchChunk(ctx, fileID, chunk)
+		if err != nil {
+			return written, err
+		}
+		n, err := w.Write(buf.Bytes()[from:to])
+		d.releaseBuffer(buf)
+		written += int64(n)
+		if err != nil {
+			return written, fmt.Errorf("stream chunk %s: %w", chunk.ChunkID, err)
+		}
+
+		pos += int64(n)
+		remaining -= int64(n)
+
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+
+	if remaining > 0 {
+		return written, fmt.Errorf("range ends %d bytes past the last chunk", remaining)
+	}
+	return written, nil
+}
+
+// failStream turns a failure before the first byte into a 502. Once data
+// has been sent the short body is what tells the client it failed.
+func failStream(c *gin.Context) {
+	if c.Writer.Written() {
+		return
+	}
+	c.Writer.Header().Del("Content-Length")
+	c.Writer.Header().Del("Content-Range")
+	c.JSON(http.StatusBadGateway, gin.H{"error": "File data is unavailable or corrupt"})
+}
+
+func fileETag(file *FileInfo) string {
+	return fmt.Sprintf(`"%s-%d"`, file.ID, file.UpdatedAt.UnixNano())
+}
+
+// ifRangeMatches reports whether the If-Range validator (an entity tag or an
+// HTTP date) still describes the current file. An absent header matches.
+func ifRangeMatches(ifRange, etag string, modified time.Time) bool {
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		// Our tags are strong, so a weak validator never matches.
+		return ifRange == etag
+	}
+	t, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(t)
+}
+
+func rangePartHeader(r byteRange, contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Type":  {contentType},
+		"Content-Range": {r.contentRange(size)},
+	}
+}
+
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// multipartSize computes the exact length of a multipart/byteranges body so
+// that Content-Length can be sent up front.
+func multipartSize(ranges []byteRange, contentType string, size int64, boundary string) int64 {
+	var w countingWriter
+	mw := multipart.NewWriter(&w)
+	mw.SetBoundary(boundary)
+	for _, r := range ranges {
+		mw.CreatePart(rangePartHeader(r, contentType, size))
+		w += countingWriter(r.length)
+	}
+	mw.Close()
+	return int64(w)
+}
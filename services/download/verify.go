@@ -0,0 +1,192 @@
+// services/download/verify.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+
+	"atlasfs/services/common/events"
+	"atlasfs/services/common/outbox"
+	"atlasfs/services/common/storage"
+)
+
+var errChunkUnavailable = errors.New("no intact copy of chunk available")
+
+// chunkCopy is one place a chunk's object, or one shard of it, can be read
+// from, with the SHA-256 and size it must have.
+type chunkCopy struct {
+	Node     *storage.Node
+	Object   string
+	Shard    int // storage.NoShard for a whole copy
+	Checksum string
+	Size     int64
+	Recorded bool // listed in chunk_locations, so it is expected to exist
+}
+
+// chunkCopies lists the copies or shards of a chunk according to
+// chunk_locations: by shard, then healthy nodes first and, among those,
+// the primary first. Objects written before replication have no rows and
+// are looked for on every node.
+func (d *DownloadService) chunkCopies(ctx context.Context, chunk ChunkInfo) []chunkCopy {
+	var copies []chunkCopy
+
+	rows, err := d.db.QueryContext(ctx, `
+        SELECT node_id, shard_index, COALESCE(shard_checksum, '')
+        FROM chunk_locations
+        WHERE chunk_id = $1
+        ORDER BY shard_index, is_primary DESC, created_at
+    `, chunk.Checksum)
+	if err != nil {
+		log.Printf("Failed to look up replicas of %s: %v", chunk.Checksum, err)
+	} else {
+		defer rows.Close()
+		for rows.Next() {
+			var nodeID string
+			cp := chunkCopy{Recorded: true}
+			if err := rows.Scan(&nodeID, &cp.Shard, &cp.Checksum); err != nil {
+				continue
+			}
+			if cp.Node = d.cluster.Node(nodeID); cp.Node == nil {
+				continue
+			}
+			cp.Object = storage.ShardKey(chunk.Checksum, cp.Shard)
+			if cp.Shard == storage.NoShard {
+				cp.Checksum, cp.Size = chunk.Checksum, chunk.ChunkSize
+			} else {
+				cp.Size = chunk.Policy.ShardSize(chunk.ChunkSize)
+			}
+			copies = append(copies, cp)
+		}
+	}
+
+	if len(copies) == 0 {
+		for _, node := range d.cluster.Placement(chunk.Checksum) {
+			copies = append(copies, chunkCopy{
+				Node:     node,
+				Object:   chunk.Checksum,
+				Shard:    storage.NoShard,
+				Checksum: chunk.Checksum,
+				Size:     chunk.ChunkSize,
+			})
+		}
+		return copies
+	}
+
+	sort.SliceStable(copies, func(i, j int) bool {
+		if copies[i].Shard != copies[j].Shard {
+			return copies[i].Shard < copies[j].Shard
+		}
+		return copies[i].Node.Healthy() && !copies[j].Node.Healthy()
+	})
+	return copies
+}
+
+// legacyCopies lists where a chunk uploaded before content addressing may
+// be: under its chunk ID rather than its checksum, on any node. They are
+// tried after the copies under the checksum, in case it was stored again
+// since.
+func (d *DownloadService) legacyCopies(chunk ChunkInfo) []chunkCopy {
+	var copies []chunkCopy
+	for _, node := range d.cluster.Nodes {
+		copies = append(copies, chunkCopy{
+			Node:     node,
+			Object:   chunk.ChunkID,
+			Shard:    storage.NoShard,
+			Checksum: chunk.Checksum,
+			Size:     chunk.ChunkSize,
+		})
+	}
+	return copies
+}
+
+// fetchChunk reads a whole chunk into a pooled buffer, hashing it as it
+// streams, and only returns data whose SHA-256 and size match the chunks
+// row. A copy that fails verification is reported with a corruption event
+// and the next copy is tried. Erasure-coded chunks are rebuilt from their
+// shards instead. Release the buffer with releaseBuffer.
+func (d *DownloadService) fetchChunk(ctx context.Context, fileID string, chunk ChunkInfo) (*bytes.Buffer, error) {
+	if chunk.Policy.Erasure() {
+		return d.fetchErasureChunk(ctx, fileID, chunk)
+	}
+
+	buf := d.bufferPool.Get().(*bytes.Buffer)
+
+	copies := d.chunkCopies(ctx, chunk)
+	if chunk.Legacy {
+		copies = append(copies, d.legacyCopies(chunk)...)
+	}
+	for _, cp := range copies {
+		buf.Reset()
+		buf.Grow(int(chunk.ChunkSize))
+		if d.readVerified(ctx, fileID, chunk, cp, buf) {
+			return buf, nil
+		}
+	}
+
+	d.releaseBuffer(buf)
+	return nil, fmt.Errorf("chunk %s: %w", chunk.ChunkID, errChunkUnavailable)
+}
+
+// readVerified reads one copy or shard into buf and reports whether it
+// matches its checksum and size. Corrupt data is reported.
+func (d *DownloadService) readVerified(ctx context.Context, fileID string, chunk ChunkInfo, cp chunkCopy, buf *bytes.Buffer) bool {
+	checksum, err := d.readCopy(ctx, cp, buf)
+	if err != nil {
+		log.Printf("Failed to read %s from %s: %v", cp.Object, cp.Node.ID, err)
+		return false
+	}
+	if checksum == cp.Checksum && int64(buf.Len()) == cp.Size {
+		return true
+	}
+
+	log.Printf("❌ %s of chunk %s on %s is corrupt: sha256 %s, %d bytes (want %s, %d bytes)",
+		cp.Object, chunk.ChunkID, cp.Node.ID, checksum, buf.Len(), cp.Checksum, cp.Size)
+	d.reportCorruption(fileID, chunk, cp, checksum, int64(buf.Len()))
+	return false
+}
+
+// readCopy streams one copy into buf through a SHA-256 hasher. It reads at
+// most one byte past the expected size so oversized objects are detected
+// without being read in full.
+func (d *DownloadService) readCopy(ctx context.Context, cp chunkCopy, buf *bytes.Buffer) (string, error) {
+	obj, err := cp.Node.Get(ctx, cp.Object)
+	if err != nil {
+		return "", err
+	}
+	defer obj.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(buf, hasher), io.LimitReader(obj, cp.Size+1)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func (d *DownloadService) releaseBuffer(buf *bytes.Buffer) {
+	d.bufferPool.Put(buf)
+}
+
+func (d *DownloadService) reportCorruption(fileID string, chunk ChunkInfo, cp chunkCopy, actual string, size int64) {
+	event := events.NewEvent("download", events.ChunkCorruptedData{
+		Checksum:         chunk.Checksum,
+		NodeID:           cp.Node.ID,
+		StoragePath:      cp.Node.StoragePath(cp.Object),
+		ShardIndex:       cp.Shard,
+		ExpectedChecksum: cp.Checksum,
+		ActualChecksum:   actual,
+		ExpectedSize:     cp.Size,
+		DetectedBy:       "download",
+		FileID:           fileID,
+		ChunkID:          chunk.ChunkID,
+		Index:            &chunk.ChunkIndex,
+		ActualSize:       &size,
+	})
+	outbox.Record(d.db, chunk.ChunkID, event)
+}
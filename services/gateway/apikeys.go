@@ -0,0 +1,415 @@
+// services/gateway/apikeys.go
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+
+	"atlasfs/services/common/config"
+)
+
+// API keys look like afs_<key id>_<secret>. The key ID is stored in the
+// clear so the row can be found; the secret is only kept as a SHA-256.
+const apiKeyPrefix = "afs_"
+
+// Scopes an API key can be given.
+const (
+	ScopeFilesRead   = "files:read"
+	ScopeFilesWrite  = "files:write"
+	ScopeFilesDelete = "files:delete"
+	ScopeAdmin       = "admin"
+)
+
+var apiKeyScopes = []string{ScopeFilesRead, ScopeFilesWrite, ScopeFilesDelete, ScopeAdmin}
+
+// lastUsedResolution limits how often a busy key's last_used_at is written.
+const lastUsedResolution = time.Minute
+
+// S3 secret access keys cannot be hashed like the API key secret, since
+// SigV4 signatures are checked with the secret itself. They are stored
+// sealed with AES-256-GCM under S3_SECRET_KEY, bound to their key ID, and
+// opened only to verify a signature.
+const sealedS3SecretPrefix = "v1:"
+
+type createAPIKeyRequest struct {
+	Name      string     `json:"name" binding:"required"`
+	Scopes    []string   `json:"scopes" binding:"required"`
+	UserID    string     `json:"user_id,omitempty"`
+	TenantID  string     `json:"tenant_id,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	S3        bool       `json:"s3,omitempty"` // also issue S3 credentials
+}
+
+type apiKeyInfo struct {
+	KeyID      string     `json:"key_id"`
+	Name       string     `json:"name"`
+	UserID     string     `json:"user_id"`
+	TenantID   string     `json:"tenant_id,omitempty"`
+	Scopes     []string   `json:"scopes"`
+	CreatedBy  string     `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	S3         bool       `json:"s3"`
+}
+
+// apiKeyRecord is an api_keys row as authentication needs it.
+type apiKeyRecord struct {
+	keyID     string
+	keyHash   string
+	userID    string
+	tenantID  string
+	scopes    []string
+	s3Sealed  string // the sealed S3 secret, if the key has one
+	expiresAt sql.NullTime
+	revokedAt sql.NullTime
+}
+
+// createAPIKey issues a key acting as user_id (the caller by default). The
+// key itself is only ever returned here. With s3, the key also gets an S3
+// secret access key; its access key ID is the key ID.
+func (g *GatewayService) createAPIKey(c *gin.Context) {
+	var req createAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name and scopes are required"})
+		return
+	}
+	if len(req.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "at least one scope is required"})
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !validScope(scope) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":  fmt.Sprintf("unknown scope %q", scope),
+				"scopes": apiKeyScopes,
+			})
+			return
+		}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+	if req.S3 && g.config.S3SecretKey == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "S3 credentials are not configured"})
+		return
+	}
+	if g.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database not available"})
+		return
+	}
+
+	principal := currentPrincipal(c)
+	userID, tenantID := req.UserID, req.TenantID
+	if userID == "" {
+		userID = principal.Subject
+		if tenantID == "" {
+			tenantID = principal.Tenant
+		}
+	}
+
+	keyID, secret, err := generateAPIKey()
+	s3Secret, s3Sealed := "", ""
+	if err == nil && req.S3 {
+		s3Secret, err = generateS3Secret()
+		if err == nil {
+			s3Sealed, err = sealS3Secret(g.config, keyID, s3Secret)
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate key"})
+		return
+	}
+
+	var createdAt time.Time
+	err = g.db.QueryRow(`
+        INSERT INTO api_keys (key_id, key_hash, name, user_id, tenant_id, scopes, created_by, expires_at, s3_secret)
+        VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7, $8, NULLIF($9, ''))
+        RETURNING created_at
+    `, keyID, hashSecret(secret), req.Name, userID, tenantID, pq.Array(req.Scopes),
+		principal.Subject, req.ExpiresAt, s3Sealed).Scan(&createdAt)
+	if err != nil {
+		log.Printf("Failed to create API key: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create key"})
+		return
+	}
+
+	log.Printf("🔑 API key %s (%s) created for %s by %s", keyID, req.Name, userID, principal.Subject)
+	response := gin.H{
+		"key":        apiKeyPrefix + keyID + "_" + secret,
+		"key_id":     keyID,
+		"name":       req.Name,
+		"user_id":    userID,
+		"tenant_id":  tenantID,
+		"scopes":     req.Scopes,
+		"created_at": createdAt,
+		"expires_at": req.ExpiresAt,
+		"message":    "Store this key now, it cannot be shown again",
+	}
+	if s3Secret != "" {
+		response["s3_access_key_id"] = keyID
+		response["s3_secret_access_key"] = s3Secret
+	}
+	c.JSON(http.StatusCreated, response)
+}
+
+// listAPIKeys returns every key, or a single user's with ?user_id=.
+func (g *GatewayService) listAPIKeys(c *gin.Context) {
+	if g.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database not available"})
+		return
+	}
+
+	userID := c.Query("user_id")
+	rows, err := g.db.Query(`
+        SELECT key_id, name, user_id, COALESCE(tenant_id, ''), scopes, COALESCE(created_by, ''), created_at,
+               expires_at, last_used_at, revoked_at, s3_secret IS NOT NULL
+        FROM api_keys
+        WHERE $1 = '' OR user_id = $1
+        ORDER BY created_at DESC
+    `, userID)
+	if err != nil {
+		log.Printf("Failed to list API keys: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list keys"})
+		return
+	}
+	defer rows.Close()
+
+	keys := []apiKeyInfo{}
+	for rows.Next() {
+		var k apiKeyInfo
+		var expiresAt, lastUsedAt, revokedAt sql.NullTime
+		if err := rows.Scan(&k.KeyID, &k.Name, &k.UserID, &k.TenantID, pq.Array(&k.Scopes), &k.CreatedBy,
+			&k.CreatedAt, &expiresAt, &lastUsedAt, &revokedAt, &k.S3); err != nil {
+			continue
+		}
+		k.ExpiresAt = nullTime(expiresAt)
+		k.LastUsedAt = nullTime(lastUsedAt)
+		k.RevokedAt = nullTime(revokedAt)
+		keys = append(keys, k)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"keys":  keys,
+		"count": len(keys),
+	})
+}
+
+// revokeAPIKey disables a key at once. The row is kept for auditing.
+func (g *GatewayService) revokeAPIKey(c *gin.Context) {
+	if g.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database not available"})
+		return
+	}
+
+	keyID := c.Param("id")
+	result, err := g.db.Exec(`
+        UPDATE api_keys SET revoked_at = NOW()
+        WHERE key_id = $1 AND revoked_at IS NULL
+    `, keyID)
+	if err != nil {
+		log.Printf("Failed to revoke API key %s: %v", keyID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke key"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Key not found or already revoked"})
+		return
+	}
+
+	log.Printf("🔑 API key %s revoked by %s", keyID, currentPrincipal(c).Subject)
+	c.JSON(http.StatusOK, gin.H{
+		"key_id":  keyID,
+		"message": "Key revoked",
+	})
+}
+
+// verifyAPIKey looks up an afs_ bearer token and returns the principal it
+// acts as.
+func (g *GatewayService) verifyAPIKey(key string) (*Principal, error) {
+	keyID, secret, ok := strings.Cut(strings.TrimPrefix(key, apiKeyPrefix), "_")
+	if !ok || keyID == "" || secret == "" {
+		return nil, errors.New("malformed API key")
+	}
+	record, err := g.loadAPIKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(record.keyHash)) != 1 {
+		return nil, fmt.Errorf("wrong secret for API key %s", keyID)
+	}
+	return g.apiKeyPrincipal(record)
+}
+
+func (g *GatewayService) loadAPIKey(keyID string) (*apiKeyRecord, error) {
+	if g.db == nil {
+		return nil, errors.New("database not available")
+	}
+
+	record := &apiKeyRecord{keyID: keyID}
+	err := g.db.QueryRow(`
+        SELECT key_hash, user_id, COALESCE(tenant_id, ''), scopes, COALESCE(s3_secret, ''), expires_at, revoked_at
+        FROM api_keys WHERE key_id = $1
+    `, keyID).Scan(&record.keyHash, &record.userID, &record.tenantID, pq.Array(&record.scopes),
+		&record.s3Sealed, &record.expiresAt, &record.revokedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("unknown API key %s", keyID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// apiKeyPrincipal checks that a key whose secret was verified is still
+// valid, records its use and returns the principal it acts as.
+func (g *GatewayService) apiKeyPrincipal(record *apiKeyRecord) (*Principal, error) {
+	keyID := record.keyID
+	if record.revokedAt.Valid {
+		return nil, fmt.Errorf("API key %s was revoked", keyID)
+	}
+	if record.expiresAt.Valid && time.Now().After(record.expiresAt.Time) {
+		return nil, fmt.Errorf("API key %s expired", keyID)
+	}
+
+	_, err := g.db.Exec(`
+        UPDATE api_keys SET last_used_at = NOW()
+        WHERE key_id = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - make_interval(secs => $2))
+    `, keyID, lastUsedResolution.Seconds())
+	if err != nil {
+		log.Printf("Failed to record use of API key %s: %v", keyID, err)
+	}
+
+	principal := &Principal{Subject: record.userID, Tenant: record.tenantID, Scopes: record.scopes,
+		Method: "api_key", KeyID: keyID}
+	principal.Admin = principal.HasScope(ScopeAdmin)
+	return principal, nil
+}
+
+// requireScope rejects API keys that were not given scope. Users are not
+// limited by scope; ownership checks still apply to them.
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !currentPrincipal(c).Allows(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": fmt.Sprintf("API key lacks the %s scope", scope),
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+func requireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !currentPrincipal(c).Admin {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+func generateAPIKey() (keyID, secret string, err error) {
+	buf := make([]byte, 8+32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(buf[:8]), hex.EncodeToString(buf[8:]), nil
+}
+
+// generateS3Secret returns a 40 character secret access key, the length
+// S3 clients expect.
+func generateS3Secret() (string, error) {
+	buf := make([]byte, 30)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func s3SecretCipher(cfg *config.Config) (cipher.AEAD, error) {
+	if cfg.S3SecretKey == "" {
+		return nil, errors.New("S3_SECRET_KEY is not set")
+	}
+	key := sha256.Sum256([]byte(cfg.S3SecretKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealS3Secret encrypts an S3 secret access key for storage.
+func sealS3Secret(cfg *config.Config, keyID, secret string) (string, error) {
+	aead, err := s3SecretCipher(cfg)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(secret), []byte(keyID))
+	return sealedS3SecretPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// openS3Secret decrypts a key's S3 secret access key sealed by
+// sealS3Secret.
+func openS3Secret(cfg *config.Config, keyID, sealed string) (string, error) {
+	aead, err := s3SecretCipher(cfg)
+	if err != nil {
+		return "", err
+	}
+	encoded, ok := strings.CutPrefix(sealed, sealedS3SecretPrefix)
+	if !ok {
+		return "", fmt.Errorf("S3 secret of API key %s is not sealed", keyID)
+	}
+	raw, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(raw) < aead.NonceSize() {
+		return "", fmt.Errorf("S3 secret of API key %s is malformed", keyID)
+	}
+	secret, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], []byte(keyID))
+	if err != nil {
+		return "", fmt.Errorf("S3 secret of API key %s cannot be opened: %w", keyID, err)
+	}
+	return string(secret), nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func validScope(scope string) bool {
+	for _, s := range apiKeyScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
@@ -0,0 +1,313 @@
+// services/gateway/auth.go
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+
+	"atlasfs/services/common/config"
+)
+
+// AnonymousUser owns files uploaded while authentication is disabled.
+const AnonymousUser = "anonymous"
+
+const principalKey = "principal"
+
+// Principal is the authenticated caller of an API request.
+type Principal struct {
+	Subject string   `json:"subject"`
+	Tenant  string   `json:"tenant,omitempty"`
+	Scopes  []string `json:"scopes"`
+	Method  string   `json:"method"` // "jwt", "api_key" or "anonymous"
+	KeyID   string   `json:"key_id,omitempty"`
+	Admin   bool     `json:"admin"`
+}
+
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows reports whether the principal may use endpoints that need scope.
+// Only API keys are limited by their scopes.
+func (p *Principal) Allows(scope string) bool {
+	return p.Admin || p.Method != "api_key" || p.HasScope(scope)
+}
+
+// CanAccess reports whether the principal may see or change a file owned
+// by owner: its own files, or any file for an admin.
+func (p *Principal) CanAccess(owner string) bool {
+	return p.Admin || p.Subject == owner
+}
+
+// currentPrincipal returns the caller set by authenticate.
+func currentPrincipal(c *gin.Context) *Principal {
+	if p, ok := c.Get(principalKey); ok {
+		return p.(*Principal)
+	}
+	return &Principal{Subject: AnonymousUser, Method: "anonymous"}
+}
+
+// authenticate requires a valid bearer token on every request and stores
+// the caller as the request's Principal. The token is either an API key
+// (afs_...) or a user JWT. Only with AUTH_DISABLED set is user
+// authentication off, and callers without an API key are the anonymous
+// admin, which is how the API behaved before it had authentication.
+func (g *GatewayService) authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		g.authenticateToken(c, token, ok, `Bearer realm="atlasfs"`)
+	}
+}
+
+// authenticateToken checks the credential a request presented, if it had
+// one, and continues as its principal. A rejected request is challenged
+// for credentials of the given kind.
+func (g *GatewayService) authenticateToken(c *gin.Context, token string, ok bool, challenge string) {
+	if ok && strings.HasPrefix(token, apiKeyPrefix) {
+		principal, err := g.verifyAPIKey(token)
+		if err != nil {
+			log.Printf("Rejected API key from %s: %v", c.ClientIP(), err)
+			unauthorized(c, challenge, "Invalid API key")
+			return
+		}
+		c.Set(principalKey, principal)
+		c.Next()
+		return
+	}
+
+	if g.config.AuthDisabled {
+		c.Set(principalKey, &Principal{Subject: AnonymousUser, Method: "anonymous", Admin: true})
+		c.Next()
+		return
+	}
+	if g.jwtVerifier == nil {
+		// NewGatewayService refuses to start like this; fail closed anyway
+		unauthorized(c, challenge, "Authentication is not configured")
+		return
+	}
+
+	if !ok || token == "" {
+		unauthorized(c, challenge, "Missing bearer token")
+		return
+	}
+
+	principal, err := g.jwtVerifier.verify(token)
+	if err != nil {
+		log.Printf("Rejected token from %s: %v", c.ClientIP(), err)
+		unauthorized(c, challenge, "Invalid token")
+		return
+	}
+	principal.Admin = principal.HasScope(g.config.AdminScope)
+
+	c.Set(principalKey, principal)
+	c.Next()
+}
+
+func unauthorized(c *gin.Context, challenge, message string) {
+	c.Header("WWW-Authenticate", challenge)
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": message})
+}
+
+// jwtVerifier checks HS256 tokens against a shared secret and RS256 tokens
+// against a PEM public key or the keys of a JWKS file, picked by kid.
+type jwtVerifier struct {
+	secret    []byte
+	publicKey *rsa.PublicKey
+	jwks      *jwksFile
+	parser    *jwt.Parser
+
+	tenantClaim string
+}
+
+// newJWTVerifier returns nil when no key is configured.
+func newJWTVerifier(cfg *config.Config) (*jwtVerifier, error) {
+	v := &jwtVerifier{tenantClaim: cfg.JWTTenantClaim}
+	if cfg.JWTSecret != "" {
+		v.secret = []byte(cfg.JWTSecret)
+	}
+	if cfg.JWTPublicKeyFile != "" {
+		pem, err := os.ReadFile(cfg.JWTPublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if v.publicKey, err = jwt.ParseRSAPublicKeyFromPEM(pem); err != nil {
+			return nil, fmt.Errorf("%s: %w", cfg.JWTPublicKeyFile, err)
+		}
+	}
+	if cfg.JWTJWKSFile != "" {
+		v.jwks = &jwksFile{path: cfg.JWTJWKSFile}
+		if err := v.jwks.load(); err != nil {
+			return nil, err
+		}
+	}
+	if v.secret == nil && v.publicKey == nil && v.jwks == nil {
+		return nil, nil
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"HS256", "RS256"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30 * time.Second),
+	}
+	if cfg.JWTIssuer != "" {
+		opts = append(opts, jwt.WithIssuer(cfg.JWTIssuer))
+	}
+	if cfg.JWTAudience != "" {
+		opts = append(opts, jwt.WithAudience(cfg.JWTAudience))
+	}
+	v.parser = jwt.NewParser(opts...)
+	return v, nil
+}
+
+func (v *jwtVerifier) verify(tokenString string) (*Principal, error) {
+	claims := jwt.MapClaims{}
+	if _, err := v.parser.ParseWithClaims(tokenString, claims, v.key); err != nil {
+		return nil, err
+	}
+
+	subject, err := claims.GetSubject()
+	if err != nil || subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+	tenant, _ := claims[v.tenantClaim].(string)
+	return &Principal{Subject: subject, Tenant: tenant, Scopes: tokenScopes(claims), Method: "jwt"}, nil
+}
+
+func (v *jwtVerifier) key(token *jwt.Token) (interface{}, error) {
+	switch token.Method.Alg() {
+	case "HS256":
+		if v.secret == nil {
+			return nil, errors.New("HS256 tokens are not accepted")
+		}
+		return v.secret, nil
+	case "RS256":
+		kid, _ := token.Header["kid"].(string)
+		if kid != "" && v.jwks != nil {
+			return v.jwks.key(kid)
+		}
+		if v.publicKey != nil {
+			return v.publicKey, nil
+		}
+		return nil, errors.New("RS256 token has no known kid")
+	}
+	return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+}
+
+// tokenScopes reads scopes from the OAuth2 "scope" claim (space separated)
+// or from a "scp" or "scopes" list.
+func tokenScopes(claims jwt.MapClaims) []string {
+	for _, name := range []string{"scope", "scp", "scopes"} {
+		switch v := claims[name].(type) {
+		case string:
+			return strings.Fields(v)
+		case []interface{}:
+			scopes := make([]string, 0, len(v))
+			for _, s := range v {
+				if s, ok := s.(string); ok {
+					scopes = append(scopes, s)
+				}
+			}
+			return scopes
+		}
+	}
+	return nil
+}
+
+// jwksFile holds the RSA keys of a local JWKS file. The file is re-read
+// when a token names a kid it does not know and the file has changed, so
+// keys can be rotated without a restart.
+type jwksFile struct {
+	path string
+
+	mu       sync.Mutex
+	keys     map[string]*rsa.PublicKey
+	modified time.Time
+}
+
+func (j *jwksFile) key(kid string) (*rsa.PublicKey, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if key, ok := j.keys[kid]; ok {
+		return key, nil
+	}
+	if info, err := os.Stat(j.path); err == nil && info.ModTime().After(j.modified) {
+		if err := j.loadLocked(); err != nil {
+			log.Printf("Failed to reload JWKS %s: %v", j.path, err)
+		}
+	}
+	if key, ok := j.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown kid %q", kid)
+}
+
+func (j *jwksFile) load() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.loadLocked()
+}
+
+func (j *jwksFile) loadLocked() error {
+	info, err := os.Stat(j.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(j.path)
+	if err != nil {
+		return err
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("%s: %w", j.path, err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || k.Kid == "" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) > 4 {
+			log.Printf("Skipping malformed JWKS key %s", k.Kid)
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	j.keys = keys
+	j.modified = info.ModTime()
+	log.Printf("✅ Loaded %d keys from JWKS %s", len(keys), j.path)
+	return nil
+}
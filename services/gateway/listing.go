@@ -0,0 +1,233 @@
+// services/gateway/listing.go
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// cursorTimeLayout keeps a cursor timestamp exactly as Postgres returned it,
+// so it compares equal when cast back to TIMESTAMP.
+const cursorTimeLayout = "2006-01-02 15:04:05.999999"
+
+// listSorts maps the sort query parameter onto a column and its SQL type.
+var listSorts = map[string]struct{ column, sqlType string }{
+	"name":       {"file_name", "text"},
+	"size":       {"file_size", "bigint"},
+	"created_at": {"created_at", "timestamp"},
+	"updated_at": {"updated_at", "timestamp"},
+}
+
+// listCursor is where the previous page ended: the sort key and file_id of
+// its last row. It is handed out base64 encoded and treated as opaque.
+type listCursor struct {
+	Sort   string `json:"s"`
+	Desc   bool   `json:"d"`
+	Value  string `json:"v"`
+	FileID string `json:"id"`
+}
+
+func (lc listCursor) encode() string {
+	data, _ := json.Marshal(lc)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeListCursor also checks the value suits its sort's SQL type, so a
+// tampered cursor is rejected here rather than failing the query.
+func decodeListCursor(s string) (listCursor, error) {
+	var lc listCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(data, &lc)
+	}
+	if err != nil || lc.FileID == "" {
+		return lc, errors.New("invalid cursor")
+	}
+
+	sort, ok := listSorts[lc.Sort]
+	switch {
+	case !ok:
+		err = errors.New("unknown sort")
+	case sort.sqlType == "bigint":
+		_, err = strconv.ParseInt(lc.Value, 10, 64)
+	case sort.sqlType == "timestamp":
+		_, err = time.Parse(cursorTimeLayout, lc.Value)
+	case !utf8.ValidString(lc.Value) || strings.ContainsRune(lc.Value, 0):
+		err = errors.New("not valid text")
+	}
+	if err != nil || !utf8.ValidString(lc.FileID) || strings.ContainsRune(lc.FileID, 0) {
+		return lc, errors.New("invalid cursor")
+	}
+	return lc, nil
+}
+
+// fileListQuery is a parsed GET /api/v1/files request.
+type fileListQuery struct {
+	sort   string
+	desc   bool
+	limit  int
+	cursor *listCursor
+	total  bool
+
+	where []string
+	args  []interface{}
+}
+
+func (q *fileListQuery) arg(v interface{}) string {
+	q.args = append(q.args, v)
+	return fmt.Sprintf("$%d", len(q.args))
+}
+
+// parseFileListQuery reads paging, sorting and filters. ownerID, when set,
+// restricts the listing to one user's files.
+func parseFileListQuery(values url.Values, ownerID string) (*fileListQuery, error) {
+	q := &fileListQuery{sort: "created_at", desc: true, limit: defaultListLimit}
+
+	// A file is listed once, as its current version, unless it is in the
+	// trash
+	q.where = append(q.where, "deleted_at IS NULL", isHeadVersion)
+
+	if s := values.Get("sort"); s != "" {
+		if s == "date" {
+			s = "created_at"
+		}
+		if _, ok := listSorts[s]; !ok {
+			return nil, fmt.Errorf("sort must be name, size, created_at or updated_at")
+		}
+		q.sort = s
+		q.desc = s != "name" // newest and largest first, names A to Z
+	}
+	switch values.Get("order") {
+	case "":
+	case "asc":
+		q.desc = false
+	case "desc":
+		q.desc = true
+	default:
+		return nil, errors.New("order must be asc or desc")
+	}
+
+	if s := values.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxListLimit {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxListLimit)
+		}
+		q.limit = n
+	}
+	if s := values.Get("cursor"); s != "" {
+		lc, err := decodeListCursor(s)
+		if err != nil {
+			return nil, err
+		}
+		if lc.Sort != q.sort || lc.Desc != q.desc {
+			return nil, errors.New("cursor was issued for a different sort order")
+		}
+		q.cursor = &lc
+	}
+	q.total, _ = strconv.ParseBool(values.Get("include_total"))
+
+	// Filters
+	if ownerID != "" {
+		q.where = append(q.where, "user_id = "+q.arg(ownerID))
+	}
+	if s := values.Get("user_id"); s != "" {
+		q.where = append(q.where, "user_id = "+q.arg(s))
+	}
+	if s := values.Get("status"); s != "" {
+		q.where = append(q.where, "status = "+q.arg(s))
+	}
+	if s := values.Get("name_prefix"); s != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+		q.where = append(q.where, "file_name LIKE "+q.arg(escaped+"%"))
+	}
+	for _, f := range []struct{ param, cond string }{{"min_size", ">="}, {"max_size", "<="}} {
+		if s := values.Get(f.param); s != "" {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("%s must be a byte count", f.param)
+			}
+			q.where = append(q.where, "file_size "+f.cond+" "+q.arg(n))
+		}
+	}
+	for _, f := range []struct{ param, column, cond string }{
+		{"created_after", "created_at", ">="},
+		{"created_before", "created_at", "<"},
+		{"updated_after", "updated_at", ">="},
+		{"updated_before", "updated_at", "<"},
+	} {
+		if s := values.Get(f.param); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be an RFC 3339 time", f.param)
+			}
+			q.where = append(q.where, f.column+" "+f.cond+" "+q.arg(t))
+		}
+	}
+	return q, nil
+}
+
+// filter is the WHERE clause without the cursor, shared with the count.
+func (q *fileListQuery) filter() string {
+	if len(q.where) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(q.where, " AND ")
+}
+
+// pageSQL returns the query for one page plus a row, to tell whether
+// there is a next page. Ties on the sort key are broken by file_id.
+func (q *fileListQuery) pageSQL() (string, []interface{}) {
+	sort := listSorts[q.sort]
+	dir, cmp := "ASC", ">"
+	if q.desc {
+		dir, cmp = "DESC", "<"
+	}
+
+	where, args := q.where, q.args
+	if q.cursor != nil {
+		args = append(args[:len(args):len(args)], q.cursor.Value, q.cursor.FileID)
+		where = append(where[:len(where):len(where)], fmt.Sprintf("(%s, file_id) %s ($%d::%s, $%d)",
+			sort.column, cmp, len(args)-1, sort.sqlType, len(args)))
+	}
+	clause := ""
+	if len(where) > 0 {
+		clause = "WHERE " + strings.Join(where, " AND ")
+	}
+
+	return fmt.Sprintf(`
+        SELECT file_id, logical_id, version, file_name, file_size, status, chunk_count, COALESCE(user_id, ''),
+               created_at, updated_at
+        FROM files
+        %s
+        ORDER BY %s %s, file_id %s
+        LIMIT %d
+    `, clause, sort.column, dir, dir, q.limit+1), args
+}
+
+// cursorAfter returns the cursor for the page following a row.
+func (q *fileListQuery) cursorAfter(fileID, fileName string, fileSize int64, createdAt, updatedAt time.Time) string {
+	lc := listCursor{Sort: q.sort, Desc: q.desc, FileID: fileID}
+	switch q.sort {
+	case "name":
+		lc.Value = fileName
+	case "size":
+		lc.Value = strconv.FormatInt(fileSize, 10)
+	case "created_at":
+		lc.Value = createdAt.Format(cursorTimeLayout)
+	case "updated_at":
+		lc.Value = updatedAt.Format(cursorTimeLayout)
+	}
+	return lc.encode()
+}
@@ -2,7 +2,6 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
@@ -11,6 +10,7 @@ import (
 	"log"
 	"mime/multipart"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -21,6 +21,9 @@ import (
 	// Use relative imports
 	"atlasfs/services/common/config"
 	"atlasfs/services/common/events"
+	"atlasfs/services/common/models"
+	"atlasfs/services/common/outbox"
+	"atlasfs/services/common/storage"
 )
 
 type GatewayService struct {
@@ -29,6 +32,10 @@ type GatewayService struct {
 	kafkaWriter *kafka.Writer
 	db          *sql.DB
 	router      *gin.Engine
+	jwtVerifier *jwtVerifier
+	limiter     *rateLimiter
+	shareSecret []byte
+	davLocks    davLocks
 }
 
 func NewGatewayService() *GatewayService {
@@ -72,12 +79,46 @@ func NewGatewayService() *GatewayService {
 		}
 	}
 
+	// Initialize authentication
+	verifier, err := newJWTVerifier(cfg)
+	if err != nil {
+		log.Fatalf("Invalid JWT configuration: %v", err)
+	}
+	switch {
+	case verifier != nil && cfg.AuthDisabled:
+		log.Fatalf("AUTH_DISABLED is set but so is a JWT key; unset one of them")
+	case verifier == nil && !cfg.AuthDisabled:
+		log.Fatalf("No JWT keys configured: set JWT_SECRET, JWT_PUBLIC_KEY_FILE or JWT_JWKS_FILE, " +
+			"or AUTH_DISABLED=true to serve every caller as an admin")
+	case cfg.AuthDisabled:
+		log.Printf("⚠️ ⚠️ ⚠️ AUTH_DISABLED=true: API authentication is OFF and every caller " +
+			"without an API key is an admin. Never expose this gateway beyond a trusted network.")
+	}
+
+	// Initialize rate limiting
+	limiter, err := newRateLimiter(cfg, redisClient)
+	if err != nil {
+		log.Fatalf("Invalid rate limit configuration: %v", err)
+	}
+	if limiter == nil {
+		log.Printf("⚠️ Rate limiting is disabled")
+	}
+
+	// Initialize share link signing
+	shareSecret, err := newShareSecret(cfg)
+	if err != nil {
+		log.Fatalf("Failed to initialize share links: %v", err)
+	}
+
 	return &GatewayService{
 		config:      cfg,
 		redisClient: redisClient,
 		kafkaWriter: kafkaWriter,
 		db:          db,
 		router:      gin.Default(),
+		jwtVerifier: verifier,
+		limiter:     limiter,
+		shareSecret: shareSecret,
 	}
 }
 
@@ -86,13 +127,83 @@ func (g *GatewayService) setupRoutes() {
 	g.router.GET("/", g.home)
 	g.router.GET("/health", g.healthCheck)
 
-	// File operations
-	api := g.router.Group("/api/v1")
+	// Share links need no credentials; the signed URL is the credential
+	g.router.GET("/s/:id", g.rateLimit(limitRead), g.limitTransfer(limitDownloadBytes), g.getSharedFile)
+
+	// File operations, limited to the caller's own files unless admin
+	api := g.router.Group("/api/v1", g.rateLimitIP(), g.authenticate())
 	{
-		api.POST("/files", g.uploadFile)
-		api.GET("/files/:id", g.getFile)
-		api.GET("/files", g.listFiles)
-		api.DELETE("/files/:id", g.deleteFile)
+		api.POST("/files", g.rateLimit(limitWrite), requireScope(ScopeFilesWrite),
+			g.limitTransfer(limitUploadBytes), g.uploadFile)
+		api.GET("/files/:id", g.rateLimit(limitRead), requireScope(ScopeFilesRead),
+			g.limitTransfer(limitDownloadBytes), g.getFile)
+		api.GET("/files", g.rateLimit(limitRead), requireScope(ScopeFilesRead), g.listFiles)
+		api.DELETE("/files/:id", g.rateLimit(limitWrite), requireScope(ScopeFilesDelete), g.deleteFile)
+
+		// Share links
+		api.POST("/files/:id/shares", g.rateLimit(limitWrite), requireScope(ScopeFilesWrite), g.createShare)
+		api.GET("/files/:id/shares", g.rateLimit(limitRead), requireScope(ScopeFilesRead), g.listShares)
+		api.DELETE("/shares/:id", g.rateLimit(limitWrite), requireScope(ScopeFilesWrite), g.revokeShare)
+
+		// Trash
+		api.GET("/trash", g.rateLimit(limitRead), requireScope(ScopeFilesRead), g.listTrash)
+		api.POST("/trash/:id/restore", g.rateLimit(limitWrite), requireScope(ScopeFilesWrite), g.restoreTrash)
+		api.DELETE("/trash/:id", g.rateLimit(limitWrite), requireScope(ScopeFilesDelete), g.purgeTrash)
+
+		// File versions
+		api.GET("/files/:id/versions", g.rateLimit(limitRead), requireScope(ScopeFilesRead), g.listVersions)
+		api.POST("/files/:id/versions", g.rateLimit(limitWrite), requireScope(ScopeFilesWrite),
+			g.limitTransfer(limitUploadBytes), g.uploadVersion)
+		api.GET("/files/:id/versions/:version", g.rateLimit(limitRead), requireScope(ScopeFilesRead),
+			g.limitTransfer(limitDownloadBytes), g.getVersion)
+		api.POST("/files/:id/versions/:version/restore", g.rateLimit(limitWrite), requireScope(ScopeFilesWrite),
+			g.restoreVersion)
+		api.POST("/files/:id/versions/prune", g.rateLimit(limitWrite), requireScope(ScopeFilesDelete),
+			g.pruneVersions)
+
+		// Resumable uploads, proxied to the upload service
+		api.POST("/uploads", g.rateLimit(limitWrite), requireScope(ScopeFilesWrite), g.createUpload)
+		api.GET("/uploads/:id", g.rateLimit(limitRead), requireScope(ScopeFilesWrite), g.getUpload)
+		api.PUT("/uploads/:id/chunks/:index", g.rateLimit(limitWrite), requireScope(ScopeFilesWrite),
+			g.limitTransfer(limitUploadBytes), g.uploadChunk)
+		api.POST("/uploads/:id/complete", g.rateLimit(limitWrite), requireScope(ScopeFilesWrite), g.completeUpload)
+
+		// Directory tree and path based access
+		api.GET("/fs/*path", g.rateLimit(limitRead), requireScope(ScopeFilesRead),
+			g.limitTransfer(limitDownloadBytes), g.getPath)
+		api.PUT("/fs/*path", g.rateLimit(limitWrite), requireScope(ScopeFilesWrite),
+			g.limitTransfer(limitUploadBytes), g.uploadPath)
+		api.DELETE("/fs/*path", g.rateLimit(limitWrite), requireScope(ScopeFilesDelete), g.deletePath)
+		api.POST("/mkdir", g.rateLimit(limitWrite), requireScope(ScopeFilesWrite), g.mkdir)
+		api.POST("/move", g.rateLimit(limitWrite), requireScope(ScopeFilesWrite), g.movePath)
+
+		// Storage quotas
+		api.GET("/usage", g.rateLimit(limitRead), g.getUsage)
+
+		// API keys for machine clients, and quota management
+		admin := api.Group("/admin", g.rateLimit(limitAdmin), requireAdmin())
+		admin.POST("/keys", g.createAPIKey)
+		admin.GET("/keys", g.listAPIKeys)
+		admin.DELETE("/keys/:id", g.revokeAPIKey)
+		admin.PUT("/quotas/:scope/:subject", g.setQuota)
+		admin.DELETE("/quotas/:scope/:subject", g.deleteQuota)
+	}
+
+	// WebDAV on the same tree as /api/v1/fs, with the same credentials
+	dav := g.router.Group(webdavPrefix, g.rateLimitIP(), g.webdavAuthenticate())
+	for method, scope := range webdavScopes {
+		handlers := []gin.HandlerFunc{g.rateLimit(limitWrite), requireScope(scope)}
+		if scope == ScopeFilesRead {
+			handlers[0] = g.rateLimit(limitRead)
+		}
+		switch method {
+		case http.MethodGet:
+			handlers = append(handlers, g.limitTransfer(limitDownloadBytes))
+		case http.MethodPut:
+			handlers = append(handlers, g.limitTransfer(limitUploadBytes))
+		}
+		dav.Handle(method, "", append(handlers, g.serveWebDAV)...)
+		dav.Handle(method, "/*path", append(handlers, g.serveWebDAV)...)
 	}
 
 	// Test endpoints
@@ -102,105 +213,294 @@ func (g *GatewayService) setupRoutes() {
 	g.router.GET("/metrics", g.getMetrics)
 }
 
+// uploadFile streams the multipart file straight through to the upload
+// service. The body is never buffered: an io.Pipe couples reading from the
+// client to writing to the upload service, so a slow upload service slows
+// the client down rather than growing memory.
 func (g *GatewayService) uploadFile(c *gin.Context) {
-	file, header, err := c.Request.FormFile("file")
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "No file provided"})
+	g.streamUpload(c, uploadTarget{})
+}
+
+// uploadTarget places an upload in a user's directory tree, or makes it a
+// new version of an existing file. The zero value is a new file outside
+// the tree, named after the client's file.
+type uploadTarget struct {
+	dirID     string
+	name      string
+	userID    string
+	logicalID string
+	staged    bool // held out of sight until it becomes part of another file
+}
+
+func (g *GatewayService) streamUpload(c *gin.Context, target uploadTarget) {
+	if !g.checkQuota(c, target, declaredUploadSize(c.Request)) {
 		return
 	}
-	defer file.Close()
 
-	fileID := fmt.Sprintf("file_%d", time.Now().UnixNano())
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expected a multipart/form-data body"})
+		return
+	}
 
-	// Store initial metadata in PostgreSQL
-	if g.db != nil {
-		query := `
-            INSERT INTO files (file_id, file_name, file_size, status, user_id, created_at, updated_at)
-            VALUES ($1, $2, $3, $4, $5, $6, $7)
-        `
-		_, dbErr := g.db.Exec(query, fileID, header.Filename, header.Size,
-			"uploading", "anonymous", time.Now(), time.Now())
-		if dbErr != nil {
-			log.Printf("Failed to insert into PostgreSQL: %v", dbErr)
+	// Skip ahead to the file part. The storage policy may be given as a
+	// field before it or as a query parameter.
+	policyName := c.Query("storage_policy")
+	var part *multipart.Part
+	for {
+		p, err := reader.NextPart()
+		if err == io.EOF {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No file provided"})
+			return
 		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Malformed multipart body"})
+			return
+		}
+		if p.FormName() == "file" && p.FileName() != "" {
+			part = p
+			break
+		}
+		if p.FormName() == "storage_policy" {
+			value, _ := io.ReadAll(io.LimitReader(p, 20))
+			policyName = string(value)
+		}
+		p.Close()
 	}
+	defer part.Close()
 
-	// Forward to upload service for actual processing
-	uploadURL := "http://upload:8081/upload"
-
-	// Create a new multipart form
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-
-	// Add the file
-	part, err := writer.CreateFormFile("file", header.Filename)
+	policy, err := storage.ResolvePolicy(g.config, policyName)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create form"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Reset file reader to beginning
-	file.Seek(0, 0)
+	fileName := part.FileName()
+	if target.name != "" {
+		fileName = target.name
+	}
+	_, status, response := g.sendUpload(c, target, fileName, policy, part, declaredUploadSize(c.Request))
+	c.JSON(status, response)
+}
 
-	// Copy file data
-	_, err = io.Copy(part, file)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to copy file"})
-		return
+// sendUpload records a new file, or a new version of one, and streams its
+// data through the upload service's chunking path. It returns the new
+// row's file_id and the status and body to respond with.
+func (g *GatewayService) sendUpload(c *gin.Context, target uploadTarget, fileName string, policy storage.Policy,
+	data io.Reader, declaredSize int64) (string, int, gin.H) {
+	userID := currentPrincipal(c).Subject
+	if target.userID != "" {
+		userID = target.userID
 	}
+	fileID := fmt.Sprintf("file_%d", time.Now().UnixNano())
 
-	// ADD THIS: Pass the file_id to upload service
-	err = writer.WriteField("file_id", fileID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add file_id"})
-		return
+	// Store initial metadata in PostgreSQL. The size is what the client
+	// declared; the upload service records the real size when it finishes.
+	if g.db != nil {
+		dbErr := g.insertFile(c.Request.Context(), g.db, newFile{
+			fileID:    fileID,
+			name:      fileName,
+			size:      max(declaredSize, 0),
+			userID:    userID,
+			tenantID:  currentPrincipal(c).Tenant,
+			dirID:     target.dirID,
+			logicalID: target.logicalID,
+			staged:    target.staged,
+			policy:    policy,
+		})
+		if dbErr != nil {
+			log.Printf("Failed to insert into PostgreSQL: %v", dbErr)
+			// A file in the tree must not take the name of another, and a
+			// new version must not take the number of another
+			if target.dirID != "" || target.logicalID != "" || target.staged {
+				switch {
+				case isUniqueViolation(dbErr) && target.logicalID != "":
+					return fileID, http.StatusConflict, gin.H{"error": "Another version is being created, try again"}
+				case isUniqueViolation(dbErr):
+					return fileID, http.StatusConflict, gin.H{"error": "A file with that name already exists"}
+				default:
+					return fileID, http.StatusInternalServerError, gin.H{"error": "Failed to create file"}
+				}
+			}
+		}
 	}
 
-	err = writer.Close()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to close writer"})
-		return
+	// The declared size was checked against the quota, but the client may
+	// send more than it declared
+	quota := &quotaReader{r: data, room: g.quotaRoom(c, target)}
+	if quota.room >= 0 {
+		data = quota
 	}
 
+	// Forward to upload service for actual processing
+	uploadURL := uploadServiceURL + "/upload"
+
+	deadline := g.transferDeadline(declaredSize)
+	ctx, cancel := context.WithTimeout(c.Request.Context(), deadline)
+	defer cancel()
+
+	// file_id and storage_policy go first so the upload service knows them
+	// before the file data starts arriving
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	writer := multipart.NewWriter(pw)
+	go func() {
+		err := writer.WriteField("file_id", fileID)
+		if err == nil {
+			err = writer.WriteField("storage_policy", policy.String())
+		}
+		if err == nil {
+			var dst io.Writer
+			if dst, err = writer.CreateFormFile("file", fileName); err == nil {
+				if _, err = io.Copy(dst, data); err == nil {
+					err = writer.Close()
+				}
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+
 	// Create request to upload service
-	req, err := http.NewRequest("POST", uploadURL, body)
+	req, err := http.NewRequestWithContext(ctx, "POST", uploadURL, pr)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create request"})
-		return
+		return fileID, http.StatusInternalServerError, gin.H{"error": "Failed to create request"}
 	}
 	req.Header.Set("Content-Type", writer.FormDataContentType())
 
-	// Forward to upload service
-	client := &http.Client{Timeout: 30 * time.Second}
+	// Forward to upload service; the context carries the deadline
+	log.Printf("📤 Streaming %s to upload service as %s (declared %d bytes, deadline %s)",
+		fileName, fileID, declaredSize, deadline)
+	client := &http.Client{}
 	resp, err := client.Do(req)
+	if quota.exceeded.Load() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		log.Printf("Upload of %s cut off at the storage quota of %s", fileID, userID)
+		g.markUploadFailed(fileID)
+		return fileID, http.StatusInsufficientStorage, gin.H{"error": "Storage quota exceeded"}
+	}
 	if err != nil {
 		log.Printf("Failed to forward to upload service: %v", err)
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Upload service unavailable"})
-		return
+		g.markUploadFailed(fileID)
+		if ctx.Err() == context.DeadlineExceeded {
+			return fileID, http.StatusGatewayTimeout, gin.H{"error": "Upload timed out"}
+		}
+		return fileID, http.StatusServiceUnavailable, gin.H{"error": "Upload service unavailable"}
 	}
 	defer resp.Body.Close()
 
 	// Read response from upload service
-	var uploadResponse map[string]interface{}
+	var uploadResponse gin.H
 	if err := json.NewDecoder(resp.Body).Decode(&uploadResponse); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse upload response"})
-		return
+		return fileID, http.StatusInternalServerError, gin.H{"error": "Failed to parse upload response"}
+	}
+
+	if resp.StatusCode >= 400 {
+		g.markUploadFailed(fileID)
+		return fileID, resp.StatusCode, uploadResponse
+	}
+
+	// A new version is reported under its file's stable ID
+	if target.logicalID != "" {
+		uploadResponse["file_id"] = target.logicalID
+		uploadResponse["version_id"] = fileID
 	}
 
 	// Return the upload service response
-	c.JSON(http.StatusAccepted, uploadResponse)
+	return fileID, http.StatusAccepted, uploadResponse
+}
+
+// declaredUploadSize returns the size the client says it is sending: the
+// larger of the X-File-Size header and the request's Content-Length (which
+// slightly overstates it by the multipart framing), or -1 if it gave
+// neither. sendUpload holds the upload to the quota whatever it declared.
+func declaredUploadSize(r *http.Request) int64 {
+	size := r.ContentLength
+	if v := r.Header.Get("X-File-Size"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n >= 0 {
+			size = max(size, n)
+		}
+	}
+	return size
+}
+
+// transferDeadline allows a fixed base plus enough time to move size bytes
+// at the configured minimum throughput. Unknown sizes get the maximum.
+func (g *GatewayService) transferDeadline(size int64) time.Duration {
+	if size < 0 || g.config.UploadMinThroughput <= 0 {
+		return g.config.UploadTimeoutMax
+	}
+	deadline := g.config.UploadTimeoutBase +
+		time.Duration(float64(size)/float64(g.config.UploadMinThroughput)*float64(time.Second))
+	return min(deadline, g.config.UploadTimeoutMax)
+}
+
+// newFile is the files row recorded when an upload starts.
+type newFile struct {
+	fileID    string
+	name      string
+	size      int64
+	userID    string
+	tenantID  string
+	dirID     string
+	logicalID string // the file this is a new version of, if any
+	staged    bool
+	policy    storage.Policy
+}
+
+// insertFile records an upload as uploading. A new version takes its
+// file's name, place and owner and is numbered after its newest version.
+// A staged file is created in the trash, where nothing lists it.
+func (g *GatewayService) insertFile(ctx context.Context, q queryer, f newFile) error {
+	now := time.Now()
+	if f.logicalID != "" {
+		result, err := q.ExecContext(ctx, `
+            INSERT INTO files (file_id, file_name, file_size, status, user_id, tenant_id, dir_id,
+                               logical_id, version, storage_policy, created_at, updated_at)
+            SELECT $1, file_name, $2, $3, user_id, tenant_id, dir_id, logical_id,
+                   (SELECT MAX(version) + 1 FROM files WHERE logical_id = $4), $5, $6, $6
+            FROM files WHERE file_id = $4
+        `, f.fileID, f.size, models.StatusUploading, f.logicalID, f.policy.String(), now)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return fmt.Errorf("file %s not found", f.logicalID)
+		}
+		return nil
+	}
+
+	var deletedAt *time.Time
+	if f.staged {
+		deletedAt = &now
+	}
+	_, err := q.ExecContext(ctx, `
+        INSERT INTO files (file_id, file_name, file_size, status, user_id, tenant_id, dir_id,
+                           logical_id, version, storage_policy, deleted_at, staged, created_at, updated_at)
+        VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), $1, 1, $8, $9, $10, $11, $11)
+    `, f.fileID, f.name, f.size, models.StatusUploading, f.userID, f.tenantID, f.dirID, f.policy.String(),
+		deletedAt, f.staged, now)
+	return err
+}
+
+func (g *GatewayService) markUploadFailed(fileID string) {
+	if g.db == nil {
+		return
+	}
+	_, err := g.db.Exec(`UPDATE files SET status = $1, updated_at = $2 WHERE file_id = $3 AND status = $4`,
+		"failed", time.Now(), fileID, "uploading")
+	if err != nil {
+		log.Printf("Failed to mark %s as failed: %v", fileID, err)
+	}
 }
 
 func (g *GatewayService) testKafka(c *gin.Context) {
 	// Publish test event
-	event := events.NewEvent(
-		"test.event",
-		"gateway",
-		map[string]interface{}{
-			"test":      true,
-			"timestamp": time.Now().Unix(),
-		},
-	)
+	event := events.NewEvent("gateway", events.TestData{
+		Test:      true,
+		Timestamp: time.Now().Unix(),
+	})
 
 	eventData, _ := event.ToJSON()
 	err := g.kafkaWriter.WriteMessages(context.Background(),
@@ -303,6 +603,34 @@ func (g *GatewayService) home(c *gin.Context) {
 			"GET /api/v1/files",
 			"GET /api/v1/files/:id",
 			"DELETE /api/v1/files/:id",
+			"GET /api/v1/files/:id/versions",
+			"POST /api/v1/files/:id/versions",
+			"GET /api/v1/files/:id/versions/:version",
+			"POST /api/v1/files/:id/versions/:version/restore",
+			"POST /api/v1/files/:id/versions/prune",
+			"POST /api/v1/files/:id/shares",
+			"GET /api/v1/files/:id/shares",
+			"DELETE /api/v1/shares/:id",
+			"GET /s/:id",
+			"GET /api/v1/trash",
+			"POST /api/v1/trash/:id/restore",
+			"DELETE /api/v1/trash/:id",
+			"POST /api/v1/uploads",
+			"GET /api/v1/uploads/:id",
+			"PUT /api/v1/uploads/:id/chunks/:index",
+			"POST /api/v1/uploads/:id/complete",
+			"POST /api/v1/admin/keys",
+			"GET /api/v1/admin/keys",
+			"DELETE /api/v1/admin/keys/:id",
+			"GET /api/v1/fs/*path",
+			"PUT /api/v1/fs/*path",
+			"DELETE /api/v1/fs/*path",
+			"POST /api/v1/mkdir",
+			"POST /api/v1/move",
+			"WebDAV /webdav/*path",
+			"GET /api/v1/usage",
+			"PUT /api/v1/admin/quotas/:scope/:subject",
+			"DELETE /api/v1/admin/quotas/:scope/:subject",
 			"GET /metrics",
 		},
 	})
@@ -310,26 +638,61 @@ func (g *GatewayService) home(c *gin.Context) {
 
 func (g *GatewayService) getFile(c *gin.Context) {
 	fileID := c.Param("id")
+	if !g.authorizeFile(c, fileID) {
+		return
+	}
+	g.proxyDownload(c, g.currentVersion(fileID))
+}
 
-	// Proxy to download service
+func (g *GatewayService) proxyDownload(c *gin.Context, fileID string) {
+	// Proxy to download service; range requests go to the streaming endpoint,
+	// which is asked for the same attachment disposition as a full download
 	downloadURL := fmt.Sprintf("http://download:8085/download/%s", fileID)
+	if c.GetHeader("Range") != "" {
+		downloadURL = fmt.Sprintf("http://download:8085/stream/%s?disposition=attachment", fileID)
+	}
+	g.proxyFrom(c, downloadURL, nil)
+}
+
+// proxyFrom streams a download service response back to the client. The
+// headers in override replace the download service's. The transfer stops
+// when the client goes away, or at a deadline that is the base one until
+// the response headers arrive and is then scaled to the response's length.
+func (g *GatewayService) proxyFrom(c *gin.Context, downloadURL string, override http.Header) {
+	rangeHeader := c.GetHeader("Range")
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	deadline := time.AfterFunc(g.config.UploadTimeoutBase, cancel)
+	defer deadline.Stop()
 
 	// Create request to download service
-	req, err := http.NewRequest("GET", downloadURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", downloadURL, nil)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create request"})
 		return
 	}
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+		if ifRange := c.GetHeader("If-Range"); ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
+		}
+	}
 
 	// Forward request
-	client := &http.Client{Timeout: 30 * time.Second}
+	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
 		log.Printf("Failed to forward to download service: %v", err)
+		if ctx.Err() != nil && c.Request.Context().Err() == nil {
+			c.JSON(http.StatusGatewayTimeout, gin.H{"error": "Download timed out"})
+			return
+		}
 		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Download service unavailable"})
 		return
 	}
 	defer resp.Body.Close()
+	deadline.Reset(g.transferDeadline(resp.ContentLength))
 
 	// Check if file was not found
 	if resp.StatusCode == http.StatusNotFound {
@@ -343,59 +706,99 @@ func (g *GatewayService) getFile(c *gin.Context) {
 			c.Header(key, value)
 		}
 	}
+	for key, values := range override {
+		c.Writer.Header()[key] = values
+	}
 
 	// Stream the file back to client
 	c.Status(resp.StatusCode)
-	io.Copy(c.Writer, resp.Body)
+	if _, err := io.Copy(c.Writer, resp.Body); err != nil && c.Request.Context().Err() == nil {
+		log.Printf("Download from %s cut off: %v", downloadURL, err)
+	}
 }
 
+// listFiles returns a page of files. Pages are keyset paginated: pass the
+// next_cursor of one response as ?cursor= to get the next.
 func (g *GatewayService) listFiles(c *gin.Context) {
 	if g.db == nil {
 		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database not available"})
 		return
 	}
 
-	// Query PostgreSQL instead of Redis
-	rows, err := g.db.Query(`
-        SELECT file_id, file_name, file_size, status, chunk_count, created_at 
-        FROM files 
-        ORDER BY created_at DESC 
-        LIMIT 100
-    `)
+	// Admins see every user's files
+	principal := currentPrincipal(c)
+	ownerID := principal.Subject
+	if principal.Admin {
+		ownerID = ""
+	}
+	q, err := parseFileListQuery(c.Request.URL.Query(), ownerID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	query, args := q.pageSQL()
+	rows, err := g.db.Query(query, args...)
 	if err != nil {
+		log.Printf("Failed to list files: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query files"})
 		return
 	}
 	defer rows.Close()
 
 	files := []gin.H{}
+	lastCursor, nextCursor := "", ""
 	for rows.Next() {
-		var fileID, fileName, status string
+		var fileID, logicalID, fileName, status, userID string
 		var fileSize int64
-		var chunkCount int
-		var createdAt time.Time
+		var version, chunkCount int
+		var createdAt, updatedAt time.Time
 
-		err := rows.Scan(&fileID, &fileName, &fileSize, &status, &chunkCount, &createdAt)
+		err := rows.Scan(&fileID, &logicalID, &version, &fileName, &fileSize, &status, &chunkCount, &userID,
+			&createdAt, &updatedAt)
 		if err != nil {
 			continue
 		}
+		if len(files) == q.limit {
+			nextCursor = lastCursor // there is at least one more row
+			break
+		}
+		lastCursor = q.cursorAfter(fileID, fileName, fileSize, createdAt, updatedAt)
 
 		files = append(files, gin.H{
-			"file_id":     fileID,
+			"file_id":     logicalID,
+			"version":     version,
+			"version_id":  fileID,
 			"filename":    fileName,
 			"size":        fileSize,
 			"status":      status,
 			"chunk_count": chunkCount,
+			"user_id":     userID,
 			"created_at":  createdAt,
+			"updated_at":  updatedAt,
 		})
 	}
 
-	c.JSON(http.StatusOK, gin.H{
+	response := gin.H{
 		"files": files,
 		"count": len(files),
-	})
+	}
+	if nextCursor != "" {
+		response["next_cursor"] = nextCursor
+	}
+	if q.total {
+		var total int64
+		if err := g.db.QueryRow("SELECT COUNT(*) FROM files "+q.filter(), q.args...).Scan(&total); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count files"})
+			return
+		}
+		response["total"] = total
+	}
+	c.JSON(http.StatusOK, response)
 }
 
+// deleteFile moves a file, with all its versions, to the trash. It is
+// purged once the trash retention period is over.
 func (g *GatewayService) deleteFile(c *gin.Context) {
 	fileID := c.Param("id")
 
@@ -404,8 +807,8 @@ func (g *GatewayService) deleteFile(c *gin.Context) {
 		return
 	}
 
-	// Start transaction
-	tx, err := g.db.Begin()
+	ctx := c.Request.Context()
+	tx, err := g.db.BeginTx(ctx, nil)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
 		return
@@ -413,32 +816,138 @@ func (g *GatewayService) deleteFile(c *gin.Context) {
 	defer tx.Rollback()
 
 	// Check if file exists
-	var exists bool
-	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM files WHERE file_id = $1)", fileID).Scan(&exists)
-	if err != nil || !exists {
+	var logicalID, userID, dirID string
+	err = tx.QueryRowContext(ctx, `
+        SELECT logical_id, COALESCE(user_id, ''), COALESCE(dir_id, '')
+        FROM files WHERE file_id = $1 AND deleted_at IS NULL
+    `, fileID).Scan(&logicalID, &userID, &dirID)
+	if err != nil || !currentPrincipal(c).CanAccess(userID) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
 		return
 	}
 
-	// Delete from files table (chunks will cascade delete due to foreign key)
-	_, err = tx.Exec("DELETE FROM files WHERE file_id = $1", fileID)
-	if err != nil {
+	trashedFrom := ""
+	if dirID != "" {
+		if trashedFrom, err = dirPath(ctx, tx, dirID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file"})
+			return
+		}
+	}
+	deletedAt := time.Now()
+	if err := trashFile(ctx, tx, logicalID, trashedFrom, deletedAt); err != nil {
+		log.Printf("Failed to move %s to the trash: %v", logicalID, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file"})
 		return
 	}
-
-	// Commit transaction
 	if err = tx.Commit(); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit deletion"})
 		return
 	}
 
-	// TODO: Also delete chunks from MinIO (optional, implement later)
+	log.Printf("🗑️ Moved %s to the trash", logicalID)
+	response := gin.H{
+		"file_id":    logicalID,
+		"deleted_at": deletedAt,
+		"message":    "File moved to trash",
+	}
+	if g.config.TrashRetention > 0 {
+		response["purge_at"] = deletedAt.Add(g.config.TrashRetention)
+	}
+	c.JSON(http.StatusOK, response)
+}
 
-	c.JSON(http.StatusOK, gin.H{
-		"file_id": fileID,
-		"message": "File deleted successfully",
-	})
+// removeFile deletes a file row locked by the caller's transaction and
+// releases its references on chunk objects. The returned event is to be
+// published once the transaction commits.
+func removeFile(tx *sql.Tx, fileID, fileName string, fileSize int64, userID string) (*events.Event, error) {
+	checksums, err := releaseChunks(tx, fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Delete from files table (chunks will cascade delete due to foreign key)
+	if _, err = tx.Exec("DELETE FROM files WHERE file_id = $1", fileID); err != nil {
+		return nil, err
+	}
+	return fileDeletedEvent(events.FileDeletedData{
+		FileID:    fileID,
+		FileName:  fileName,
+		Size:      fileSize,
+		UserID:    userID,
+		Checksums: checksums,
+	}), nil
+}
+
+// releaseChunks drops a file's references on its chunk objects and returns
+// their checksums.
+func releaseChunks(tx *sql.Tx, fileID string) ([]string, error) {
+	// Remember which chunk objects the file used so the collector can
+	// remove the ones nothing else references
+	checksums, err := fileChecksums(tx, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("load chunks: %w", err)
+	}
+
+	// Release this file's references on its chunk objects
+	_, err = tx.Exec(`
+        UPDATE chunk_objects co
+        SET ref_count = co.ref_count - r.refs
+        FROM (SELECT checksum, COUNT(*) AS refs FROM chunks WHERE file_id = $1 GROUP BY checksum) r
+        WHERE co.checksum = r.checksum
+    `, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("release chunks: %w", err)
+	}
+	return checksums, nil
+}
+
+// fileDeletedEvent builds the event the collector and quota accounting act
+// on.
+func fileDeletedEvent(data events.FileDeletedData) *events.Event {
+	return events.NewEvent("gateway", data)
+}
+
+// authorizeFile checks that the caller may access a file, responding with
+// 404 rather than 403 so other users' file IDs are not confirmed.
+func (g *GatewayService) authorizeFile(c *gin.Context, fileID string) bool {
+	principal := currentPrincipal(c)
+	if g.db == nil {
+		if principal.Admin {
+			return true // nothing is trashed without a database
+		}
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database not available"})
+		return false
+	}
+
+	// Trashed files are hidden from admins too
+	var owner string
+	err := g.db.QueryRow(`
+        SELECT COALESCE(user_id, '') FROM files WHERE file_id = $1 AND deleted_at IS NULL
+    `, fileID).Scan(&owner)
+	if err != nil || !principal.CanAccess(owner) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return false
+	}
+	return true
+}
+
+// fileChecksums returns the distinct chunk checksums a file references.
+func fileChecksums(tx *sql.Tx, fileID string) ([]string, error) {
+	rows, err := tx.Query(`SELECT DISTINCT checksum FROM chunks WHERE file_id = $1`, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checksums := []string{}
+	for rows.Next() {
+		var checksum string
+		if err := rows.Scan(&checksum); err != nil {
+			return nil, err
+		}
+		checksums = append(checksums, checksum)
+	}
+	return checksums, rows.Err()
 }
 
 func (g *GatewayService) testRedis(c *gin.Context) {
@@ -475,12 +984,54 @@ func (g *GatewayService) getMetrics(c *gin.Context) {
 	info := g.redisClient.Info(ctx, "stats").Val()
 	dbSize := g.redisClient.DBSize(ctx).Val()
 
-	c.JSON(http.StatusOK, gin.H{
+	metrics := gin.H{
 		"service":     "gateway",
 		"uptime":      time.Now().Unix(),
 		"redis_keys":  dbSize,
 		"redis_stats": info,
-	})
+	}
+
+	if g.db != nil {
+		if dedup, err := g.dedupStats(); err != nil {
+			log.Printf("Failed to collect dedup stats: %v", err)
+		} else {
+			metrics["dedup"] = dedup
+		}
+	}
+
+	c.JSON(http.StatusOK, metrics)
+}
+
+// dedupStats compares the bytes files reference (logical) with the bytes
+// actually held in chunk storage (physical).
+func (g *GatewayService) dedupStats() (gin.H, error) {
+	var logicalBytes, physicalBytes, chunkRefs, storedChunks int64
+	err := g.db.QueryRow(`
+        SELECT COALESCE(SUM(chunk_size), 0), COUNT(*) FROM chunks
+    `).Scan(&logicalBytes, &chunkRefs)
+	if err != nil {
+		return nil, err
+	}
+	err = g.db.QueryRow(`
+        SELECT COALESCE(SUM(chunk_size), 0), COUNT(*) FROM chunk_objects WHERE ref_count > 0
+    `).Scan(&physicalBytes, &storedChunks)
+	if err != nil {
+		return nil, err
+	}
+
+	ratio := 1.0
+	if physicalBytes > 0 {
+		ratio = float64(logicalBytes) / float64(physicalBytes)
+	}
+
+	return gin.H{
+		"logical_bytes":  logicalBytes,
+		"physical_bytes": physicalBytes,
+		"bytes_saved":    logicalBytes - physicalBytes,
+		"chunk_refs":     chunkRefs,
+		"stored_chunks":  storedChunks,
+		"dedup_ratio":    ratio,
+	}, nil
 }
 
 func main() {
@@ -492,6 +1043,30 @@ func main() {
 
 	service.setupRoutes()
 
+	// Quota usage follows file events and is rebuilt from the files table
+	// now and then; old file versions and the trash are pruned by the
+	// retention settings. Events recorded in the outbox are published to
+	// Kafka by whichever service's relay holds the lock.
+	if service.db != nil {
+		go service.runQuotaAccounting(context.Background())
+		go service.runQuotaReconciler(context.Background())
+		go service.runVersionPruner(context.Background())
+		go service.runTrashPurger(context.Background())
+		go outbox.NewRelay(service.config, service.db).Run(context.Background())
+	}
+
+	// The S3 API is served on a port of its own, as S3 clients expect the
+	// whole URL space of their endpoint
+	if service.config.S3Enabled {
+		s3Router := service.newS3Router()
+		go func() {
+			log.Printf("✅ S3 API listening on port %s", service.config.S3Port)
+			if err := s3Router.Run(":" + service.config.S3Port); err != nil {
+				log.Fatal("Failed to start S3 server:", err)
+			}
+		}()
+	}
+
 	port := service.config.Port
 	log.Printf("✅ Gateway Service listening on port %s", port)
 	log.Printf("📍 Visit http://localhost:%s for API info", port)
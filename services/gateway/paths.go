@@ -0,0 +1,668 @@
+// services/gateway/paths.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+var (
+	errPathNotFound = errors.New("no such file or directory")
+	errNotDirectory = errors.New("not a directory")
+	errPathExists   = errors.New("file or directory already exists")
+	errInvalidName  = errors.New("invalid name")
+	errDirNotEmpty  = errors.New("directory is not empty")
+	errMoveIntoSelf = errors.New("cannot move a directory into itself")
+)
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// fsEntry is a directory or a file in a user's tree.
+type fsEntry struct {
+	isDir bool
+	id    string
+	name  string
+}
+
+type mkdirRequest struct {
+	Path    string `json:"path" binding:"required"`
+	Parents bool   `json:"parents"`
+}
+
+type moveRequest struct {
+	From string `json:"from" binding:"required"`
+	To   string `json:"to" binding:"required"`
+}
+
+// splitPath cleans a slash separated path into the names along it. The
+// root, "/", has none.
+func splitPath(p string) ([]string, error) {
+	cleaned := path.Clean("/" + p)
+	if cleaned == "/" {
+		return nil, nil
+	}
+	names := strings.Split(cleaned[1:], "/")
+	for _, name := range names {
+		if len(name) > 255 || strings.ContainsRune(name, 0) {
+			return nil, fmt.Errorf("%w %q", errInvalidName, name)
+		}
+	}
+	return names, nil
+}
+
+func joinPath(names []string) string {
+	return "/" + strings.Join(names, "/")
+}
+
+// treeOwner is whose tree a request works on: the caller's, or for an
+// admin any user's with ?user_id=.
+func treeOwner(c *gin.Context) string {
+	principal := currentPrincipal(c)
+	if userID := c.Query("user_id"); userID != "" && principal.Admin {
+		return userID
+	}
+	return principal.Subject
+}
+
+// rootDir returns the user's root directory, creating it on first use.
+func rootDir(ctx context.Context, q queryer, userID string) (fsEntry, error) {
+	root := fsEntry{isDir: true}
+	err := q.QueryRowContext(ctx, `
+        SELECT dir_id FROM directories WHERE user_id = $1 AND parent_id IS NULL
+    `, userID).Scan(&root.id)
+	if err != sql.ErrNoRows {
+		return root, err
+	}
+
+	_, err = q.ExecContext(ctx, `
+        INSERT INTO directories (dir_id, parent_id, name, user_id)
+        VALUES ($1, NULL, '', $2)
+        ON CONFLICT DO NOTHING
+    `, fmt.Sprintf("dir_%d", time.Now().UnixNano()), userID)
+	if err != nil {
+		return root, err
+	}
+	err = q.QueryRowContext(ctx, `
+        SELECT dir_id FROM directories WHERE user_id = $1 AND parent_id IS NULL
+    `, userID).Scan(&root.id)
+	return root, err
+}
+
+// lookupChild finds the directory or file called name in a directory.
+// Failed uploads and files in the trash do not count. A file is found by
+// its first version, whose file_id is the ID all its versions share.
+func lookupChild(ctx context.Context, q queryer, dirID, name string) (fsEntry, error) {
+	entry := fsEntry{isDir: true, name: name}
+	err := q.QueryRowContext(ctx, `
+        SELECT dir_id FROM directories WHERE parent_id = $1 AND name = $2
+    `, dirID, name).Scan(&entry.id)
+	if err != sql.ErrNoRows {
+		return entry, err
+	}
+
+	entry.isDir = false
+	err = q.QueryRowContext(ctx, `
+        SELECT file_id FROM files
+        WHERE dir_id = $1 AND file_name = $2 AND status <> 'failed' AND file_id = logical_id
+          AND deleted_at IS NULL
+    `, dirID, name).Scan(&entry.id)
+	if err == sql.ErrNoRows {
+		return entry, errPathNotFound
+	}
+	return entry, err
+}
+
+// resolvePath walks a user's tree to the entry names points at.
+func resolvePath(ctx context.Context, q queryer, userID string, names []string) (fsEntry, error) {
+	entry, err := rootDir(ctx, q, userID)
+	if err != nil {
+		return entry, err
+	}
+	for _, name := range names {
+		if !entry.isDir {
+			return entry, errNotDirectory
+		}
+		if entry, err = lookupChild(ctx, q, entry.id, name); err != nil {
+			return entry, err
+		}
+	}
+	return entry, nil
+}
+
+// resolveDir is resolvePath for a path that must be a directory.
+func resolveDir(ctx context.Context, q queryer, userID string, names []string) (fsEntry, error) {
+	entry, err := resolvePath(ctx, q, userID, names)
+	if err == nil && !entry.isDir {
+		err = errNotDirectory
+	}
+	return entry, err
+}
+
+// dirPath returns the path of a directory from its user's root.
+func dirPath(ctx context.Context, q queryer, dirID string) (string, error) {
+	var names string
+	err := q.QueryRowContext(ctx, `
+        WITH RECURSIVE up AS (
+            SELECT dir_id, parent_id, name, 0 AS depth FROM directories WHERE dir_id = $1
+            UNION ALL
+            SELECT d.dir_id, d.parent_id, d.name, up.depth + 1 FROM directories d JOIN up ON d.dir_id = up.parent_id
+        )
+        SELECT COALESCE(string_agg(name, '/' ORDER BY depth DESC), '') FROM up WHERE parent_id IS NOT NULL
+    `, dirID).Scan(&names)
+	return "/" + names, err
+}
+
+// lockDir holds a directory's row until the transaction ends, so entries
+// are not created in it, or moved into it, under the same name at once.
+func lockDir(ctx context.Context, tx *sql.Tx, dirID string) error {
+	_, err := tx.ExecContext(ctx, `SELECT 1 FROM directories WHERE dir_id = $1 FOR UPDATE`, dirID)
+	return err
+}
+
+// makeDirs creates the directory names points at. With parents, missing
+// directories along the way are created and an existing directory is not
+// an error, like mkdir -p.
+func (g *GatewayService) makeDirs(ctx context.Context, userID string, names []string, parents bool) (fsEntry, error) {
+	tx, err := g.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fsEntry{}, err
+	}
+	defer tx.Rollback()
+
+	dir, err := rootDir(ctx, tx, userID)
+	if err != nil {
+		return dir, err
+	}
+	for i, name := range names {
+		last := i == len(names)-1
+		if err := lockDir(ctx, tx, dir.id); err != nil {
+			return dir, err
+		}
+
+		child, err := lookupChild(ctx, tx, dir.id, name)
+		switch {
+		case err == nil && !child.isDir:
+			return child, errNotDirectory
+		case err == nil && last && !parents:
+			return child, errPathExists
+		case err == nil:
+			dir = child
+			continue
+		case err != errPathNotFound:
+			return child, err
+		case !last && !parents:
+			return child, errPathNotFound
+		}
+
+		child = fsEntry{isDir: true, id: fmt.Sprintf("dir_%d", time.Now().UnixNano()), name: name}
+		_, err = tx.ExecContext(ctx, `
+            INSERT INTO directories (dir_id, parent_id, name, user_id)
+            VALUES ($1, $2, $3, $4)
+        `, child.id, dir.id, name, userID)
+		if err != nil {
+			return child, err
+		}
+		dir = child
+	}
+	return dir, tx.Commit()
+}
+
+// pathError responds to a failed path operation.
+func pathError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errPathNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, errNotDirectory), errors.Is(err, errPathExists), errors.Is(err, errDirNotEmpty):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case isUniqueViolation(err):
+		c.JSON(http.StatusConflict, gin.H{"error": errPathExists.Error()})
+	case errors.Is(err, errInvalidName), errors.Is(err, errMoveIntoSelf):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		log.Printf("Path operation failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Path operation failed"})
+	}
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// getPath downloads the file at a path, or lists the directory there.
+func (g *GatewayService) getPath(c *gin.Context) {
+	if g.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database not available"})
+		return
+	}
+	names, err := splitPath(c.Param("path"))
+	if err != nil {
+		pathError(c, err)
+		return
+	}
+
+	entry, err := resolvePath(c.Request.Context(), g.db, treeOwner(c), names)
+	if err != nil {
+		pathError(c, err)
+		return
+	}
+	if !entry.isDir {
+		g.proxyDownload(c, g.currentVersion(entry.id))
+		return
+	}
+	g.listDirectory(c, entry, joinPath(names))
+}
+
+func (g *GatewayService) listDirectory(c *gin.Context, dir fsEntry, dirPath string) {
+	ctx := c.Request.Context()
+
+	rows, err := g.db.QueryContext(ctx, `
+        SELECT dir_id, name, created_at, updated_at
+        FROM directories WHERE parent_id = $1
+        ORDER BY name
+    `, dir.id)
+	if err != nil {
+		pathError(c, err)
+		return
+	}
+	defer rows.Close()
+
+	dirs := []gin.H{}
+	for rows.Next() {
+		var dirID, name string
+		var createdAt, updatedAt time.Time
+		if err := rows.Scan(&dirID, &name, &createdAt, &updatedAt); err != nil {
+			continue
+		}
+		dirs = append(dirs, gin.H{
+			"dir_id":     dirID,
+			"name":       name,
+			"path":       path.Join(dirPath, name),
+			"created_at": createdAt,
+			"updated_at": updatedAt,
+		})
+	}
+
+	fileRows, err := g.db.QueryContext(ctx, `
+        SELECT logical_id, version, file_name, file_size, status, created_at, updated_at
+        FROM files WHERE dir_id = $1 AND status <> 'failed' AND deleted_at IS NULL AND `+isHeadVersion+`
+        ORDER BY file_name
+    `, dir.id)
+	if err != nil {
+		pathError(c, err)
+		return
+	}
+	defer fileRows.Close()
+
+	files := []gin.H{}
+	for fileRows.Next() {
+		var fileID, name, status string
+		var version int
+		var size int64
+		var createdAt, updatedAt time.Time
+		if err := fileRows.Scan(&fileID, &version, &name, &size, &status, &createdAt, &updatedAt); err != nil {
+			continue
+		}
+		files = append(files, gin.H{
+			"file_id":    fileID,
+			"version":    version,
+			"name":       name,
+			"path":       path.Join(dirPath, name),
+			"size":       size,
+			"status":     status,
+			"created_at": createdAt,
+			"updated_at": updatedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"path":        dirPath,
+		"dir_id":      dir.id,
+		"directories": dirs,
+		"files":       files,
+		"count":       len(dirs) + len(files),
+	})
+}
+
+// uploadPath uploads a file to a path. The body is the same multipart
+// form as POST /api/v1/files; ?parents=true creates missing directories.
+// Uploading to an existing file adds a new version of it.
+func (g *GatewayService) uploadPath(c *gin.Context) {
+	if g.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database not available"})
+		return
+	}
+	names, err := splitPath(c.Param("path"))
+	if err != nil {
+		pathError(c, err)
+		return
+	}
+	if len(names) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Path must name a file"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	owner := treeOwner(c)
+	parentNames, name := names[:len(names)-1], names[len(names)-1]
+
+	var parent fsEntry
+	if parents, _ := strconv.ParseBool(c.Query("parents")); parents {
+		parent, err = g.makeDirs(ctx, owner, parentNames, true)
+	} else {
+		parent, err = resolveDir(ctx, g.db, owner, parentNames)
+	}
+	if err != nil {
+		pathError(c, err)
+		return
+	}
+
+	existing, err := lookupChild(ctx, g.db, parent.id, name)
+	switch {
+	case err == nil && existing.isDir:
+		pathError(c, errPathExists)
+	case err == nil:
+		g.streamUpload(c, uploadTarget{logicalID: existing.id})
+	case err == errPathNotFound:
+		g.streamUpload(c, uploadTarget{dirID: parent.id, name: name, userID: owner})
+	default:
+		pathError(c, err)
+	}
+}
+
+// mkdir creates a directory.
+func (g *GatewayService) mkdir(c *gin.Context) {
+	var req mkdirRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "path is required"})
+		return
+	}
+	if g.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database not available"})
+		return
+	}
+	names, err := splitPath(req.Path)
+	if err != nil {
+		pathError(c, err)
+		return
+	}
+	if len(names) == 0 && !req.Parents {
+		pathError(c, errPathExists)
+		return
+	}
+
+	dir, err := g.makeDirs(c.Request.Context(), treeOwner(c), names, req.Parents)
+	if err != nil {
+		pathError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"dir_id": dir.id,
+		"path":   joinPath(names),
+	})
+}
+
+// movePath moves or renames a file or directory. Moving onto an existing
+// directory moves the entry into it, keeping its name.
+func (g *GatewayService) movePath(c *gin.Context) {
+	var req moveRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from and to are required"})
+		return
+	}
+	if g.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database not available"})
+		return
+	}
+	from, err := splitPath(req.From)
+	if err == nil {
+		var to []string
+		if to, err = splitPath(req.To); err == nil {
+			err = g.move(c, from, to)
+		}
+	}
+	if err != nil {
+		pathError(c, err)
+	}
+}
+
+func (g *GatewayService) move(c *gin.Context, from, to []string) error {
+	if len(from) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot move the root directory"})
+		return nil
+	}
+
+	ctx := c.Request.Context()
+	owner := treeOwner(c)
+	tx, err := g.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	entry, err := resolvePath(ctx, tx, owner, from)
+	if err != nil {
+		return err
+	}
+
+	dest, err := resolvePath(ctx, tx, owner, to)
+	switch {
+	case err == nil && dest.isDir:
+		to = append(to[:len(to):len(to)], entry.name)
+	case err == nil && dest.id == entry.id:
+		// renamed onto itself
+	case err == nil:
+		return errPathExists
+	case err != errPathNotFound:
+		return err
+	}
+	if err := renameEntry(ctx, tx, owner, entry, to); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("📁 Moved %s to %s for %s", joinPath(from), joinPath(to), owner)
+	c.JSON(http.StatusOK, gin.H{
+		"id":   entry.id,
+		"from": joinPath(from),
+		"to":   joinPath(to),
+	})
+	return nil
+}
+
+// renameEntry moves a file or directory to the path to, whose parent
+// directory must exist and which must not be taken by another entry.
+func renameEntry(ctx context.Context, tx *sql.Tx, owner string, entry fsEntry, to []string) error {
+	dest, err := resolveDir(ctx, tx, owner, to[:len(to)-1])
+	if err != nil {
+		return err
+	}
+	name := to[len(to)-1]
+
+	if err := lockDir(ctx, tx, dest.id); err != nil {
+		return err
+	}
+	if existing, err := lookupChild(ctx, tx, dest.id, name); err == nil && existing.id != entry.id {
+		return errPathExists
+	} else if err != nil && err != errPathNotFound {
+		return err
+	}
+
+	if entry.isDir {
+		// A directory cannot go into itself or one of its descendants
+		var cycle bool
+		err := tx.QueryRowContext(ctx, `
+            WITH RECURSIVE up AS (
+                SELECT dir_id, parent_id FROM directories WHERE dir_id = $1
+                UNION ALL
+                SELECT d.dir_id, d.parent_id FROM directories d JOIN up ON d.dir_id = up.parent_id
+            )
+            SELECT EXISTS (SELECT 1 FROM up WHERE dir_id = $2)
+        `, dest.id, entry.id).Scan(&cycle)
+		if err != nil {
+			return err
+		}
+		if cycle {
+			return errMoveIntoSelf
+		}
+		_, err = tx.ExecContext(ctx, `
+            UPDATE directories SET parent_id = $1, name = $2, updated_at = NOW() WHERE dir_id = $3
+        `, dest.id, name, entry.id)
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err := tx.ExecContext(ctx, `
+            UPDATE files SET dir_id = $1, file_name = $2, updated_at = NOW() WHERE logical_id = $3
+        `, dest.id, name, entry.id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deletePath deletes a file, or a directory. A directory that is not empty
+// needs ?recursive=true. Files go to the trash like DELETE
+// /api/v1/files/:id, remembering the path they were at; directories are
+// removed.
+func (g *GatewayService) deletePath(c *gin.Context) {
+	if g.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database not available"})
+		return
+	}
+	names, err := splitPath(c.Param("path"))
+	if err != nil {
+		pathError(c, err)
+		return
+	}
+	if len(names) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot delete the root directory"})
+		return
+	}
+	recursive, _ := strconv.ParseBool(c.Query("recursive"))
+
+	files, dirs, err := g.removePath(c.Request.Context(), treeOwner(c), names, recursive)
+	if err != nil {
+		pathError(c, err)
+		return
+	}
+
+	log.Printf("🗑️ Deleted %s for %s: %d files moved to the trash", joinPath(names), treeOwner(c), files)
+	c.JSON(http.StatusOK, gin.H{
+		"path":                joinPath(names),
+		"files_trashed":       files,
+		"directories_deleted": dirs,
+		"message":             "Deleted successfully",
+	})
+}
+
+// removePath moves the file at names, or every file under the directory
+// there, to the trash and removes the directories. It returns how many of
+// each it deleted.
+func (g *GatewayService) removePath(ctx context.Context, owner string, names []string, recursive bool) (int, int, error) {
+	tx, err := g.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	entry, err := resolvePath(ctx, tx, owner, names)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// The directory and every directory below it, with their paths
+	dirIDs := []string{}
+	dirPaths := map[string]string{}
+	if entry.isDir {
+		rows, err := tx.QueryContext(ctx, `
+            WITH RECURSIVE tree AS (
+                SELECT dir_id, $2::text AS path FROM directories WHERE dir_id = $1
+                UNION ALL
+                SELECT d.dir_id, t.path || '/' || d.name FROM directories d JOIN tree t ON d.parent_id = t.dir_id
+            )
+            SELECT dir_id, path FROM tree
+        `, entry.id, joinPath(names))
+		if err != nil {
+			return 0, 0, err
+		}
+		for rows.Next() {
+			var id, p string
+			if err := rows.Scan(&id, &p); err == nil {
+				dirIDs = append(dirIDs, id)
+				dirPaths[id] = p
+			}
+		}
+		rows.Close()
+	} else {
+		dirPaths[""] = joinPath(names[:len(names)-1])
+	}
+
+	// Lock the files before moving them, collecting them first since the
+	// transaction can only run one query at a time
+	type fileRow struct {
+		logicalID, dirID string
+	}
+	var files []fileRow
+	seen := map[string]bool{}
+	rows, err := tx.QueryContext(ctx, `
+        SELECT logical_id, COALESCE(dir_id, '')
+        FROM files WHERE (logical_id = $1 OR dir_id = ANY($2)) AND deleted_at IS NULL
+        FOR UPDATE
+    `, entry.id, pq.Array(dirIDs))
+	if err != nil {
+		return 0, 0, err
+	}
+	for rows.Next() {
+		var f fileRow
+		if err := rows.Scan(&f.logicalID, &f.dirID); err == nil && !seen[f.logicalID] {
+			seen[f.logicalID] = true
+			files = append(files, f)
+		}
+	}
+	rows.Close()
+
+	if entry.isDir && !recursive && (len(dirIDs) > 1 || len(files) > 0) {
+		return 0, 0, errDirNotEmpty
+	}
+
+	deletedAt := time.Now()
+	for _, f := range files {
+		trashedFrom, ok := dirPaths[f.dirID]
+		if !ok {
+			trashedFrom = dirPaths[""]
+		}
+		if err := trashFile(ctx, tx, f.logicalID, trashedFrom, deletedAt); err != nil {
+			return 0, 0, fmt.Errorf("delete %s: %w", f.logicalID, err)
+		}
+	}
+	if len(dirIDs) > 0 {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM directories WHERE dir_id = ANY($1)`, pq.Array(dirIDs)); err != nil {
+			return 0, 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return len(files), len(dirIDs), nil
+}
@@ -0,0 +1,471 @@
+// services/gateway/quota.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/segmentio/kafka-go"
+
+	"atlasfs/services/common/events"
+	"atlasfs/services/common/models"
+)
+
+const (
+	quotaScopeUser   = "user"
+	quotaScopeTenant = "tenant"
+)
+
+// quotaLockID is the Postgres advisory lock taken by every transaction that
+// changes quota_usage, so event updates and reconciliation on different
+// gateway replicas do not interleave.
+const quotaLockID = 0x71756f7461 // "quota"
+
+// QuotaStatus is a user's or tenant's usage against its quota. A zero
+// maximum means unlimited.
+type QuotaStatus struct {
+	Scope     string `json:"scope"`
+	Subject   string `json:"subject"`
+	BytesUsed int64  `json:"bytes_used"`
+	FileCount int64  `json:"file_count"`
+	MaxBytes  int64  `json:"max_bytes"`
+	MaxFiles  int64  `json:"max_files"`
+}
+
+type setQuotaRequest struct {
+	MaxBytes *int64 `json:"max_bytes" binding:"required"`
+	MaxFiles *int64 `json:"max_files" binding:"required"`
+}
+
+func (g *GatewayService) defaultQuota(scope string) (maxBytes, maxFiles int64) {
+	if scope == quotaScopeTenant {
+		return g.config.QuotaTenantBytes, g.config.QuotaTenantFiles
+	}
+	return g.config.QuotaUserBytes, g.config.QuotaUserFiles
+}
+
+func (g *GatewayService) quotaStatus(ctx context.Context, scope, subject string) (QuotaStatus, error) {
+	status := QuotaStatus{Scope: scope, Subject: subject}
+	defaultBytes, defaultFiles := g.defaultQuota(scope)
+	err := g.db.QueryRowContext(ctx, `
+        SELECT COALESCE((SELECT bytes_used FROM quota_usage WHERE scope = $1 AND subject = $2), 0),
+               COALESCE((SELECT file_count FROM quota_usage WHERE scope = $1 AND subject = $2), 0),
+               COALESCE((SELECT max_bytes FROM quotas WHERE scope = $1 AND subject = $2), $3),
+               COALESCE((SELECT max_files FROM quotas WHERE scope = $1 AND subject = $2), $4)
+    `, scope, subject, defaultBytes, defaultFiles).
+		Scan(&status.BytesUsed, &status.FileCount, &status.MaxBytes, &status.MaxFiles)
+	return status, err
+}
+
+// uploadQuotas returns the quotas an upload to target counts against:
+// those of the user and tenant the file will be charged to. A new version
+// is charged to its file's owner, anything else to the tree's owner and
+// the caller's tenant.
+func (g *GatewayService) uploadQuotas(c *gin.Context, target uploadTarget) ([][2]string, error) {
+	principal := currentPrincipal(c)
+	userID, tenantID := principal.Subject, principal.Tenant
+	if target.userID != "" {
+		userID = target.userID
+	}
+	if target.logicalID != "" {
+		err := g.db.QueryRowContext(c.Request.Context(), `
+            SELECT COALESCE(user_id, ''), COALESCE(tenant_id, '') FROM files WHERE file_id = $1
+        `, target.logicalID).Scan(&userID, &tenantID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	quotas := [][2]string{{quotaScopeUser, userID}}
+	if tenantID != "" {
+		quotas = append(quotas, [2]string{quotaScopeTenant, tenantID})
+	}
+	return quotas, nil
+}
+
+// checkQuota rejects an upload of size bytes (-1 when unknown) to target
+// that would take its owner or tenant over quota: 413 when the file alone
+// is larger than the quota, 507 when there is not enough room left.
+// Errors reading usage let the upload through; reconciliation catches up
+// later.
+func (g *GatewayService) checkQuota(c *gin.Context, target uploadTarget, size int64) bool {
+	if status, response := g.quotaExceeded(c, target, size); status != 0 {
+		c.JSON(status, response)
+		return false
+	}
+	return true
+}
+
+// quotaExceeded returns the status and body checkQuota rejects an upload
+// with, or 0 if it fits.
+func (g *GatewayService) quotaExceeded(c *gin.Context, target uploadTarget, size int64) (int, gin.H) {
+	if g.db == nil {
+		return 0, nil
+	}
+	quotas, err := g.uploadQuotas(c, target)
+	if err != nil {
+		log.Printf("Failed to find the quotas for an upload to %+v: %v", target, err)
+		return 0, nil
+	}
+
+	for _, q := range quotas {
+		status, err := g.quotaStatus(c.Request.Context(), q[0], q[1])
+		if err != nil {
+			log.Printf("Failed to read %s quota for %s: %v", q[0], q[1], err)
+			continue
+		}
+
+		switch {
+		case status.MaxFiles > 0 && status.FileCount >= status.MaxFiles:
+			return http.StatusInsufficientStorage, gin.H{"error": "File count quota reached", "quota": status}
+		case status.MaxBytes > 0 && size > status.MaxBytes:
+			return http.StatusRequestEntityTooLarge, gin.H{"error": "File is larger than the storage quota", "quota": status}
+		case status.MaxBytes > 0 && (status.BytesUsed+max(size, 0) > status.MaxBytes ||
+			size < 0 && status.BytesUsed >= status.MaxBytes):
+			return http.StatusInsufficientStorage, gin.H{"error": "Storage quota exceeded", "quota": status}
+		}
+	}
+	return 0, nil
+}
+
+// quotaRoom returns how many bytes an upload to target may store before
+// its owner or tenant goes over quota, or -1 if there is no limit.
+func (g *GatewayService) quotaRoom(c *gin.Context, target uploadTarget) int64 {
+	if g.db == nil {
+		return -1
+	}
+	quotas, err := g.uploadQuotas(c, target)
+	if err != nil {
+		log.Printf("Failed to find the quotas for an upload to %+v: %v", target, err)
+		return -1
+	}
+
+	room := int64(-1)
+	for _, q := range quotas {
+		status, err := g.quotaStatus(c.Request.Context(), q[0], q[1])
+		if err != nil || status.MaxBytes <= 0 {
+			continue
+		}
+		left := max(status.MaxBytes-status.BytesUsed, 0)
+		if room < 0 || left < room {
+			room = left
+		}
+	}
+	return room
+}
+
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// quotaReader cuts an upload off with errQuotaExceeded once more than room
+// bytes have been read from it, whatever size the client declared.
+type quotaReader struct {
+	r        io.Reader
+	room     int64
+	exceeded atomic.Bool
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	q.room -= int64(n)
+	if q.room < 0 {
+		q.exceeded.Store(true)
+		return 0, errQuotaExceeded
+	}
+	return n, err
+}
+
+// getUsage reports the caller's usage against its quotas. Admins may ask
+// about anyone with ?user_id= and ?tenant_id=.
+func (g *GatewayService) getUsage(c *gin.Context) {
+	if g.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database not available"})
+		return
+	}
+
+	principal := currentPrincipal(c)
+	userID, tenantID := principal.Subject, principal.Tenant
+	if principal.Admin && (c.Query("user_id") != "" || c.Query("tenant_id") != "") {
+		userID, tenantID = c.Query("user_id"), c.Query("tenant_id")
+	}
+
+	response := gin.H{}
+	if userID != "" {
+		status, err := g.quotaStatus(c.Request.Context(), quotaScopeUser, userID)
+		if err != nil {
+			log.Printf("Failed to read user quota for %s: %v", userID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read usage"})
+			return
+		}
+		response["user"] = status
+	}
+	if tenantID != "" {
+		status, err := g.quotaStatus(c.Request.Context(), quotaScopeTenant, tenantID)
+		if err != nil {
+			log.Printf("Failed to read tenant quota for %s: %v", tenantID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read usage"})
+			return
+		}
+		response["tenant"] = status
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// setQuota sets the quota of a user or tenant, replacing the default.
+func (g *GatewayService) setQuota(c *gin.Context) {
+	scope, subject := c.Param("scope"), c.Param("subject")
+	if scope != quotaScopeUser && scope != quotaScopeTenant {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "scope must be user or tenant"})
+		return
+	}
+	var req setQuotaRequest
+	if err := c.ShouldBindJSON(&req); err != nil || *req.MaxBytes < 0 || *req.MaxFiles < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max_bytes and max_files are required and must not be negative"})
+		return
+	}
+	if g.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database not available"})
+		return
+	}
+
+	_, err := g.db.Exec(`
+        INSERT INTO quotas (scope, subject, max_bytes, max_files, updated_at)
+        VALUES ($1, $2, $3, $4, NOW())
+        ON CONFLICT (scope, subject) DO UPDATE
+        SET max_bytes = EXCLUDED.max_bytes, max_files = EXCLUDED.max_files, updated_at = NOW()
+    `, scope, subject, *req.MaxBytes, *req.MaxFiles)
+	if err != nil {
+		log.Printf("Failed to set %s quota for %s: %v", scope, subject, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set quota"})
+		return
+	}
+
+	status, err := g.quotaStatus(c.Request.Context(), scope, subject)
+	if err != nil {
+		log.Printf("Failed to read %s quota for %s: %v", scope, subject, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read quota"})
+		return
+	}
+	log.Printf("📏 Quota for %s %s set to %d bytes, %d files", scope, subject, *req.MaxBytes, *req.MaxFiles)
+	c.JSON(http.StatusOK, status)
+}
+
+// deleteQuota puts a user or tenant back on the default quota.
+func (g *GatewayService) deleteQuota(c *gin.Context) {
+	if g.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database not available"})
+		return
+	}
+
+	result, err := g.db.Exec(`DELETE FROM quotas WHERE scope = $1 AND subject = $2`,
+		c.Param("scope"), c.Param("subject"))
+	if err != nil {
+		log.Printf("Failed to reset %s quota for %s: %v", c.Param("scope"), c.Param("subject"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset quota"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No quota set"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Quota reset to default"})
+}
+
+// runQuotaAccounting applies file.upload.completed and file.deleted events
+// to quota usage. Every gateway replica joins the same consumer group.
+func (g *GatewayService) runQuotaAccounting(ctx context.Context) {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:  g.config.KafkaBrokers,
+		GroupID:  "atlasfs-quota",
+		Topic:    "file.events",
+		MinBytes: 1,
+		MaxBytes: 10e6,
+	})
+	defer reader.Close()
+
+	log.Printf("✅ Quota accounting consuming file.events")
+
+	for {
+		msg, err := reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Quota accounting failed to fetch event: %v", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		event, err := events.Decode(msg.Value)
+		if err != nil {
+			log.Printf("Quota accounting skipped event at offset %d it cannot decode: %v", msg.Offset, err)
+		} else {
+			var fileID string
+			switch data := event.Payload().(type) {
+			case events.UploadCompletedData:
+				fileID = data.FileID
+				err = g.chargeFile(ctx, fileID)
+			case events.FileDeletedData:
+				fileID = data.FileID
+				err = g.releaseFile(ctx, fileID)
+			}
+			if err != nil {
+				log.Printf("Failed to apply %s for %s to quota usage: %v", event.Type, fileID, err)
+			}
+		}
+
+		if err := reader.CommitMessages(ctx, msg); err != nil {
+			log.Printf("Quota accounting failed to commit offset: %v", err)
+		}
+	}
+}
+
+// chargeFile adds a completed file to its owner's usage, once.
+func (g *GatewayService) chargeFile(ctx context.Context, fileID string) error {
+	return g.updateUsage(ctx, func(tx *sql.Tx) *sql.Row {
+		return tx.QueryRowContext(ctx, `
+            INSERT INTO quota_charges (file_id, user_id, tenant_id, bytes)
+            SELECT file_id, COALESCE(user_id, ''), tenant_id, file_size
+            FROM files WHERE file_id = $1 AND status IN ($2, $3)
+            ON CONFLICT (file_id) DO NOTHING
+            RETURNING user_id, COALESCE(tenant_id, ''), bytes, 1
+        `, fileID, models.StatusCompleted, models.StatusDegraded)
+	})
+}
+
+// releaseFile takes a deleted file off its owner's usage, once.
+func (g *GatewayService) releaseFile(ctx context.Context, fileID string) error {
+	return g.updateUsage(ctx, func(tx *sql.Tx) *sql.Row {
+		return tx.QueryRowContext(ctx, `
+            DELETE FROM quota_charges WHERE file_id = $1
+            RETURNING user_id, COALESCE(tenant_id, ''), -bytes, -1
+        `, fileID)
+	})
+}
+
+// updateUsage applies the change to quota_charges made by change, which
+// returns the owner, tenant and byte and file deltas, to quota_usage.
+func (g *GatewayService) updateUsage(ctx context.Context, change func(*sql.Tx) *sql.Row) error {
+	tx, err := g.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, quotaLockID); err != nil {
+		return err
+	}
+
+	var userID, tenantID string
+	var bytes, files int64
+	err = change(tx).Scan(&userID, &tenantID, &bytes, &files)
+	if err == sql.ErrNoRows {
+		return nil // not completed, or already applied
+	}
+	if err != nil {
+		return err
+	}
+
+	usage := [][2]string{{quotaScopeUser, userID}}
+	if tenantID != "" {
+		usage = append(usage, [2]string{quotaScopeTenant, tenantID})
+	}
+	for _, u := range usage {
+		_, err := tx.ExecContext(ctx, `
+            INSERT INTO quota_usage (scope, subject, bytes_used, file_count, updated_at)
+            VALUES ($1, $2, $3, $4, NOW())
+            ON CONFLICT (scope, subject) DO UPDATE
+            SET bytes_used = quota_usage.bytes_used + EXCLUDED.bytes_used,
+                file_count = quota_usage.file_count + EXCLUDED.file_count,
+                updated_at = NOW()
+        `, u[0], u[1], bytes, files)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// runQuotaReconciler periodically rebuilds quota usage from the files
+// table, correcting for events that were lost or never published.
+func (g *GatewayService) runQuotaReconciler(ctx context.Context) {
+	ticker := time.NewTicker(g.config.QuotaReconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := g.reconcileQuotas(ctx); err != nil {
+			log.Printf("Quota reconciliation failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (g *GatewayService) reconcileQuotas(ctx context.Context) error {
+	tx, err := g.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, quotaLockID); err != nil {
+		return err
+	}
+
+	removed, err := tx.ExecContext(ctx, `
+        DELETE FROM quota_charges qc
+        WHERE NOT EXISTS (
+            SELECT 1 FROM files f
+            WHERE f.file_id = qc.file_id AND f.status IN ($1, $2)
+        )
+    `, models.StatusCompleted, models.StatusDegraded)
+	if err != nil {
+		return err
+	}
+	added, err := tx.ExecContext(ctx, `
+        INSERT INTO quota_charges (file_id, user_id, tenant_id, bytes)
+        SELECT file_id, COALESCE(user_id, ''), tenant_id, file_size
+        FROM files WHERE status IN ($1, $2)
+        ON CONFLICT (file_id) DO UPDATE
+        SET user_id = EXCLUDED.user_id, tenant_id = EXCLUDED.tenant_id, bytes = EXCLUDED.bytes
+        WHERE (quota_charges.user_id, quota_charges.tenant_id, quota_charges.bytes)
+              IS DISTINCT FROM (EXCLUDED.user_id, EXCLUDED.tenant_id, EXCLUDED.bytes)
+    `, models.StatusCompleted, models.StatusDegraded)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM quota_usage`); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO quota_usage (scope, subject, bytes_used, file_count, updated_at)
+        SELECT 'user', user_id, SUM(bytes), COUNT(*), NOW()
+        FROM quota_charges GROUP BY user_id
+        UNION ALL
+        SELECT 'tenant', tenant_id, SUM(bytes), COUNT(*), NOW()
+        FROM quota_charges WHERE tenant_id IS NOT NULL GROUP BY tenant_id
+    `)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	r, _ := removed.RowsAffected()
+	a, _ := added.RowsAffected()
+	if r > 0 || a > 0 {
+		log.Printf("🔁 Reconciled quota usage: %d charges added or corrected, %d removed", a, r)
+	}
+	return nil
+}
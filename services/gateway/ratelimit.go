@@ -0,0 +1,325 @@
+// services/gateway/ratelimit.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+
+	"atlasfs/services/common/config"
+)
+
+// Limits, by the name used in RATE_LIMIT_OVERRIDES and the Redis keys.
+const (
+	limitIP            = "ip"
+	limitRead          = "read"
+	limitWrite         = "write"
+	limitAdmin         = "admin"
+	limitUploadBytes   = "upload_bytes"
+	limitDownloadBytes = "download_bytes"
+)
+
+// tokenBucket refills a bucket of ARGV[1] tokens evenly over ARGV[2] ms and
+// takes ARGV[4] tokens from it at time ARGV[3]. A debit (ARGV[5] = 1) always
+// succeeds and may leave the bucket negative; it charges for bytes that were
+// only counted once the transfer was over. Returns allowed, the tokens left,
+// the ms until the cost would fit and the ms until the bucket is full.
+var tokenBucket = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+local debit = ARGV[5] == '1'
+local rate = capacity / window
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or capacity
+local ts = tonumber(state[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * rate)
+
+local allowed = 0
+if debit or tokens >= cost then
+    tokens = tokens - cost
+    allowed = 1
+end
+
+local full = math.ceil((capacity - tokens) / rate)
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], full + 1000)
+
+local retry = 0
+if allowed == 0 then
+    retry = math.ceil((cost - tokens) / rate)
+end
+return {allowed, math.floor(tokens), retry, full}
+`)
+
+type rateLimit struct {
+	capacity int64 // 0 means unlimited
+	window   time.Duration
+}
+
+type bucketState struct {
+	allowed    bool
+	remaining  int64
+	retryAfter time.Duration
+	reset      time.Duration
+}
+
+// rateLimiter keeps one token bucket per limit and principal in Redis, so
+// all gateway replicas share them.
+type rateLimiter struct {
+	redis     *redis.Client
+	limits    map[string]rateLimit
+	overrides map[string]map[string]int64 // principal -> limit -> capacity
+}
+
+// newRateLimiter returns nil when rate limiting is disabled.
+func newRateLimiter(cfg *config.Config, client *redis.Client) (*rateLimiter, error) {
+	if !cfg.RateLimitEnabled {
+		return nil, nil
+	}
+	overrides, err := parseRateLimitOverrides(cfg.RateLimitOverrides)
+	if err != nil {
+		return nil, err
+	}
+	return &rateLimiter{
+		redis: client,
+		limits: map[string]rateLimit{
+			limitIP:            {int64(cfg.RateLimitIP), cfg.RateLimitWindow},
+			limitRead:          {int64(cfg.RateLimitRead), cfg.RateLimitWindow},
+			limitWrite:         {int64(cfg.RateLimitWrite), cfg.RateLimitWindow},
+			limitAdmin:         {int64(cfg.RateLimitAdmin), cfg.RateLimitWindow},
+			limitUploadBytes:   {cfg.RateLimitUploadBytes, cfg.RateLimitBytesWindow},
+			limitDownloadBytes: {cfg.RateLimitDownloadBytes, cfg.RateLimitBytesWindow},
+		},
+		overrides: overrides,
+	}, nil
+}
+
+// parseRateLimitOverrides reads "<principal>.<limit>=<n>,...". The limit
+// name is taken after the last dot, so principals may be IP addresses.
+func parseRateLimitOverrides(spec string) (map[string]map[string]int64, error) {
+	overrides := make(map[string]map[string]int64)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		target, value, ok := strings.Cut(entry, "=")
+		dot := strings.LastIndex(target, ".")
+		if !ok || dot <= 0 {
+			return nil, fmt.Errorf("rate limit override %q: want <principal>.<limit>=<n>", entry)
+		}
+		principal, limit := target[:dot], target[dot+1:]
+		switch limit {
+		case limitIP, limitRead, limitWrite, limitAdmin, limitUploadBytes, limitDownloadBytes:
+		default:
+			return nil, fmt.Errorf("rate limit override %q: unknown limit %q", entry, limit)
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("rate limit override %q: invalid value", entry)
+		}
+		if overrides[principal] == nil {
+			overrides[principal] = make(map[string]int64)
+		}
+		overrides[principal][limit] = n
+	}
+	return overrides, nil
+}
+
+func (l *rateLimiter) limitFor(name, principal string) rateLimit {
+	limit := l.limits[name]
+	if n, ok := l.overrides[principal][name]; ok {
+		limit.capacity = n
+	}
+	return limit
+}
+
+// take removes cost tokens from the principal's bucket for the limit.
+// Unlimited buckets always allow.
+func (l *rateLimiter) take(ctx context.Context, name, principal string, cost int64, debit bool) (rateLimit, bucketState, error) {
+	limit := l.limitFor(name, principal)
+	if limit.capacity <= 0 || limit.window <= 0 {
+		return limit, bucketState{allowed: true}, nil
+	}
+
+	flag := "0"
+	if debit {
+		flag = "1"
+	}
+	key := fmt.Sprintf("ratelimit:%s:%s", name, principal)
+	res, err := tokenBucket.Run(ctx, l.redis, []string{key},
+		limit.capacity, limit.window.Milliseconds(), time.Now().UnixMilli(), cost, flag).Int64Slice()
+	if err != nil {
+		return limit, bucketState{allowed: true}, err
+	}
+	return limit, bucketState{
+		allowed:    res[0] == 1,
+		remaining:  max(res[1], 0),
+		retryAfter: time.Duration(res[2]) * time.Millisecond,
+		reset:      time.Duration(res[3]) * time.Millisecond,
+	}, nil
+}
+
+// rateLimitKey identifies the caller: its subject, or its IP when the
+// request is anonymous.
+func rateLimitKey(c *gin.Context) string {
+	principal := currentPrincipal(c)
+	if principal.Method == "anonymous" {
+		return "ip:" + c.ClientIP()
+	}
+	return principal.Subject
+}
+
+// rateLimit counts each request against the caller's bucket for the route
+// group. If Redis is unavailable requests are let through.
+func (g *GatewayService) rateLimit(name string) gin.HandlerFunc {
+	return g.rateLimitBy(name, rateLimitKey)
+}
+
+// rateLimitIP counts each request against its client IP's bucket. It runs
+// before authentication, so that a flood of bad credentials is turned away
+// before each one costs a key lookup.
+func (g *GatewayService) rateLimitIP() gin.HandlerFunc {
+	return g.rateLimitBy(limitIP, func(c *gin.Context) string {
+		return "ip:" + c.ClientIP()
+	})
+}
+
+func (g *GatewayService) rateLimitBy(name string, keyOf func(*gin.Context) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if g.limiter == nil {
+			c.Next()
+			return
+		}
+
+		key := keyOf(c)
+		limit, state, err := g.limiter.take(c.Request.Context(), name, key, 1, false)
+		if err != nil {
+			log.Printf("⚠️ Rate limiter unavailable, allowing request: %v", err)
+			c.Next()
+			return
+		}
+		setRateLimitHeaders(c, limit, state)
+		if !state.allowed {
+			tooManyRequests(c, name, key, state)
+			return
+		}
+		c.Next()
+	}
+}
+
+// limitTransfer charges the bytes of an upload or download against the
+// caller's byte bucket. The declared upload size (or a single byte for
+// downloads and uploads of unknown size) must fit before the transfer
+// starts; whatever was actually moved beyond that is charged afterwards.
+// An upload declared larger than the whole bucket could never fit, and is
+// refused with 413.
+func (g *GatewayService) limitTransfer(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if g.limiter == nil {
+			c.Next()
+			return
+		}
+
+		key := rateLimitKey(c)
+		limit := g.limiter.limitFor(name, key)
+		if limit.capacity <= 0 {
+			c.Next()
+			return
+		}
+
+		upfront := int64(1)
+		if size := declaredUploadSize(c.Request); name == limitUploadBytes && size > 0 {
+			if size > limit.capacity {
+				log.Printf("🚦 Refused a %d byte upload from %s over its %d byte limit", size, key, limit.capacity)
+				c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{
+					"error": "Upload is larger than the upload byte limit",
+					"limit": name,
+					"max":   limit.capacity,
+				})
+				return
+			}
+			upfront = size
+		}
+		_, state, err := g.limiter.take(c.Request.Context(), name, key, upfront, false)
+		if err != nil {
+			log.Printf("⚠️ Rate limiter unavailable, allowing transfer: %v", err)
+			c.Next()
+			return
+		}
+		if !state.allowed {
+			setRateLimitHeaders(c, limit, state)
+			tooManyRequests(c, name, key, state)
+			return
+		}
+
+		var body *countingReader
+		if name == limitUploadBytes {
+			body = &countingReader{ReadCloser: c.Request.Body}
+			c.Request.Body = body
+		}
+
+		c.Next()
+
+		transferred := int64(c.Writer.Size())
+		if body != nil {
+			transferred = body.n
+		}
+		if rest := transferred - upfront; rest > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			if _, _, err := g.limiter.take(ctx, name, key, rest, true); err != nil {
+				log.Printf("⚠️ Failed to charge %d bytes to %s: %v", rest, key, err)
+			}
+		}
+	}
+}
+
+// setRateLimitHeaders sets the RateLimit-* headers from the IETF draft.
+func setRateLimitHeaders(c *gin.Context, limit rateLimit, state bucketState) {
+	if limit.capacity <= 0 {
+		return
+	}
+	c.Header("RateLimit-Limit", strconv.FormatInt(limit.capacity, 10))
+	c.Header("RateLimit-Remaining", strconv.FormatInt(state.remaining, 10))
+	c.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(state.reset)))
+	c.Header("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.capacity, ceilSeconds(limit.window)))
+}
+
+func tooManyRequests(c *gin.Context, name, key string, state bucketState) {
+	retryAfter := max(ceilSeconds(state.retryAfter), 1)
+	log.Printf("🚦 Rate limited %s on %s %s (%s limit)", key, c.Request.Method, c.Request.URL.Path, name)
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+		"error":       "Rate limit exceeded",
+		"limit":       name,
+		"retry_after": retryAfter,
+	})
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,1214 @@
+// services/gateway/s3.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"atlasfs/services/common/models"
+	"atlasfs/services/common/storage"
+)
+
+// The S3 API serves each user's top-level directories as buckets and the
+// paths below them as object keys, addressed path-style as /bucket/key.
+// Object data goes through the upload service like any other upload, so
+// putting an existing key adds a version of its file, and deleting one
+// moves it to the trash.
+
+const (
+	s3TimeLayout     = "2006-01-02T15:04:05.000Z"
+	maxS3KeyLength   = 1024
+	maxS3ListKeys    = 1000
+	maxS3XMLBody     = 2 << 20
+	emptyMD5         = "d41d8cd98f00b204e9800998ecf8427e"
+	s3StorageClass   = "STANDARD"
+	s3DefaultRegion  = "us-east-1"
+	s3RequestIDField = "X-Amz-Request-Id"
+)
+
+var s3BucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// Bucket subresources that are not supported. Answering them with a
+// listing would mislead clients.
+var s3BucketSubresources = []string{"acl", "cors", "encryption", "lifecycle", "logging", "notification",
+	"object-lock", "policy", "replication", "tagging", "uploads", "versioning", "versions", "website"}
+
+// s3Error is an error response as S3 defines them.
+type s3Error struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *s3Error) Error() string {
+	return e.code + ": " + e.message
+}
+
+func (e *s3Error) withMessage(message string) *s3Error {
+	copied := *e
+	copied.message = message
+	return &copied
+}
+
+var (
+	errS3AccessDenied           = &s3Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	errS3InvalidAccessKeyID     = &s3Error{http.StatusForbidden, "InvalidAccessKeyId", "The access key ID you provided does not exist in our records"}
+	errS3SignatureDoesNotMatch  = &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided"}
+	errS3RequestTimeTooSkewed   = &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large"}
+	errS3QuotaExceeded          = &s3Error{http.StatusForbidden, "QuotaExceeded", "Storage quota exceeded"}
+	errS3AuthorizationMalformed = &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed",
+		"The authorization header is malformed"}
+	errS3AuthorizationQueryParameters = &s3Error{http.StatusBadRequest, "AuthorizationQueryParametersError",
+		"The presigned URL's query parameters are malformed"}
+	errS3InvalidRequest          = &s3Error{http.StatusBadRequest, "InvalidRequest", "Invalid request"}
+	errS3InvalidArgument         = &s3Error{http.StatusBadRequest, "InvalidArgument", "Invalid argument"}
+	errS3InvalidBucketName       = &s3Error{http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid"}
+	errS3KeyTooLong              = &s3Error{http.StatusBadRequest, "KeyTooLongError", "Your key is too long"}
+	errS3MalformedXML            = &s3Error{http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema"}
+	errS3InvalidDigest           = &s3Error{http.StatusBadRequest, "InvalidDigest", "The Content-MD5 you specified is not valid"}
+	errS3BadDigest               = &s3Error{http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received"}
+	errS3ContentSHA256Mismatch   = &s3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided x-amz-content-sha256 header does not match what was computed"}
+	errS3IncompleteBody          = &s3Error{http.StatusBadRequest, "IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header"}
+	errS3EntityTooLarge          = &s3Error{http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size"}
+	errS3EntityTooSmall          = &s3Error{http.StatusBadRequest, "EntityTooSmall", "Your proposed upload is smaller than the minimum allowed object size"}
+	errS3InvalidPart             = &s3Error{http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found or its entity tag did not match"}
+	errS3InvalidPartOrder        = &s3Error{http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order"}
+	errS3RequestTimeout          = &s3Error{http.StatusBadRequest, "RequestTimeout", "Your socket connection to the server was not read from or written to within the timeout period"}
+	errS3NoSuchBucket            = &s3Error{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist"}
+	errS3NoSuchKey               = &s3Error{http.StatusNotFound, "NoSuchKey", "The specified key does not exist"}
+	errS3NoSuchUpload            = &s3Error{http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist"}
+	errS3BucketAlreadyOwnedByYou = &s3Error{http.StatusConflict, "BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded and you already own it"}
+	errS3BucketAlreadyExists     = &s3Error{http.StatusConflict, "BucketAlreadyExists", "The requested bucket name is not available"}
+	errS3BucketNotEmpty          = &s3Error{http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty"}
+	errS3OperationAborted        = &s3Error{http.StatusConflict, "OperationAborted", "A conflicting operation is in progress against this resource"}
+	errS3KeyConflict             = &s3Error{http.StatusConflict, "InvalidRequest", "The key conflicts with a directory or file on its path"}
+	errS3MissingContentLength    = &s3Error{http.StatusLengthRequired, "MissingContentLength", "You must provide the Content-Length HTTP header"}
+	errS3PreconditionFailed      = &s3Error{http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the preconditions you specified did not hold"}
+	errS3InternalError           = &s3Error{http.StatusInternalServerError, "InternalError", "We encountered an internal error, please try again"}
+	errS3NotImplemented          = &s3Error{http.StatusNotImplemented, "NotImplemented", "A header or query you provided implies functionality that is not implemented"}
+	errS3ServiceUnavailable      = &s3Error{http.StatusServiceUnavailable, "ServiceUnavailable", "Please reduce your request rate"}
+)
+
+type s3ErrorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string
+	Message   string
+	Resource  string
+	RequestID string `xml:"RequestId"`
+}
+
+type s3Owner struct {
+	ID          string
+	DisplayName string
+}
+
+type s3BucketEntry struct {
+	Name         string
+	CreationDate string
+}
+
+type s3ListAllMyBucketsResult struct {
+	XMLName xml.Name        `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+	Owner   s3Owner         `xml:"Owner"`
+	Buckets []s3BucketEntry `xml:"Buckets>Bucket"`
+}
+
+type s3LocationConstraint struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+	Location string   `xml:",chardata"`
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+	Owner        *s3Owner `xml:",omitempty"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string
+}
+
+// s3ListBucketResult is the ListObjects response; the V1 and V2 fields
+// are left empty in the other version.
+type s3ListBucketResult struct {
+	XMLName               xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Marker                *string `xml:",omitempty"`
+	NextMarker            string  `xml:",omitempty"`
+	ContinuationToken     string  `xml:",omitempty"`
+	NextContinuationToken string  `xml:",omitempty"`
+	StartAfter            string  `xml:",omitempty"`
+	KeyCount              *int    `xml:",omitempty"`
+	MaxKeys               int
+	Delimiter             string `xml:",omitempty"`
+	EncodingType          string `xml:",omitempty"`
+	IsTruncated           bool
+	Contents              []s3Object
+	CommonPrefixes        []s3CommonPrefix
+}
+
+type s3Delete struct {
+	XMLName xml.Name `xml:"Delete"`
+	Quiet   bool
+	Objects []struct {
+		Key string
+	} `xml:"Object"`
+}
+
+type s3DeletedObject struct {
+	Key string
+}
+
+type s3DeleteError struct {
+	Key     string
+	Code    string
+	Message string
+}
+
+type s3DeleteResult struct {
+	XMLName xml.Name          `xml:"http://s3.amazonaws.com/doc/2006-03-01/ DeleteResult"`
+	Deleted []s3DeletedObject `xml:"Deleted"`
+	Errors  []s3DeleteError   `xml:"Error"`
+}
+
+// s3ListQuery is a parsed ListObjects request.
+type s3ListQuery struct {
+	prefix    string
+	delimiter string
+	after     string
+	maxKeys   int
+}
+
+// s3ObjectInfo is the current version of an object, or the directory a
+// key ending in a slash names.
+type s3ObjectInfo struct {
+	versionID string
+	name      string
+	size      int64
+	etag      string
+	modified  time.Time
+	isDir     bool
+}
+
+// newS3Router returns the engine serving the S3 API on its own port.
+func (g *GatewayService) newS3Router() *gin.Engine {
+	router := gin.Default()
+	router.Use(g.rateLimitIP(), g.s3Authenticate())
+	router.NoRoute(func(c *gin.Context) {
+		s3Fail(c, errS3NotImplemented)
+	})
+
+	router.GET("/", g.rateLimit(limitRead), g.listBuckets)
+
+	// Buckets
+	router.PUT("/:bucket", g.rateLimit(limitWrite), s3Scope(ScopeFilesWrite), g.createBucket)
+	router.HEAD("/:bucket", g.rateLimit(limitRead), s3Scope(ScopeFilesRead), g.headBucket)
+	router.GET("/:bucket", g.rateLimit(limitRead), s3Scope(ScopeFilesRead), g.getBucket)
+	router.DELETE("/:bucket", g.rateLimit(limitWrite), s3Scope(ScopeFilesDelete), g.deleteBucket)
+	router.POST("/:bucket", g.rateLimit(limitWrite), g.postObject)
+
+	// Objects, and multipart uploads of them
+	router.HEAD("/:bucket/*key", g.rateLimit(limitRead), s3Scope(ScopeFilesRead), g.headObject)
+	router.GET("/:bucket/*key", g.rateLimit(limitRead), s3Scope(ScopeFilesRead),
+		g.limitTransfer(limitDownloadBytes), g.getObject)
+	router.PUT("/:bucket/*key", g.rateLimit(limitWrite), s3Scope(ScopeFilesWrite),
+		g.limitTransfer(limitUploadBytes), g.putObject)
+	router.POST("/:bucket/*key", g.rateLimit(limitWrite), g.postObject)
+	router.DELETE("/:bucket/*key", g.rateLimit(limitWrite), g.deleteObject)
+	return router
+}
+
+// s3Authenticate checks the request's SigV4 signature and stores the API
+// key it was signed with as the request's Principal. As with authenticate,
+// only with AUTH_DISABLED set is an unsigned request the anonymous admin.
+func (g *GatewayService) s3Authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header(s3RequestIDField, fmt.Sprintf("%016X", time.Now().UnixNano()))
+
+		sig, err := parseSigV4(c.Request)
+		if err != nil {
+			s3Fail(c, err)
+			return
+		}
+		if sig == nil {
+			if !g.config.AuthDisabled {
+				s3Fail(c, errS3AccessDenied)
+				return
+			}
+			if err := decodePayload(c.Request, c.GetHeader("X-Amz-Content-Sha256"), nil, nil); err != nil {
+				s3Fail(c, err)
+				return
+			}
+			c.Set(principalKey, &Principal{Subject: AnonymousUser, Method: "anonymous", Admin: true})
+			c.Next()
+			return
+		}
+
+		record, err := g.loadAPIKey(sig.accessKeyID)
+		if err == nil && record.s3Sealed == "" {
+			err = fmt.Errorf("API key %s has no S3 credentials", sig.accessKeyID)
+		}
+		var secret string
+		if err == nil {
+			secret, err = openS3Secret(g.config, record.keyID, record.s3Sealed)
+		}
+		if err != nil {
+			log.Printf("Rejected S3 request from %s: %v", c.ClientIP(), err)
+			s3Fail(c, errS3InvalidAccessKeyID)
+			return
+		}
+		signingKey, err := sig.verify(c.Request, secret)
+		if err != nil {
+			log.Printf("Rejected S3 request from %s with key %s: %v", c.ClientIP(), sig.accessKeyID, err)
+			s3Fail(c, err)
+			return
+		}
+		principal, err := g.apiKeyPrincipal(record)
+		if err != nil {
+			log.Printf("Rejected S3 request from %s: %v", c.ClientIP(), err)
+			s3Fail(c, errS3InvalidAccessKeyID)
+			return
+		}
+		if err := decodePayload(c.Request, sig.payloadHash, sig, signingKey); err != nil {
+			s3Fail(c, err)
+			return
+		}
+
+		c.Set(principalKey, principal)
+		c.Next()
+	}
+}
+
+// s3Scope rejects API keys without scope, like requireScope.
+func s3Scope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s3Denied(c, scope) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// s3Denied responds with AccessDenied and returns true if the caller lacks
+// scope.
+func s3Denied(c *gin.Context, scope string) bool {
+	if currentPrincipal(c).Allows(scope) {
+		return false
+	}
+	s3Fail(c, errS3AccessDenied.withMessage(fmt.Sprintf("API key lacks the %s scope", scope)))
+	return true
+}
+
+// s3Fail responds with an S3 error document. Path errors become the
+// closest S3 error and anything else an InternalError.
+func s3Fail(c *gin.Context, err error) {
+	var s3err *s3Error
+	switch {
+	case errors.As(err, &s3err):
+	case errors.Is(err, errPathNotFound):
+		s3err = errS3NoSuchKey
+	case errors.Is(err, errNotDirectory), errors.Is(err, errPathExists), isUniqueViolation(err):
+		s3err = errS3KeyConflict
+	case errors.Is(err, errInvalidName):
+		s3err = errS3InvalidArgument.withMessage(err.Error())
+	default:
+		log.Printf("S3 %s %s failed: %v", c.Request.Method, c.Request.URL.Path, err)
+		s3err = errS3InternalError
+	}
+
+	c.Abort()
+	if c.Request.Method == http.MethodHead {
+		c.Status(s3err.status)
+		return
+	}
+	s3XML(c, s3err.status, s3ErrorResponse{
+		Code:      s3err.code,
+		Message:   s3err.message,
+		Resource:  c.Request.URL.Path,
+		RequestID: c.Writer.Header().Get(s3RequestIDField),
+	})
+}
+
+func s3XML(c *gin.Context, status int, v interface{}) {
+	c.Header("Content-Type", "application/xml")
+	c.Status(status)
+	c.Writer.WriteString(xml.Header)
+	if err := xml.NewEncoder(c.Writer).Encode(v); err != nil {
+		log.Printf("Failed to write S3 response: %v", err)
+	}
+}
+
+func s3Time(t time.Time) string {
+	return t.UTC().Format(s3TimeLayout)
+}
+
+// s3ETag quotes an object's ETag: the MD5 of its data, in the multipart
+// form for multipart uploads, if it was written through the S3 API, else
+// its version's file_id.
+func s3ETag(etag, versionID string) string {
+	if etag == "" {
+		etag = versionID
+	}
+	return `"` + etag + `"`
+}
+
+// s3ObjectKey is the key a request names; "" for the bucket itself.
+func s3ObjectKey(c *gin.Context) string {
+	return strings.TrimPrefix(c.Param("key"), "/")
+}
+
+// s3KeyNames splits an object key into the names along its path. A key
+// ending in a slash names a directory. Keys that do not map onto a path
+// one to one, with empty, "." or ".." segments, are refused.
+func s3KeyNames(key string) (names []string, isDir bool, err error) {
+	if len(key) > maxS3KeyLength {
+		return nil, false, errS3KeyTooLong
+	}
+	key, isDir = strings.CutSuffix(key, "/")
+	names = strings.Split(key, "/")
+	for _, name := range names {
+		if name == "" || name == "." || name == ".." || len(name) > 255 || strings.ContainsRune(name, 0) {
+			return nil, false, errS3InvalidArgument.withMessage(
+				fmt.Sprintf("Object key %q has a segment that cannot be a file name", key))
+		}
+	}
+	return names, isDir, nil
+}
+
+// s3Bucket resolves the bucket a request names to its directory.
+func (g *GatewayService) s3Bucket(c *gin.Context, q queryer) (fsEntry, error) {
+	if g.db == nil {
+		return fsEntry{}, errS3ServiceUnavailable
+	}
+	bucket, err := resolveDir(c.Request.Context(), q, currentPrincipal(c).Subject, []string{c.Param("bucket")})
+	if errors.Is(err, errPathNotFound) || errors.Is(err, errNotDirectory) || errors.Is(err, errInvalidName) {
+		return bucket, errS3NoSuchBucket
+	}
+	return bucket, err
+}
+
+// s3Resolve walks from a bucket to the entry names points at.
+func s3Resolve(ctx context.Context, q queryer, bucket fsEntry, names []string) (fsEntry, error) {
+	entry := bucket
+	for _, name := range names {
+		if !entry.isDir {
+			return entry, errPathNotFound
+		}
+		var err error
+		if entry, err = lookupChild(ctx, q, entry.id, name); err != nil {
+			return entry, err
+		}
+	}
+	return entry, nil
+}
+
+// dirIsEmpty reports whether a directory has no directories and no files
+// outside the trash in it.
+func dirIsEmpty(ctx context.Context, q queryer, dirID string) (bool, error) {
+	var empty bool
+	err := q.QueryRowContext(ctx, `
+        SELECT NOT EXISTS (SELECT 1 FROM directories WHERE parent_id = $1)
+           AND NOT EXISTS (SELECT 1 FROM files WHERE dir_id = $1 AND deleted_at IS NULL)
+    `, dirID).Scan(&empty)
+	return empty, err
+}
+
+// listBuckets lists the caller's top-level directories.
+func (g *GatewayService) listBuckets(c *gin.Context) {
+	if g.db == nil {
+		s3Fail(c, errS3ServiceUnavailable)
+		return
+	}
+	ctx := c.Request.Context()
+	owner := currentPrincipal(c).Subject
+
+	root, err := rootDir(ctx, g.db, owner)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	rows, err := g.db.QueryContext(ctx, `
+        SELECT name, created_at FROM directories WHERE parent_id = $1 ORDER BY name
+    `, root.id)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	defer rows.Close()
+
+	result := s3ListAllMyBucketsResult{Owner: s3Owner{ID: owner, DisplayName: owner}}
+	for rows.Next() {
+		var name string
+		var createdAt time.Time
+		if err := rows.Scan(&name, &createdAt); err != nil {
+			continue
+		}
+		result.Buckets = append(result.Buckets, s3BucketEntry{Name: name, CreationDate: s3Time(createdAt)})
+	}
+	s3XML(c, http.StatusOK, result)
+}
+
+// createBucket creates a top-level directory.
+func (g *GatewayService) createBucket(c *gin.Context) {
+	if g.db == nil {
+		s3Fail(c, errS3ServiceUnavailable)
+		return
+	}
+	bucket := c.Param("bucket")
+	if !s3BucketName.MatchString(bucket) || strings.Contains(bucket, "..") {
+		s3Fail(c, errS3InvalidBucketName)
+		return
+	}
+
+	_, err := g.makeDirs(c.Request.Context(), currentPrincipal(c).Subject, []string{bucket}, false)
+	switch {
+	case errors.Is(err, errPathExists):
+		s3Fail(c, errS3BucketAlreadyOwnedByYou)
+	case errors.Is(err, errNotDirectory), isUniqueViolation(err):
+		s3Fail(c, errS3BucketAlreadyExists)
+	case err != nil:
+		s3Fail(c, err)
+	default:
+		log.Printf("🪣 Created bucket %s for %s", bucket, currentPrincipal(c).Subject)
+		c.Header("Location", "/"+bucket)
+		c.Status(http.StatusOK)
+	}
+}
+
+func (g *GatewayService) headBucket(c *gin.Context) {
+	if _, err := g.s3Bucket(c, g.db); err != nil {
+		s3Fail(c, err)
+		return
+	}
+	c.Header("X-Amz-Bucket-Region", s3DefaultRegion)
+	c.Status(http.StatusOK)
+}
+
+// getBucket lists a bucket's objects, or answers GetBucketLocation.
+func (g *GatewayService) getBucket(c *gin.Context) {
+	query := c.Request.URL.Query()
+	if query.Has("location") {
+		if _, err := g.s3Bucket(c, g.db); err != nil {
+			s3Fail(c, err)
+			return
+		}
+		// An empty constraint is us-east-1; any region is accepted anyway
+		s3XML(c, http.StatusOK, s3LocationConstraint{})
+		return
+	}
+	for _, subresource := range s3BucketSubresources {
+		if query.Has(subresource) {
+			s3Fail(c, errS3NotImplemented.withMessage("The ?"+subresource+" subresource is not supported"))
+			return
+		}
+	}
+	g.listObjects(c, query.Get("list-type") == "2")
+}
+
+// deleteBucket removes an empty top-level directory.
+func (g *GatewayService) deleteBucket(c *gin.Context) {
+	if g.db == nil {
+		s3Fail(c, errS3ServiceUnavailable)
+		return
+	}
+	ctx := c.Request.Context()
+	tx, err := g.db.BeginTx(ctx, nil)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	defer tx.Rollback()
+
+	bucket, err := g.s3Bucket(c, tx)
+	if err == nil {
+		err = lockDir(ctx, tx, bucket.id)
+	}
+	var empty bool
+	if err == nil {
+		empty, err = dirIsEmpty(ctx, tx, bucket.id)
+	}
+	if err == nil && !empty {
+		err = errS3BucketNotEmpty
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `DELETE FROM directories WHERE dir_id = $1`, bucket.id)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+
+	log.Printf("🪣 Deleted bucket %s for %s", bucket.name, currentPrincipal(c).Subject)
+	c.Status(http.StatusNoContent)
+}
+
+// listObjects answers ListObjects, and ListObjectsV2 if v2 is set. Keys
+// are listed in byte order. Directories with nothing in them are listed
+// as keys ending in a slash, the way S3 clients create folders.
+func (g *GatewayService) listObjects(c *gin.Context, v2 bool) {
+	bucket, err := g.s3Bucket(c, g.db)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	query := c.Request.URL.Query()
+
+	lq := s3ListQuery{prefix: query.Get("prefix"), delimiter: query.Get("delimiter"), maxKeys: maxS3ListKeys}
+	if s := query.Get("max-keys"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			s3Fail(c, errS3InvalidArgument.withMessage("max-keys must be a non-negative integer"))
+			return
+		}
+		lq.maxKeys = min(n, maxS3ListKeys)
+	}
+	encodingType := query.Get("encoding-type")
+	if encodingType != "" && encodingType != "url" {
+		s3Fail(c, errS3InvalidArgument.withMessage("Invalid Encoding Method specified in Request"))
+		return
+	}
+	encode := func(s string) string {
+		if encodingType == "" {
+			return s
+		}
+		return awsURIEncode(s, false)
+	}
+
+	result := s3ListBucketResult{
+		Name:         bucket.name,
+		Prefix:       encode(lq.prefix),
+		MaxKeys:      lq.maxKeys,
+		Delimiter:    encode(lq.delimiter),
+		EncodingType: encodingType,
+	}
+	if v2 {
+		lq.after = query.Get("start-after")
+		result.StartAfter = encode(lq.after)
+		if token := query.Get("continuation-token"); token != "" {
+			decoded, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				s3Fail(c, errS3InvalidArgument.withMessage("The continuation token provided is incorrect"))
+				return
+			}
+			lq.after = string(decoded)
+			result.ContinuationToken = token
+		}
+	} else {
+		lq.after = query.Get("marker")
+		marker := encode(lq.after)
+		result.Marker = &marker
+	}
+
+	objects, prefixes, truncated, err := g.listKeys(c.Request.Context(), bucket.id, lq)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+
+	owner := currentPrincipal(c).Subject
+	last := ""
+	for _, o := range objects {
+		last = o.Key
+		o.Key = encode(o.Key)
+		if !v2 || query.Get("fetch-owner") == "true" {
+			o.Owner = &s3Owner{ID: owner, DisplayName: owner}
+		}
+		result.Contents = append(result.Contents, o)
+	}
+	for _, p := range prefixes {
+		last = max(last, p)
+		result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: encode(p)})
+	}
+	result.IsTruncated = truncated
+	if v2 {
+		count := len(objects) + len(prefixes)
+		result.KeyCount = &count
+		if truncated {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+		}
+	} else if truncated {
+		result.NextMarker = encode(last)
+	}
+	s3XML(c, http.StatusOK, result)
+}
+
+// listKeys returns up to maxKeys objects and common prefixes after
+// lq.after, and whether there are more. Once a common prefix is found the
+// keys under it are skipped in the database rather than read.
+func (g *GatewayService) listKeys(ctx context.Context, bucketID string, lq s3ListQuery) ([]s3Object, []string, bool, error) {
+	objects := []s3Object{}
+	prefixes := []string{}
+	if lq.maxKeys == 0 {
+		return objects, prefixes, false, nil
+	}
+
+	// commonPrefix returns the prefix key rolls up into, if any
+	commonPrefix := func(key string) string {
+		if lq.delimiter == "" || !strings.HasPrefix(key, lq.prefix) {
+			return ""
+		}
+		if i := strings.Index(key[len(lq.prefix):], lq.delimiter); i >= 0 {
+			return key[:len(lq.prefix)+i+len(lq.delimiter)]
+		}
+		return ""
+	}
+
+	// Resuming after a common prefix skips the rest of it
+	after, skip := lq.after, commonPrefix(lq.after)
+	for {
+		limit := lq.maxKeys - len(objects) - len(prefixes) + 1
+		rows, err := g.db.QueryContext(ctx, `
+            WITH RECURSIVE tree AS (
+                SELECT dir_id, ''::text AS prefix FROM directories WHERE dir_id = $1
+                UNION ALL
+                SELECT d.dir_id, t.prefix || d.name || '/' FROM directories d JOIN tree t ON d.parent_id = t.dir_id
+            ), objects AS (
+                SELECT t.prefix || files.file_name AS key, files.file_id, files.file_size,
+                       COALESCE(files.etag, '') AS etag, files.updated_at
+                FROM tree t JOIN files ON files.dir_id = t.dir_id
+                WHERE files.deleted_at IS NULL AND files.status IN ($6, $7) AND `+isHeadVersion+`
+                UNION ALL
+                SELECT t.prefix, '', 0, $8, d.updated_at
+                FROM tree t JOIN directories d ON d.dir_id = t.dir_id
+                WHERE t.prefix <> ''
+                  AND NOT EXISTS (SELECT 1 FROM directories c WHERE c.parent_id = t.dir_id)
+                  AND NOT EXISTS (SELECT 1 FROM files f WHERE f.dir_id = t.dir_id AND f.deleted_at IS NULL
+                                  AND f.status IN ($6, $7))
+            )
+            SELECT key, file_id, file_size, etag, updated_at FROM objects
+            WHERE left(key, length($2)) = $2 AND key COLLATE "C" > $3
+              AND ($4 = '' OR left(key, length($4)) <> $4)
+            ORDER BY key COLLATE "C"
+            LIMIT $5
+        `, bucketID, lq.prefix, after, skip, limit, models.StatusCompleted, models.StatusDegraded, emptyMD5)
+		if err != nil {
+			return nil, nil, false, err
+		}
+
+		n, jumped, truncated := 0, false, false
+		for rows.Next() {
+			var key, versionID, etag string
+			var size int64
+			var modified time.Time
+			if err := rows.Scan(&key, &versionID, &size, &etag, &modified); err != nil {
+				rows.Close()
+				return nil, nil, false, err
+			}
+			n++
+			if len(objects)+len(prefixes) == lq.maxKeys {
+				truncated = true
+				break
+			}
+			if prefix := commonPrefix(key); prefix != "" {
+				prefixes = append(prefixes, prefix)
+				after, skip, jumped = prefix, prefix, true
+				break
+			}
+			objects = append(objects, s3Object{
+				Key:          key,
+				LastModified: s3Time(modified),
+				ETag:         s3ETag(etag, versionID),
+				Size:         size,
+				StorageClass: s3StorageClass,
+			})
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, nil, false, err
+		}
+		if truncated || !jumped {
+			return objects, prefixes, truncated, nil
+		}
+	}
+}
+
+// s3Object resolves the object a request names to its current version.
+func (g *GatewayService) s3Object(c *gin.Context) (s3ObjectInfo, error) {
+	var info s3ObjectInfo
+	names, isDir, err := s3KeyNames(s3ObjectKey(c))
+	if err != nil {
+		return info, err
+	}
+	bucket, err := g.s3Bucket(c, g.db)
+	if err != nil {
+		return info, err
+	}
+	ctx := c.Request.Context()
+	entry, err := s3Resolve(ctx, g.db, bucket, names)
+	if errors.Is(err, errPathNotFound) || err == nil && entry.isDir != isDir {
+		return info, errS3NoSuchKey
+	}
+	if err != nil {
+		return info, err
+	}
+
+	info.name = names[len(names)-1]
+	if isDir {
+		info.isDir, info.etag = true, emptyMD5
+		err = g.db.QueryRowContext(ctx, `SELECT updated_at FROM directories WHERE dir_id = $1`, entry.id).
+			Scan(&info.modified)
+		return info, err
+	}
+
+	info.versionID = g.currentVersion(entry.id)
+	var status string
+	err = g.db.QueryRowContext(ctx, `
+        SELECT file_size, status, COALESCE(etag, ''), updated_at FROM files WHERE file_id = $1
+    `, info.versionID).Scan(&info.size, &status, &info.etag, &info.modified)
+	if err != nil {
+		return info, err
+	}
+	if status != string(models.StatusCompleted) && status != string(models.StatusDegraded) {
+		return info, errS3NoSuchKey
+	}
+	return info, nil
+}
+
+// setHeaders sets the headers that describe an object.
+func (info s3ObjectInfo) setHeaders(c *gin.Context) {
+	contentType := mime.TypeByExtension(path.Ext(info.name))
+	if contentType == "" || info.isDir {
+		contentType = "application/octet-stream"
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("ETag", s3ETag(info.etag, info.versionID))
+	c.Header("Last-Modified", info.modified.UTC().Format(http.TimeFormat))
+	c.Header("Accept-Ranges", "bytes")
+}
+
+// precondition evaluates If-Match, If-Unmodified-Since, If-None-Match and
+// If-Modified-Since, returning the status to answer with instead of the
+// object, or 0.
+func (info s3ObjectInfo) precondition(r *http.Request) int {
+	etag := strings.Trim(s3ETag(info.etag, info.versionID), `"`)
+	modified := info.modified.Truncate(time.Second)
+	matches := func(header string) bool {
+		for _, candidate := range strings.Split(header, ",") {
+			candidate = strings.Trim(strings.TrimSpace(candidate), `"`)
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if v := r.Header.Get("If-Match"); v != "" && !matches(v) {
+		return http.StatusPreconditionFailed
+	}
+	if t, err := http.ParseTime(r.Header.Get("If-Unmodified-Since")); err == nil && r.Header.Get("If-Match") == "" &&
+		modified.After(t) {
+		return http.StatusPreconditionFailed
+	}
+	if v := r.Header.Get("If-None-Match"); v != "" {
+		if matches(v) {
+			return http.StatusNotModified
+		}
+	} else if t, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.After(t) {
+		return http.StatusNotModified
+	}
+	return 0
+}
+
+func (g *GatewayService) headObject(c *gin.Context) {
+	if s3ObjectKey(c) == "" {
+		g.headBucket(c)
+		return
+	}
+	info, err := g.s3Object(c)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	info.setHeaders(c)
+	if status := info.precondition(c.Request); status != 0 {
+		c.Status(status)
+		return
+	}
+	c.Header("Content-Length", strconv.FormatInt(info.size, 10))
+	c.Status(http.StatusOK)
+}
+
+// getObject streams an object from the download service. Range requests
+// are passed through.
+func (g *GatewayService) getObject(c *gin.Context) {
+	if s3ObjectKey(c) == "" {
+		g.getBucket(c)
+		return
+	}
+	info, err := g.s3Object(c)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	switch info.precondition(c.Request) {
+	case http.StatusPreconditionFailed:
+		s3Fail(c, errS3PreconditionFailed)
+		return
+	case http.StatusNotModified:
+		info.setHeaders(c)
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	// Empty objects have no chunks to stream
+	if info.size == 0 {
+		info.setHeaders(c)
+		c.Header("Content-Length", "0")
+		c.Status(http.StatusOK)
+		return
+	}
+
+	// If-Range holds our ETag, not the download service's, so it is
+	// settled here
+	if ifRange := c.GetHeader("If-Range"); ifRange != "" {
+		if strings.Trim(ifRange, `"`) != strings.Trim(s3ETag(info.etag, info.versionID), `"`) {
+			c.Request.Header.Del("Range")
+		}
+		c.Request.Header.Del("If-Range")
+	}
+
+	override := http.Header{}
+	override.Set("ETag", s3ETag(info.etag, info.versionID))
+	g.proxyFrom(c, fmt.Sprintf("http://download:8085/stream/%s", info.versionID), override)
+}
+
+// putObject stores an object, creating the directories along its key. A
+// key ending in a slash with no data creates a directory. PUT with
+// ?partNumber and ?uploadId uploads a part of a multipart upload.
+func (g *GatewayService) putObject(c *gin.Context) {
+	key := s3ObjectKey(c)
+	if key == "" {
+		g.createBucket(c)
+		return
+	}
+	if c.Query("uploadId") != "" {
+		g.uploadPart(c)
+		return
+	}
+	if c.GetHeader("X-Amz-Copy-Source") != "" {
+		s3Fail(c, errS3NotImplemented.withMessage("CopyObject is not supported"))
+		return
+	}
+
+	names, isDir, err := s3KeyNames(key)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	bucket, err := g.s3Bucket(c, g.db)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	ctx := c.Request.Context()
+	owner := currentPrincipal(c).Subject
+	size := s3ContentLength(c.Request)
+
+	if isDir {
+		if size > 0 {
+			s3Fail(c, errS3InvalidArgument.withMessage("A key ending in a slash names a directory and takes no data"))
+			return
+		}
+		if _, err := g.makeDirs(ctx, owner, append([]string{bucket.name}, names...), true); err != nil {
+			s3Fail(c, err)
+			return
+		}
+		c.Header("ETag", s3ETag(emptyMD5, ""))
+		c.Status(http.StatusOK)
+		return
+	}
+
+	if size < 0 {
+		s3Fail(c, errS3MissingContentLength)
+		return
+	}
+	if err := g.s3CheckQuota(c, uploadTarget{userID: owner}, size); err != nil {
+		s3Fail(c, err)
+		return
+	}
+	parentNames, name := names[:len(names)-1], names[len(names)-1]
+	parent, err := g.makeDirs(ctx, owner, append([]string{bucket.name}, parentNames...), true)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+
+	target := uploadTarget{dirID: parent.id, name: name, userID: owner}
+	existing, err := lookupChild(ctx, g.db, parent.id, name)
+	switch {
+	case err == nil && existing.isDir:
+		s3Fail(c, errS3KeyConflict)
+		return
+	case err == nil:
+		target = uploadTarget{logicalID: existing.id}
+	case err != errPathNotFound:
+		s3Fail(c, err)
+		return
+	}
+
+	fileID, etag, _, err := g.s3Upload(c, target, name, "", size)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	if _, err := g.db.ExecContext(ctx, `UPDATE files SET etag = $1 WHERE file_id = $2`, etag, fileID); err != nil {
+		log.Printf("Failed to record the ETag of %s: %v", fileID, err)
+	}
+
+	log.Printf("🪣 Put s3://%s/%s as %s", bucket.name, key, fileID)
+	c.Header("ETag", s3ETag(etag, fileID))
+	c.Status(http.StatusOK)
+}
+
+// s3Body reads object data from a request, taking its MD5 for the ETag
+// and checking it against Content-MD5 if the client sent one.
+type s3Body struct {
+	r    io.Reader
+	md5  hash.Hash
+	want []byte
+	n    int64
+	err  error
+}
+
+func newS3Body(r *http.Request) (*s3Body, error) {
+	body := &s3Body{r: r.Body, md5: md5.New()}
+	if v := r.Header.Get("Content-MD5"); v != "" {
+		want, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(want) != md5.Size {
+			return nil, errS3InvalidDigest
+		}
+		body.want = want
+	}
+	return body, nil
+}
+
+func (b *s3Body) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.md5.Write(p[:n])
+	b.n += int64(n)
+	if err == io.EOF && b.want != nil && !bytes.Equal(b.md5.Sum(nil), b.want) {
+		err = errS3BadDigest
+	}
+	if err != nil {
+		b.err = err
+	}
+	return n, err
+}
+
+// s3Upload sends a request's body through the upload service's chunking
+// path as the file target describes. It returns the new row's file_id and
+// the MD5 and size of the data.
+func (g *GatewayService) s3Upload(c *gin.Context, target uploadTarget, name, policyName string, size int64) (string, string, int64, error) {
+	policy, err := storage.ResolvePolicy(g.config, policyName)
+	if err != nil {
+		return "", "", 0, err
+	}
+	body, err := newS3Body(c.Request)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	fileID, status, response := g.sendUpload(c, target, name, policy, body, size)
+
+	// A body that failed its checks cut the upload short; say why
+	if body.err != nil && body.err != io.EOF {
+		g.markUploadFailed(fileID)
+		var s3err *s3Error
+		if !errors.As(body.err, &s3err) {
+			s3err = errS3IncompleteBody
+		}
+		return fileID, "", 0, s3err
+	}
+	if status >= http.StatusMultipleChoices {
+		message, _ := response["error"].(string)
+		switch status {
+		case http.StatusConflict:
+			return fileID, "", 0, errS3OperationAborted.withMessage(message)
+		case http.StatusInsufficientStorage:
+			return fileID, "", 0, errS3QuotaExceeded.withMessage(message)
+		case http.StatusServiceUnavailable:
+			return fileID, "", 0, errS3ServiceUnavailable.withMessage(message)
+		case http.StatusGatewayTimeout:
+			return fileID, "", 0, errS3RequestTimeout
+		default:
+			return fileID, "", 0, fmt.Errorf("upload of %s failed with %d: %s", fileID, status, message)
+		}
+	}
+	return fileID, hex.EncodeToString(body.md5.Sum(nil)), body.n, nil
+}
+
+// s3CheckQuota is checkQuota with S3 errors. Going over quota is a 403, as
+// S3 clients retry 5xx responses.
+func (g *GatewayService) s3CheckQuota(c *gin.Context, target uploadTarget, size int64) error {
+	status, response := g.quotaExceeded(c, target, size)
+	if status == 0 {
+		return nil
+	}
+	message, _ := response["error"].(string)
+	if status == http.StatusRequestEntityTooLarge {
+		return errS3EntityTooLarge.withMessage(message)
+	}
+	return errS3QuotaExceeded.withMessage(message)
+}
+
+// deleteObject moves an object to the trash. As in S3, deleting a key that
+// does not exist succeeds. DELETE with ?uploadId aborts a multipart
+// upload.
+func (g *GatewayService) deleteObject(c *gin.Context) {
+	key := s3ObjectKey(c)
+	switch {
+	case key == "":
+		if !s3Denied(c, ScopeFilesDelete) {
+			g.deleteBucket(c)
+		}
+		return
+	case c.Query("uploadId") != "":
+		if !s3Denied(c, ScopeFilesWrite) {
+			g.abortMultipartUpload(c)
+		}
+		return
+	case s3Denied(c, ScopeFilesDelete):
+		return
+	}
+
+	names, isDir, err := s3KeyNames(key)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	bucket, err := g.s3Bucket(c, g.db)
+	if err == nil {
+		err = g.s3Delete(c.Request.Context(), bucket, names, isDir)
+	}
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// s3Delete moves the file at names to the trash, remembering its path, or
+// removes the directory a key ending in a slash names if it is empty.
+// Keys that name nothing are not an error.
+func (g *GatewayService) s3Delete(ctx context.Context, bucket fsEntry, names []string, isDir bool) error {
+	tx, err := g.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	entry, err := s3Resolve(ctx, tx, bucket, names)
+	if errors.Is(err, errPathNotFound) || err == nil && entry.isDir != isDir {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if entry.isDir {
+		if err := lockDir(ctx, tx, entry.id); err != nil {
+			return err
+		}
+		if empty, err := dirIsEmpty(ctx, tx, entry.id); err != nil || !empty {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM directories WHERE dir_id = $1`, entry.id); err != nil {
+			return err
+		}
+	} else {
+		trashedFrom := joinPath(append([]string{bucket.name}, names[:len(names)-1]...))
+		if err := trashFile(ctx, tx, entry.id, trashedFrom, time.Now()); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("🗑️ Deleted s3://%s/%s", bucket.name, strings.Join(names, "/"))
+	return nil
+}
+
+// postObject dispatches POST requests: DeleteObjects on a bucket, and
+// starting or completing a multipart upload on a key.
+func (g *GatewayService) postObject(c *gin.Context) {
+	key := s3ObjectKey(c)
+	query := c.Request.URL.Query()
+	switch {
+	case key == "" && query.Has("delete"):
+		if !s3Denied(c, ScopeFilesDelete) {
+			g.deleteObjects(c)
+		}
+	case key != "" && query.Has("uploads"):
+		if !s3Denied(c, ScopeFilesWrite) {
+			g.createMultipartUpload(c)
+		}
+	case key != "" && query.Get("uploadId") != "":
+		if !s3Denied(c, ScopeFilesWrite) {
+			g.completeMultipartUpload(c)
+		}
+	default:
+		s3Fail(c, errS3NotImplemented)
+	}
+}
+
+// deleteObjects deletes up to 1000 keys at once.
+func (g *GatewayService) deleteObjects(c *gin.Context) {
+	bucket, err := g.s3Bucket(c, g.db)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	var req s3Delete
+	if err := xml.NewDecoder(io.LimitReader(c.Request.Body, maxS3XMLBody)).Decode(&req); err != nil ||
+		len(req.Objects) == 0 || len(req.Objects) > maxS3ListKeys {
+		s3Fail(c, errS3MalformedXML)
+		return
+	}
+
+	result := s3DeleteResult{}
+	for _, object := range req.Objects {
+		names, isDir, err := s3KeyNames(object.Key)
+		if err == nil {
+			err = g.s3Delete(c.Request.Context(), bucket, names, isDir)
+		}
+		if err != nil {
+			s3err := errS3InternalError
+			if !errors.As(err, &s3err) {
+				log.Printf("Failed to delete s3://%s/%s: %v", bucket.name, object.Key, err)
+			}
+			result.Errors = append(result.Errors, s3DeleteError{Key: object.Key, Code: s3err.code,
+				Message: s3err.message})
+			continue
+		}
+		if !req.Quiet {
+			result.Deleted = append(result.Deleted, s3DeletedObject{Key: object.Key})
+		}
+	}
+	s3XML(c, http.StatusOK, result)
+}
@@ -0,0 +1,473 @@
+// services/gateway/s3auth.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3 clients sign requests with AWS Signature Version 4, in the
+// Authorization header or, for presigned URLs, in the query string. The
+// access key ID is an API key's ID and the secret its S3 secret.
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	amzDateLayout   = "20060102T150405Z"
+	sigV4MaxSkew    = 15 * time.Minute
+	sigV4MaxExpires = 7 * 24 * time.Hour
+
+	// x-amz-content-sha256 values other than the hex SHA-256 of the body
+	unsignedPayload           = "UNSIGNED-PAYLOAD"
+	streamingSignedPayload    = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingUnsignedTrailer  = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	emptySHA256               = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	maxChunkHeaderLength      = 4096
+	awsChunkedSignaturePrefix = "chunk-signature="
+)
+
+// sigV4 is the signature of a request, as the client presented it.
+type sigV4 struct {
+	accessKeyID   string
+	amzDate       string
+	date          time.Time
+	scope         string // <yyyymmdd>/<region>/s3/aws4_request
+	signedHeaders []string
+	signature     string
+	payloadHash   string
+	presigned     bool
+	expires       time.Duration
+}
+
+// parseSigV4 reads a request's signature. It returns nil if the request is
+// not signed at all.
+func parseSigV4(r *http.Request) (*sigV4, error) {
+	authorization := r.Header.Get("Authorization")
+	query := r.URL.Query()
+
+	sig := &sigV4{}
+	var credential, signedHeaders string
+	switch {
+	case strings.HasPrefix(authorization, sigV4Algorithm+" "):
+		for _, field := range strings.Split(strings.TrimPrefix(authorization, sigV4Algorithm+" "), ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch name {
+			case "Credential":
+				credential = value
+			case "SignedHeaders":
+				signedHeaders = value
+			case "Signature":
+				sig.signature = value
+			}
+		}
+		sig.amzDate = r.Header.Get("X-Amz-Date")
+		if sig.amzDate == "" {
+			// Date is signed as it was sent, but read as an HTTP date
+			t, err := http.ParseTime(r.Header.Get("Date"))
+			if err != nil {
+				return nil, errS3AccessDenied.withMessage("AWS authentication requires a valid Date or x-amz-date header")
+			}
+			sig.amzDate = t.UTC().Format(amzDateLayout)
+		}
+		sig.payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		if sig.payloadHash == "" {
+			return nil, errS3InvalidRequest.withMessage("Missing required header for this request: x-amz-content-sha256")
+		}
+
+	case query.Get("X-Amz-Algorithm") != "":
+		if query.Get("X-Amz-Algorithm") != sigV4Algorithm {
+			return nil, errS3AuthorizationQueryParameters.withMessage("X-Amz-Algorithm only supports \"AWS4-HMAC-SHA256\"")
+		}
+		sig.presigned = true
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		sig.signature = query.Get("X-Amz-Signature")
+		sig.amzDate = query.Get("X-Amz-Date")
+		seconds, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || seconds < 0 || time.Duration(seconds)*time.Second > sigV4MaxExpires {
+			return nil, errS3AuthorizationQueryParameters.withMessage(
+				"X-Amz-Expires must be a number of seconds no greater than 604800")
+		}
+		sig.expires = time.Duration(seconds) * time.Second
+		sig.payloadHash = unsignedPayload
+
+	case strings.HasPrefix(authorization, "AWS "):
+		return nil, errS3InvalidRequest.withMessage("Signature Version 2 is not supported, use AWS4-HMAC-SHA256")
+
+	case authorization != "":
+		return nil, errS3AuthorizationMalformed
+
+	default:
+		return nil, nil
+	}
+
+	date, err := time.Parse(amzDateLayout, sig.amzDate)
+	if err != nil {
+		return nil, errS3AuthorizationMalformed.withMessage("x-amz-date must be in the form 20060102T150405Z")
+	}
+	sig.date = date
+
+	// Credential is <access key>/<yyyymmdd>/<region>/s3/aws4_request; any
+	// region is accepted
+	accessKeyID, scope, _ := strings.Cut(credential, "/")
+	parts := strings.Split(scope, "/")
+	if accessKeyID == "" || len(parts) != 4 || parts[2] != "s3" || parts[3] != "aws4_request" {
+		return nil, errS3AuthorizationMalformed
+	}
+	if parts[0] != date.Format("20060102") {
+		return nil, errS3AuthorizationMalformed.withMessage("The credential date does not match x-amz-date")
+	}
+	sig.accessKeyID = accessKeyID
+	sig.scope = scope
+
+	if signedHeaders == "" || sig.signature == "" {
+		return nil, errS3AuthorizationMalformed
+	}
+	sig.signedHeaders = strings.Split(signedHeaders, ";")
+	return sig, nil
+}
+
+// verify checks the signature against the key's secret and that the
+// request is current: within the allowed clock skew, or for a presigned
+// URL not yet expired. It returns the key that signs aws-chunked payloads.
+func (s *sigV4) verify(r *http.Request, secret string) ([]byte, error) {
+	now := time.Now()
+	switch {
+	case s.presigned && now.Before(s.date.Add(-sigV4MaxSkew)):
+		return nil, errS3AccessDenied.withMessage("Request is not valid yet")
+	case s.presigned && now.After(s.date.Add(s.expires)):
+		return nil, errS3AccessDenied.withMessage("Request has expired")
+	case !s.presigned && (now.Sub(s.date) > sigV4MaxSkew || s.date.Sub(now) > sigV4MaxSkew):
+		return nil, errS3RequestTimeTooSkewed
+	}
+
+	key := hmacSHA256([]byte("AWS4"+secret), s.scope[:8])
+	for _, part := range strings.Split(s.scope, "/")[1:] {
+		key = hmacSHA256(key, part)
+	}
+	expected := hex.EncodeToString(hmacSHA256(key, s.stringToSign(r)))
+	if !hmac.Equal([]byte(expected), []byte(s.signature)) {
+		return nil, errS3SignatureDoesNotMatch
+	}
+	return key, nil
+}
+
+func (s *sigV4) stringToSign(r *http.Request) string {
+	canonical := strings.Join([]string{
+		r.Method,
+		canonicalURI(r),
+		s.canonicalQuery(r),
+		s.canonicalHeaders(r),
+		strings.Join(s.signedHeaders, ";"),
+		s.payloadHash,
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	return strings.Join([]string{sigV4Algorithm, s.amzDate, s.scope, hex.EncodeToString(sum[:])}, "\n")
+}
+
+// canonicalURI is the path encoded once, as S3 signs it. Each segment is
+// decoded and encoded again so escapes the client chose match ours, while
+// an escaped slash stays part of its segment.
+func canonicalURI(r *http.Request) string {
+	segments := strings.Split(r.URL.EscapedPath(), "/")
+	for i, segment := range segments {
+		if decoded, err := url.PathUnescape(segment); err == nil {
+			segments[i] = awsURIEncode(decoded, true)
+		}
+	}
+	if uri := strings.Join(segments, "/"); uri != "" {
+		return uri
+	}
+	return "/"
+}
+
+// canonicalQuery is the query string encoded, sorted by name and then by
+// value.
+func (s *sigV4) canonicalQuery(r *http.Request) string {
+	var pairs [][2]string
+	for name, values := range r.URL.Query() {
+		if s.presigned && name == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			pairs = append(pairs, [2]string{awsURIEncode(name, true), awsURIEncode(value, true)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+	encoded := make([]string, len(pairs))
+	for i, pair := range pairs {
+		encoded[i] = pair[0] + "=" + pair[1]
+	}
+	return strings.Join(encoded, "&")
+}
+
+// canonicalHeaders lists the signed headers, each with its values trimmed
+// and runs of spaces collapsed, and is followed by a blank line.
+func (s *sigV4) canonicalHeaders(r *http.Request) string {
+	var b strings.Builder
+	for _, name := range s.signedHeaders {
+		var values []string
+		switch name {
+		case "host":
+			values = []string{r.Host}
+		case "content-length":
+			values = []string{strconv.FormatInt(r.ContentLength, 10)}
+		case "transfer-encoding":
+			values = append(values, r.TransferEncoding...)
+		default:
+			values = append(values, r.Header.Values(name)...)
+		}
+		for i, value := range values {
+			values[i] = strings.Join(strings.Fields(value), " ")
+		}
+		b.WriteString(name + ":" + strings.Join(values, ",") + "\n")
+	}
+	return b.String()
+}
+
+// awsURIEncode percent-encodes every byte of s but the unreserved
+// characters, and slashes only if encodeSlash is set.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case 'A' <= ch && ch <= 'Z', 'a' <= ch && ch <= 'z', '0' <= ch && ch <= '9',
+			ch == '-', ch == '_', ch == '.', ch == '~':
+			b.WriteByte(ch)
+		case ch == '/' && !encodeSlash:
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// decodePayload replaces the request body with one that decodes it as
+// payloadHash says and fails instead of ending if it does not match what
+// was signed. sig and key are nil for an unsigned request.
+func decodePayload(r *http.Request, payloadHash string, sig *sigV4, key []byte) error {
+	switch {
+	case payloadHash == "" || payloadHash == unsignedPayload:
+	case payloadHash == streamingSignedPayload && sig != nil:
+		r.Body = newAWSChunkedReader(r, &chunkSigner{key: key, amzDate: sig.amzDate, scope: sig.scope,
+			previous: sig.signature})
+	case payloadHash == streamingUnsignedTrailer:
+		r.Body = newAWSChunkedReader(r, nil)
+	case len(payloadHash) == sha256.Size*2:
+		want, err := hex.DecodeString(payloadHash)
+		if err != nil {
+			return errS3InvalidRequest.withMessage("x-amz-content-sha256 must be UNSIGNED-PAYLOAD, " +
+				"STREAMING-AWS4-HMAC-SHA256-PAYLOAD, STREAMING-UNSIGNED-PAYLOAD-TRAILER or a SHA-256")
+		}
+		r.Body = &digestReader{ReadCloser: r.Body, hash: sha256.New(), want: want,
+			mismatch: errS3ContentSHA256Mismatch}
+	default:
+		return errS3NotImplemented.withMessage("Payload signing mode " + payloadHash + " is not supported")
+	}
+	return nil
+}
+
+// s3ContentLength is the size of the object data in a request: the
+// decoded length of an aws-chunked body, or the Content-Length. It is -1
+// if the client did not say.
+func s3ContentLength(r *http.Request) int64 {
+	if v := r.Header.Get("X-Amz-Decoded-Content-Length"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n >= 0 {
+			return n
+		}
+		return -1
+	}
+	return r.ContentLength
+}
+
+// digestReader hashes what is read through it and, at the end, returns
+// mismatch rather than io.EOF if the digest is not the one wanted.
+type digestReader struct {
+	io.ReadCloser
+	hash     hash.Hash
+	want     []byte
+	mismatch error
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.ReadCloser.Read(p)
+	d.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(d.hash.Sum(nil), d.want) {
+		err = d.mismatch
+	}
+	return n, err
+}
+
+// chunkSigner checks the signatures of aws-chunked chunks, each of which
+// signs its data and the signature before it, starting from the request's.
+type chunkSigner struct {
+	key      []byte
+	amzDate  string
+	scope    string
+	previous string
+}
+
+func (s *chunkSigner) verify(dataHash []byte, signature string) error {
+	stringToSign := strings.Join([]string{sigV4Algorithm + "-PAYLOAD", s.amzDate, s.scope, s.previous,
+		emptySHA256, hex.EncodeToString(dataHash)}, "\n")
+	expected := hex.EncodeToString(hmacSHA256(s.key, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errS3SignatureDoesNotMatch
+	}
+	s.previous = signature
+	return nil
+}
+
+// awsChunkedReader decodes an aws-chunked body: chunks of
+// "<hex size>[;chunk-signature=<sig>]\r\n<data>\r\n", ending with an empty
+// chunk and, for the trailer forms, trailing headers. Trailing checksums
+// are not checked.
+type awsChunkedReader struct {
+	body      io.ReadCloser
+	r         *bufio.Reader
+	signer    *chunkSigner // nil for unsigned chunks
+	decoded   int64        // the length the client declared, or -1
+	total     int64
+	remaining int64 // of the chunk being read
+	inChunk   bool
+	hash      hash.Hash
+	signature string
+	err       error
+}
+
+func newAWSChunkedReader(r *http.Request, signer *chunkSigner) *awsChunkedReader {
+	decoded := int64(-1)
+	if v := r.Header.Get("X-Amz-Decoded-Content-Length"); v != "" {
+		decoded, _ = strconv.ParseInt(v, 10, 64)
+	}
+	return &awsChunkedReader{body: r.Body, r: bufio.NewReader(r.Body), signer: signer, decoded: decoded,
+		hash: sha256.New()}
+}
+
+func (a *awsChunkedReader) Close() error {
+	return a.body.Close()
+}
+
+func (a *awsChunkedReader) Read(p []byte) (int, error) {
+	for a.err == nil && a.remaining == 0 {
+		a.err = a.nextChunk()
+	}
+	if a.err != nil {
+		return 0, a.err
+	}
+
+	if int64(len(p)) > a.remaining {
+		p = p[:a.remaining]
+	}
+	n, err := a.r.Read(p)
+	a.hash.Write(p[:n])
+	a.remaining -= int64(n)
+	a.total += int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		a.err = err
+	}
+	return n, err
+}
+
+// nextChunk finishes the chunk that was being read and starts the next. It
+// returns io.EOF once the final chunk is read.
+func (a *awsChunkedReader) nextChunk() error {
+	if a.inChunk {
+		if err := a.endChunk(); err != nil {
+			return err
+		}
+	}
+
+	line, err := a.readLine()
+	if err != nil {
+		return err
+	}
+	sizeHex, extension, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(strings.TrimSpace(sizeHex), 16, 64)
+	if err != nil || size < 0 {
+		return errS3IncompleteBody.withMessage("Malformed aws-chunked encoding")
+	}
+	if a.signer != nil {
+		signature, ok := strings.CutPrefix(extension, awsChunkedSignaturePrefix)
+		if !ok {
+			return errS3SignatureDoesNotMatch.withMessage("A chunk is missing its signature")
+		}
+		a.signature = signature
+	}
+	a.remaining, a.inChunk = size, true
+	a.hash.Reset()
+	if size > 0 {
+		return nil
+	}
+
+	// The final chunk signs no data, and is followed by any trailing
+	// headers and a blank line
+	if a.signer != nil {
+		if err := a.signer.verify(a.hash.Sum(nil), a.signature); err != nil {
+			return err
+		}
+	}
+	for {
+		line, err := a.readLine()
+		if err != nil || line == "" {
+			break
+		}
+	}
+	if a.decoded >= 0 && a.total != a.decoded {
+		return errS3IncompleteBody
+	}
+	return io.EOF
+}
+
+func (a *awsChunkedReader) endChunk() error {
+	if a.signer != nil {
+		if err := a.signer.verify(a.hash.Sum(nil), a.signature); err != nil {
+			return err
+		}
+	}
+	a.inChunk = false
+	if line, err := a.readLine(); err != nil || line != "" {
+		return errS3IncompleteBody.withMessage("Malformed aws-chunked encoding")
+	}
+	return nil
+}
+
+func (a *awsChunkedReader) readLine() (string, error) {
+	line, err := a.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull || len(line) > maxChunkHeaderLength {
+		return "", errS3IncompleteBody.withMessage("Malformed aws-chunked encoding")
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
@@ -0,0 +1,455 @@
+// services/gateway/s3multipart.go
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"atlasfs/services/common/events"
+	"atlasfs/services/common/models"
+	"atlasfs/services/common/outbox"
+	"atlasfs/services/common/storage"
+)
+
+// Each part of a multipart upload is stored as a staged file, chunked by
+// the upload service like any other. Completing the upload creates the
+// object's file from the parts' chunks, in order, without copying any
+// data, and purges the parts.
+
+const (
+	minS3PartSize = 5 << 20 // for every part but the last
+	maxS3Parts    = 10000
+)
+
+type s3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+	Bucket   string
+	Key      string
+	UploadID string `xml:"UploadId"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []struct {
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+
+type s3CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+}
+
+// s3Part is an uploaded part of a multipart upload.
+type s3Part struct {
+	fileID     string
+	etag       string
+	size       int64
+	chunkCount int
+	complete   bool
+}
+
+// s3MultipartUpload finds the caller's multipart upload for the key a
+// request names and returns its storage policy. With lock, the upload row
+// is held until the transaction ends.
+func (g *GatewayService) s3MultipartUpload(c *gin.Context, q queryer, lock bool) (string, error) {
+	if g.db == nil {
+		return "", errS3ServiceUnavailable
+	}
+	query := `
+        SELECT storage_policy FROM s3_multipart_uploads
+        WHERE upload_id = $1 AND user_id = $2 AND bucket = $3 AND object_key = $4
+    `
+	if lock {
+		query += " FOR UPDATE"
+	}
+	var policy string
+	err := q.QueryRowContext(c.Request.Context(), query, c.Query("uploadId"), currentPrincipal(c).Subject,
+		c.Param("bucket"), s3ObjectKey(c)).Scan(&policy)
+	if err == sql.ErrNoRows {
+		return "", errS3NoSuchUpload
+	}
+	return policy, err
+}
+
+// createMultipartUpload starts a multipart upload, answering POST
+// /bucket/key?uploads.
+func (g *GatewayService) createMultipartUpload(c *gin.Context) {
+	key := s3ObjectKey(c)
+	_, isDir, err := s3KeyNames(key)
+	if err == nil && isDir {
+		err = errS3InvalidArgument.withMessage("A key ending in a slash names a directory and takes no data")
+	}
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	bucket, err := g.s3Bucket(c, g.db)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	policy, err := storage.ResolvePolicy(g.config, "")
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		s3Fail(c, err)
+		return
+	}
+	uploadID := hex.EncodeToString(buf)
+	_, err = g.db.ExecContext(c.Request.Context(), `
+        INSERT INTO s3_multipart_uploads (upload_id, user_id, bucket, object_key, storage_policy)
+        VALUES ($1, $2, $3, $4, $5)
+    `, uploadID, currentPrincipal(c).Subject, bucket.name, key, policy.String())
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+
+	log.Printf("🪣 Started multipart upload %s of s3://%s/%s", uploadID, bucket.name, key)
+	s3XML(c, http.StatusOK, s3InitiateMultipartUploadResult{Bucket: bucket.name, Key: key, UploadID: uploadID})
+}
+
+// uploadPart stores one part of a multipart upload. Uploading a part
+// number again replaces the part.
+func (g *GatewayService) uploadPart(c *gin.Context) {
+	partNumber, err := strconv.Atoi(c.Query("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > maxS3Parts {
+		s3Fail(c, errS3InvalidArgument.withMessage(
+			fmt.Sprintf("Part number must be an integer between 1 and %d, inclusive", maxS3Parts)))
+		return
+	}
+	uploadID := c.Query("uploadId")
+	policy, err := g.s3MultipartUpload(c, g.db, false)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	size := s3ContentLength(c.Request)
+	if size < 0 {
+		s3Fail(c, errS3MissingContentLength)
+		return
+	}
+	target := uploadTarget{userID: currentPrincipal(c).Subject, staged: true}
+	if err := g.s3CheckQuota(c, target, size); err != nil {
+		s3Fail(c, err)
+		return
+	}
+	name := fmt.Sprintf("%s.part%d", uploadID, partNumber)
+	fileID, etag, partSize, err := g.s3Upload(c, target, name, policy, size)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+
+	// Record the part, taking the place of any uploaded before under the
+	// same number. The upload may have been completed or aborted meanwhile.
+	ctx := c.Request.Context()
+	replaced := ""
+	tx, err := g.db.BeginTx(ctx, nil)
+	if err == nil {
+		defer tx.Rollback()
+		_, err = g.s3MultipartUpload(c, tx, true)
+	}
+	if err == nil {
+		err = tx.QueryRowContext(ctx, `
+            SELECT file_id FROM s3_multipart_parts WHERE upload_id = $1 AND part_number = $2
+        `, uploadID, partNumber).Scan(&replaced)
+		if err == sql.ErrNoRows {
+			err = nil
+		}
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `
+            INSERT INTO s3_multipart_parts (upload_id, part_number, file_id, etag, part_size)
+            VALUES ($1, $2, $3, $4, $5)
+            ON CONFLICT (upload_id, part_number) DO UPDATE
+            SET file_id = EXCLUDED.file_id, etag = EXCLUDED.etag, part_size = EXCLUDED.part_size,
+                created_at = NOW()
+        `, uploadID, partNumber, fileID, etag, partSize)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		g.purgeParts(fileID)
+		s3Fail(c, err)
+		return
+	}
+	if replaced != "" {
+		g.purgeParts(replaced)
+	}
+
+	c.Header("ETag", s3ETag(etag, fileID))
+	c.Status(http.StatusOK)
+}
+
+// completeMultipartUpload joins the listed parts into the object. Its
+// file takes a reference on each part's chunks, renumbered to follow one
+// another, and the parts are purged.
+func (g *GatewayService) completeMultipartUpload(c *gin.Context) {
+	var req s3CompleteMultipartUpload
+	if err := xml.NewDecoder(io.LimitReader(c.Request.Body, maxS3XMLBody)).Decode(&req); err != nil ||
+		len(req.Parts) == 0 {
+		s3Fail(c, errS3MalformedXML)
+		return
+	}
+	for i := 1; i < len(req.Parts); i++ {
+		if req.Parts[i].PartNumber <= req.Parts[i-1].PartNumber {
+			s3Fail(c, errS3InvalidPartOrder)
+			return
+		}
+	}
+
+	key := s3ObjectKey(c)
+	names, _, err := s3KeyNames(key)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	bucket, err := g.s3Bucket(c, g.db)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	ctx := c.Request.Context()
+	principal := currentPrincipal(c)
+	parentNames, name := names[:len(names)-1], names[len(names)-1]
+	parent, err := g.makeDirs(ctx, principal.Subject, append([]string{bucket.name}, parentNames...), true)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+
+	tx, err := g.db.BeginTx(ctx, nil)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	defer tx.Rollback()
+
+	policyName, err := g.s3MultipartUpload(c, tx, true)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	policy, err := storage.ResolvePolicy(g.config, policyName)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+
+	// Every part uploaded, listed or not, is purged once the upload is done
+	rows, err := tx.QueryContext(ctx, `
+        SELECT p.part_number, p.file_id, p.etag, p.part_size, f.chunk_count, f.status IN ($2, $3)
+        FROM s3_multipart_parts p JOIN files f ON f.file_id = p.file_id
+        WHERE p.upload_id = $1
+    `, c.Query("uploadId"), models.StatusCompleted, models.StatusDegraded)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	uploaded := map[int]s3Part{}
+	var partIDs []string
+	for rows.Next() {
+		var number int
+		var part s3Part
+		if err := rows.Scan(&number, &part.fileID, &part.etag, &part.size, &part.chunkCount, &part.complete); err == nil {
+			uploaded[number] = part
+			partIDs = append(partIDs, part.fileID)
+		}
+	}
+	rows.Close()
+
+	// The multipart ETag is the MD5 of the parts' MD5s and the part count
+	var size int64
+	digests := md5.New()
+	parts := make([]s3Part, len(req.Parts))
+	for i, p := range req.Parts {
+		part, ok := uploaded[p.PartNumber]
+		if !ok || !part.complete || strings.Trim(p.ETag, `"`) != part.etag {
+			s3Fail(c, errS3InvalidPart.withMessage(fmt.Sprintf("Part %d was not found or its ETag did not match",
+				p.PartNumber)))
+			return
+		}
+		if i < len(req.Parts)-1 && part.size < minS3PartSize {
+			s3Fail(c, errS3EntityTooSmall.withMessage(fmt.Sprintf("Part %d is smaller than 5 MiB", p.PartNumber)))
+			return
+		}
+		digest, _ := hex.DecodeString(part.etag)
+		digests.Write(digest)
+		size += part.size
+		parts[i] = part
+	}
+	etag := fmt.Sprintf("%s-%d", hex.EncodeToString(digests.Sum(nil)), len(parts))
+
+	// The object's file is a new file in the bucket, or a new version of
+	// the file at its key
+	f := newFile{
+		fileID:   fmt.Sprintf("file_%d", time.Now().UnixNano()),
+		name:     name,
+		size:     size,
+		userID:   principal.Subject,
+		tenantID: principal.Tenant,
+		dirID:    parent.id,
+		policy:   policy,
+	}
+	if err := lockDir(ctx, tx, parent.id); err != nil {
+		s3Fail(c, err)
+		return
+	}
+	existing, err := lookupChild(ctx, tx, parent.id, name)
+	switch {
+	case err == nil && existing.isDir:
+		s3Fail(c, errS3KeyConflict)
+		return
+	case err == nil:
+		f.logicalID = existing.id
+	case err != errPathNotFound:
+		s3Fail(c, err)
+		return
+	}
+	if err := g.insertFile(ctx, tx, f); err != nil {
+		s3Fail(c, err)
+		return
+	}
+
+	chunkCount := 0
+	for _, part := range parts {
+		_, err = tx.ExecContext(ctx, `
+            INSERT INTO chunks (chunk_id, file_id, chunk_index, chunk_size, checksum, created_at)
+            SELECT $1 || '_chunk_' || (chunk_index + $3), $1, chunk_index + $3, chunk_size, checksum, NOW()
+            FROM chunks WHERE file_id = $2
+        `, f.fileID, part.fileID, chunkCount)
+		if err != nil {
+			break
+		}
+		chunkCount += part.chunkCount
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `
+            UPDATE chunk_objects co
+            SET ref_count = co.ref_count + r.refs
+            FROM (SELECT checksum, COUNT(*) AS refs FROM chunks WHERE file_id = $1 GROUP BY checksum) r
+            WHERE co.checksum = r.checksum
+        `, f.fileID)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `
+            UPDATE files SET status = $2, file_size = $3, chunk_count = $4, etag = $5, updated_at = NOW()
+            WHERE file_id = $1
+        `, f.fileID, models.StatusCompleted, size, chunkCount, etag)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `DELETE FROM s3_multipart_uploads WHERE upload_id = $1`, c.Query("uploadId"))
+	}
+	if err == nil {
+		err = outbox.Add(ctx, tx, f.fileID, events.NewEvent("gateway", events.UploadCompletedData{
+			FileID:     f.fileID,
+			FileName:   name,
+			Size:       size,
+			ChunkCount: chunkCount,
+			Parts:      len(parts),
+		}))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		if isUniqueViolation(err) {
+			err = errS3OperationAborted
+		}
+		s3Fail(c, err)
+		return
+	}
+	g.purgeParts(partIDs...)
+
+	log.Printf("🪣 Completed multipart upload %s of s3://%s/%s as %s (%d parts, %d bytes)",
+		c.Query("uploadId"), bucket.name, key, f.fileID, len(parts), size)
+	location := fmt.Sprintf("http://%s/%s/%s", c.Request.Host, bucket.name, awsURIEncode(key, false))
+	s3XML(c, http.StatusOK, s3CompleteMultipartUploadResult{
+		Location: location,
+		Bucket:   bucket.name,
+		Key:      key,
+		ETag:     s3ETag(etag, f.fileID),
+	})
+}
+
+// abortMultipartUpload discards a multipart upload and its parts.
+func (g *GatewayService) abortMultipartUpload(c *gin.Context) {
+	ctx := c.Request.Context()
+	if g.db == nil {
+		s3Fail(c, errS3ServiceUnavailable)
+		return
+	}
+	tx, err := g.db.BeginTx(ctx, nil)
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := g.s3MultipartUpload(c, tx, true); err != nil {
+		s3Fail(c, err)
+		return
+	}
+	rows, err := tx.QueryContext(ctx, `
+        DELETE FROM s3_multipart_parts WHERE upload_id = $1 RETURNING file_id
+    `, c.Query("uploadId"))
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	var partIDs []string
+	for rows.Next() {
+		var fileID string
+		if err := rows.Scan(&fileID); err == nil {
+			partIDs = append(partIDs, fileID)
+		}
+	}
+	rows.Close()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM s3_multipart_uploads WHERE upload_id = $1`, c.Query("uploadId"))
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		s3Fail(c, err)
+		return
+	}
+	g.purgeParts(partIDs...)
+
+	log.Printf("🪣 Aborted multipart upload %s", c.Query("uploadId"))
+	c.Status(http.StatusNoContent)
+}
+
+// purgeParts purges staged part files. A part left behind is purged with
+// the trash once the retention period is over.
+func (g *GatewayService) purgeParts(fileIDs ...string) {
+	for _, fileID := range fileIDs {
+		if _, err := g.purgeFile(context.Background(), fileID); err != nil {
+			log.Printf("Failed to purge part %s: %v", fileID, err)
+		}
+	}
+}
@@ -0,0 +1,465 @@
+// services/gateway/shares.go
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+
+	"atlasfs/services/common/config"
+)
+
+// A share link is /s/<share id>?exp=<unix time>&sig=<signature>. The
+// signature is an HMAC of the share ID, the file ID and the expiry, so a
+// link cannot be altered or forged. What it allows is kept in Redis under
+// share:<id> until it expires; revoking a link deletes that key, which
+// stops it at once.
+
+const sharePasswordIterations = 100_000
+
+// chargeShare charges ARGV[1] bytes, or refunds them if negative, to a
+// share link's downloads, of a file of ARGV[2] bytes: every file's worth
+// of bytes served is one download. A charge is refused once the link has
+// used up its downloads (-2), and any change if it was revoked (-1).
+// Returns the new count.
+var chargeShare = redis.NewScript(`
+local max = tonumber(redis.call('HGET', KEYS[1], 'max_downloads') or '')
+if max == nil then
+    return -1
+end
+local used = tonumber(redis.call('HGET', KEYS[1], 'downloads') or '0')
+local charge, size = tonumber(ARGV[1]), tonumber(ARGV[2])
+if charge > 0 and max > 0 and used >= max then
+    return -2
+end
+local bytes = tonumber(redis.call('HGET', KEYS[1], 'bytes') or '0') + charge
+used = used + math.floor(bytes / size)
+bytes = bytes % size
+if used < 0 then
+    used, bytes = 0, 0
+end
+redis.call('HSET', KEYS[1], 'downloads', used, 'bytes', bytes)
+return used
+`)
+
+type createShareRequest struct {
+	ExpiresIn    string   `json:"expires_in,omitempty"` // a duration, like 72h
+	MaxDownloads int64    `json:"max_downloads,omitempty"`
+	Password     string   `json:"password,omitempty"`
+	AllowedIPs   []string `json:"allowed_ips,omitempty"` // addresses or CIDR ranges
+}
+
+// newShareSecret returns the key share links are signed with.
+func newShareSecret(cfg *config.Config) ([]byte, error) {
+	if cfg.ShareLinkSecret != "" {
+		return []byte(cfg.ShareLinkSecret), nil
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	log.Printf("⚠️ SHARE_LINK_SECRET is not set, share links will not survive a restart")
+	return secret, nil
+}
+
+func shareKey(shareID string) string {
+	return "share:" + shareID
+}
+
+// fileSharesKey holds the IDs of the share links made for a file.
+func fileSharesKey(fileID string) string {
+	return "shares:file:" + fileID
+}
+
+func (g *GatewayService) signShare(shareID, fileID string, expires int64) string {
+	mac := hmac.New(sha256.New, g.shareSecret)
+	fmt.Fprintf(mac, "%s\n%s\n%d", shareID, fileID, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// shareURL builds the link for a share, on PUBLIC_URL or else the host the
+// request came in on.
+func (g *GatewayService) shareURL(c *gin.Context, shareID, fileID string, expires int64) string {
+	base := strings.TrimSuffix(g.config.PublicURL, "/")
+	if base == "" {
+		scheme := "http"
+		if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+			scheme = "https"
+		}
+		base = scheme + "://" + c.Request.Host
+	}
+	query := url.Values{
+		"exp": {strconv.FormatInt(expires, 10)},
+		"sig": {g.signShare(shareID, fileID, expires)},
+	}
+	return base + "/s/" + shareID + "?" + query.Encode()
+}
+
+// hashSharePassword returns salt$hash, both hex.
+func hashSharePassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, sharePasswordIterations, 32)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(salt) + "$" + hex.EncodeToString(key), nil
+}
+
+func checkSharePassword(stored, password string) bool {
+	saltHex, keyHex, ok := strings.Cut(stored, "$")
+	salt, err1 := hex.DecodeString(saltHex)
+	want, err2 := hex.DecodeString(keyHex)
+	if !ok || err1 != nil || err2 != nil {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, sharePasswordIterations, len(want))
+	return err == nil && subtle.ConstantTimeCompare(key, want) == 1
+}
+
+func parseAllowedIPs(values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if prefix, err := netip.ParsePrefix(v); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address or range %q", v)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func ipAllowed(allowed, clientIP string) bool {
+	addr, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return false
+	}
+	prefixes, _ := parseAllowedIPs(strings.Split(allowed, ","))
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// createShare mints a share link for a file, valid for expires_in (the
+// default TTL if not given) and optionally limited to max_downloads, to a
+// password and to the addresses in allowed_ips.
+func (g *GatewayService) createShare(c *gin.Context) {
+	var req createShareRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+	}
+	ttl := g.config.ShareLinkDefaultTTL
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in must be a positive duration, like 72h"})
+			return
+		}
+		ttl = d
+	}
+	if ttl > g.config.ShareLinkMaxTTL {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("expires_in may be at most %s", g.config.ShareLinkMaxTTL),
+		})
+		return
+	}
+	if req.MaxDownloads < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max_downloads must not be negative"})
+		return
+	}
+	prefixes, err := parseAllowedIPs(req.AllowedIPs)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	logicalID := g.logicalFile(c, c.Param("id"))
+	if logicalID == "" {
+		return
+	}
+	var owner string
+	g.db.QueryRow(`SELECT COALESCE(user_id, '') FROM files WHERE file_id = $1`, logicalID).Scan(&owner)
+
+	passwordHash := ""
+	if req.Password != "" {
+		if passwordHash, err = hashSharePassword(req.Password); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create share link"})
+			return
+		}
+	}
+	allowed := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		allowed[i] = prefix.String()
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create share link"})
+		return
+	}
+	shareID := hex.EncodeToString(id)
+	now := time.Now()
+	expiresAt := now.Add(ttl).Truncate(time.Second)
+	principal := currentPrincipal(c)
+
+	ctx := c.Request.Context()
+	_, err = g.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, shareKey(shareID), map[string]interface{}{
+			"file_id":       logicalID,
+			"owner":         owner,
+			"created_by":    principal.Subject,
+			"created_at":    now.Unix(),
+			"expires_at":    expiresAt.Unix(),
+			"max_downloads": req.MaxDownloads,
+			"downloads":     0,
+			"bytes":         0,
+			"password":      passwordHash,
+			"allowed_ips":   strings.Join(allowed, ","),
+		})
+		pipe.ExpireAt(ctx, shareKey(shareID), expiresAt)
+		pipe.SAdd(ctx, fileSharesKey(logicalID), shareID)
+		pipe.Expire(ctx, fileSharesKey(logicalID), g.config.ShareLinkMaxTTL)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to store share link for %s: %v", logicalID, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Share links unavailable"})
+		return
+	}
+
+	log.Printf("🔗 Share link %s for %s created by %s, expires %s", shareID, logicalID, principal.Subject,
+		expiresAt.Format(time.RFC3339))
+	c.JSON(http.StatusCreated, gin.H{
+		"share_id":           shareID,
+		"file_id":            logicalID,
+		"url":                g.shareURL(c, shareID, logicalID, expiresAt.Unix()),
+		"expires_at":         expiresAt,
+		"max_downloads":      req.MaxDownloads,
+		"password_protected": passwordHash != "",
+		"allowed_ips":        allowed,
+	})
+}
+
+// listShares returns the share links of a file that are still valid.
+func (g *GatewayService) listShares(c *gin.Context) {
+	logicalID := g.logicalFile(c, c.Param("id"))
+	if logicalID == "" {
+		return
+	}
+	ctx := c.Request.Context()
+
+	ids, err := g.redisClient.SMembers(ctx, fileSharesKey(logicalID)).Result()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Share links unavailable"})
+		return
+	}
+
+	shares := []gin.H{}
+	for _, shareID := range ids {
+		share, err := g.redisClient.HGetAll(ctx, shareKey(shareID)).Result()
+		if err != nil {
+			continue
+		}
+		if len(share) == 0 {
+			// Expired or revoked
+			g.redisClient.SRem(ctx, fileSharesKey(logicalID), shareID)
+			continue
+		}
+		createdAt, _ := strconv.ParseInt(share["created_at"], 10, 64)
+		expires, _ := strconv.ParseInt(share["expires_at"], 10, 64)
+		maxDownloads, _ := strconv.ParseInt(share["max_downloads"], 10, 64)
+		downloads, _ := strconv.ParseInt(share["downloads"], 10, 64)
+		allowed := []string{}
+		if share["allowed_ips"] != "" {
+			allowed = strings.Split(share["allowed_ips"], ",")
+		}
+		shares = append(shares, gin.H{
+			"share_id":           shareID,
+			"url":                g.shareURL(c, shareID, logicalID, expires),
+			"created_by":         share["created_by"],
+			"created_at":         time.Unix(createdAt, 0),
+			"expires_at":         time.Unix(expires, 0),
+			"max_downloads":      maxDownloads,
+			"downloads":          downloads,
+			"password_protected": share["password"] != "",
+			"allowed_ips":        allowed,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"file_id": logicalID,
+		"shares":  shares,
+		"count":   len(shares),
+	})
+}
+
+// revokeShare disables a share link at once. Its creator, the file's owner
+// and admins may revoke it.
+func (g *GatewayService) revokeShare(c *gin.Context) {
+	shareID := c.Param("id")
+	ctx := c.Request.Context()
+
+	share, err := g.redisClient.HGetAll(ctx, shareKey(shareID)).Result()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Share links unavailable"})
+		return
+	}
+	principal := currentPrincipal(c)
+	if len(share) == 0 || (share["created_by"] != principal.Subject && !principal.CanAccess(share["owner"])) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share link not found"})
+		return
+	}
+
+	_, err = g.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, shareKey(shareID))
+		pipe.SRem(ctx, fileSharesKey(share["file_id"]), shareID)
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Share links unavailable"})
+		return
+	}
+
+	log.Printf("🔗 Share link %s revoked by %s", shareID, principal.Subject)
+	c.JSON(http.StatusOK, gin.H{
+		"share_id": shareID,
+		"message":  "Share link revoked",
+	})
+}
+
+// getSharedFile downloads the file behind a share link. The password, if
+// the link has one, is sent in the X-Share-Password header. Links are
+// charged by the bytes they serve, so ranges add up to a download however
+// the file is split; see chargeShare.
+func (g *GatewayService) getSharedFile(c *gin.Context) {
+	shareID := c.Param("id")
+	expires, err := strconv.ParseInt(c.Query("exp"), 10, 64)
+	if err != nil || c.Query("sig") == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid share link"})
+		return
+	}
+	if time.Now().Unix() >= expires {
+		c.JSON(http.StatusGone, gin.H{"error": "Share link has expired"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	share, err := g.redisClient.HGetAll(ctx, shareKey(shareID)).Result()
+	if err != nil {
+		// Without Redis, revocations and download limits cannot be checked
+		log.Printf("⚠️ Share links unavailable: %v", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Share links unavailable"})
+		return
+	}
+	if len(share) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share link not found"})
+		return
+	}
+
+	fileID := share["file_id"]
+	want := g.signShare(shareID, fileID, expires)
+	if !hmac.Equal([]byte(want), []byte(c.Query("sig"))) || share["expires_at"] != strconv.FormatInt(expires, 10) {
+		log.Printf("Rejected share link %s from %s: bad signature", shareID, c.ClientIP())
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid share link"})
+		return
+	}
+	if share["allowed_ips"] != "" && !ipAllowed(share["allowed_ips"], c.ClientIP()) {
+		log.Printf("Rejected share link %s from %s: address not allowed", shareID, c.ClientIP())
+		c.JSON(http.StatusForbidden, gin.H{"error": "Share link is not valid from this address"})
+		return
+	}
+	if share["password"] != "" {
+		// Never taken from the query, which ends up in access logs
+		password := c.GetHeader("X-Share-Password")
+		if password == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Password required"})
+			return
+		}
+		if !checkSharePassword(share["password"], password) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Wrong password"})
+			return
+		}
+	}
+
+	if g.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database not available"})
+		return
+	}
+	versionID := g.currentVersion(fileID)
+	var size int64
+	err = g.db.QueryRow(`
+        SELECT f.file_size FROM files f JOIN files l ON l.file_id = f.logical_id
+        WHERE f.file_id = $1 AND l.deleted_at IS NULL
+    `, versionID).Scan(&size)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	// Whatever the request asks for, hold a whole file's worth until it is
+	// served, so that concurrent requests cannot each take the last
+	// download. What was not served is refunded after. Requests for an
+	// empty file are charged one unit each.
+	unit := max(size, 1)
+	key := []string{shareKey(shareID)}
+	used, err := chargeShare.Run(ctx, g.redisClient, key, unit, unit).Int64()
+	switch {
+	case err != nil:
+		log.Printf("⚠️ Failed to count download of share link %s: %v", shareID, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Share links unavailable"})
+		return
+	case used == -1:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share link not found"})
+		return
+	case used == -2:
+		c.JSON(http.StatusGone, gin.H{"error": "Share link has no downloads left"})
+		return
+	}
+
+	g.proxyDownload(c, versionID)
+
+	served := int64(0)
+	if c.Writer.Status() < http.StatusMultipleChoices {
+		served = int64(max(c.Writer.Size(), 0))
+		if size == 0 {
+			served = unit
+		}
+	}
+	if refund := min(served, unit) - unit; refund < 0 {
+		// The request's context is gone if the client went away
+		used, err = chargeShare.Run(context.Background(), g.redisClient, key, refund, unit).Int64()
+		if err != nil {
+			log.Printf("⚠️ Failed to refund share link %s %d bytes: %v", shareID, -refund, err)
+		}
+	}
+	log.Printf("🔗 Share link %s served %d bytes to %s (%d downloads)", shareID, served, c.ClientIP(), used)
+}
@@ -0,0 +1,325 @@
+// services/gateway/trash.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"atlasfs/services/common/outbox"
+)
+
+// trashFile moves every version of a file to the trash. trashedFrom is the
+// path of the directory it was in, if it was in the tree.
+func trashFile(ctx context.Context, tx *sql.Tx, logicalID, trashedFrom string, deletedAt time.Time) error {
+	_, err := tx.ExecContext(ctx, `
+        UPDATE files SET deleted_at = $2, trashed_from = NULLIF($3, ''), updated_at = $2
+        WHERE logical_id = $1 AND deleted_at IS NULL
+    `, logicalID, deletedAt, trashedFrom)
+	return err
+}
+
+// listTrash returns the caller's deleted files, most recently deleted
+// first. Admins see every user's, or a single user's with ?user_id=.
+func (g *GatewayService) listTrash(c *gin.Context) {
+	if g.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database not available"})
+		return
+	}
+
+	principal := currentPrincipal(c)
+	ownerID := principal.Subject
+	if principal.Admin {
+		ownerID = c.Query("user_id")
+	}
+
+	// size is what all the file's versions hold until it is purged
+	rows, err := g.db.Query(`
+        SELECT f.file_id, f.file_name, COALESCE(f.user_id, ''), COALESCE(f.trashed_from, ''), f.deleted_at,
+               (SELECT COUNT(*) FROM files v WHERE v.logical_id = f.file_id),
+               (SELECT COALESCE(SUM(v.file_size), 0) FROM files v
+                WHERE v.logical_id = f.file_id AND v.status IN ('completed', 'degraded'))
+        FROM files f
+        WHERE f.file_id = f.logical_id AND f.deleted_at IS NOT NULL AND NOT f.staged
+          AND ($1 = '' OR f.user_id = $1)
+        ORDER BY f.deleted_at DESC, f.file_id
+        LIMIT $2
+    `, ownerID, maxListLimit)
+	if err != nil {
+		log.Printf("Failed to list the trash: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list the trash"})
+		return
+	}
+	defer rows.Close()
+
+	files := []gin.H{}
+	for rows.Next() {
+		var fileID, fileName, userID, trashedFrom string
+		var deletedAt time.Time
+		var versions int
+		var size int64
+		if err := rows.Scan(&fileID, &fileName, &userID, &trashedFrom, &deletedAt, &versions, &size); err != nil {
+			continue
+		}
+		file := gin.H{
+			"file_id":    fileID,
+			"filename":   fileName,
+			"user_id":    userID,
+			"size":       size,
+			"versions":   versions,
+			"deleted_at": deletedAt,
+		}
+		if trashedFrom != "" {
+			file["path"] = path.Join(trashedFrom, fileName)
+		}
+		if g.config.TrashRetention > 0 {
+			file["purge_at"] = deletedAt.Add(g.config.TrashRetention)
+		}
+		files = append(files, file)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"files": files,
+		"count": len(files),
+	})
+}
+
+// trashedFile finds a file in the trash that the caller may access. It
+// responds itself and returns false if there is none.
+func (g *GatewayService) trashedFile(c *gin.Context, q queryer, lock bool) (userID, dirID, trashedFrom, fileName string, ok bool) {
+	query := `
+        SELECT COALESCE(user_id, ''), COALESCE(dir_id, ''), COALESCE(trashed_from, ''), file_name
+        FROM files
+        WHERE file_id = $1 AND file_id = logical_id AND deleted_at IS NOT NULL AND NOT staged
+    `
+	if lock {
+		query += " FOR UPDATE"
+	}
+	err := q.QueryRowContext(c.Request.Context(), query, c.Param("id")).Scan(&userID, &dirID, &trashedFrom, &fileName)
+	if err != nil || !currentPrincipal(c).CanAccess(userID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found in trash"})
+		return "", "", "", "", false
+	}
+	return userID, dirID, trashedFrom, fileName, true
+}
+
+// restoreTrash takes a file out of the trash. A file from the tree goes
+// back to its directory, which is recreated if it was deleted since.
+func (g *GatewayService) restoreTrash(c *gin.Context) {
+	if g.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database not available"})
+		return
+	}
+	ctx := c.Request.Context()
+	logicalID := c.Param("id")
+
+	userID, dirID, trashedFrom, fileName, ok := g.trashedFile(c, g.db, false)
+	if !ok {
+		return
+	}
+	if dirID == "" && trashedFrom != "" {
+		names, err := splitPath(trashedFrom)
+		if err != nil {
+			pathError(c, err)
+			return
+		}
+		dir, err := g.makeDirs(ctx, userID, names, true)
+		if err != nil {
+			pathError(c, err)
+			return
+		}
+		dirID = dir.id
+	}
+
+	tx, err := g.db.BeginTx(ctx, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, _, _, _, ok := g.trashedFile(c, tx, true); !ok {
+		return
+	}
+	if dirID != "" {
+		if err := lockDir(ctx, tx, dirID); err != nil {
+			pathError(c, err)
+			return
+		}
+		if _, err := lookupChild(ctx, tx, dirID, fileName); err != errPathNotFound {
+			if err == nil {
+				err = errPathExists
+			}
+			pathError(c, err)
+			return
+		}
+	}
+	_, err = tx.ExecContext(ctx, `
+        UPDATE files SET deleted_at = NULL, trashed_from = NULL, dir_id = NULLIF($2, ''), updated_at = NOW()
+        WHERE logical_id = $1
+    `, logicalID, dirID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		// Another file may have taken its name meanwhile
+		pathError(c, err)
+		return
+	}
+
+	log.Printf("♻️ Restored %s from the trash", logicalID)
+	response := gin.H{
+		"file_id": logicalID,
+		"message": "File restored",
+	}
+	if dirID != "" {
+		if dir, err := dirPath(ctx, g.db, dirID); err == nil {
+			response["path"] = path.Join(dir, fileName)
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// purgeTrash permanently deletes a file in the trash without waiting for
+// the retention period.
+func (g *GatewayService) purgeTrash(c *gin.Context) {
+	if g.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database not available"})
+		return
+	}
+	if _, _, _, _, ok := g.trashedFile(c, g.db, false); !ok {
+		return
+	}
+
+	versions, err := g.purgeFile(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		log.Printf("Failed to purge %s: %v", c.Param("id"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to purge file"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"file_id":         c.Param("id"),
+		"versions_purged": versions,
+		"message":         "File purged",
+	})
+}
+
+// purgeFile permanently deletes every version of a trashed file and
+// releases its chunks. The FileDeleted events, for the collector and quota
+// accounting, are recorded with the deletion.
+func (g *GatewayService) purgeFile(ctx context.Context, logicalID string) (int, error) {
+	tx, err := g.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Lock the versions before removing them, collecting them first since
+	// the transaction can only run one query at a time
+	rows, err := tx.QueryContext(ctx, `
+        SELECT file_id, file_name, file_size, COALESCE(user_id, '')
+        FROM files WHERE logical_id = $1 AND deleted_at IS NOT NULL
+        FOR UPDATE
+    `, logicalID)
+	if err != nil {
+		return 0, err
+	}
+	type version struct {
+		id, name, userID string
+		size             int64
+	}
+	var versions []version
+	for rows.Next() {
+		var v version
+		if err := rows.Scan(&v.id, &v.name, &v.size, &v.userID); err == nil {
+			versions = append(versions, v)
+		}
+	}
+	rows.Close()
+
+	for _, v := range versions {
+		event, err := removeFile(tx, v.id, v.name, v.size, v.userID)
+		if err == nil {
+			err = outbox.Add(ctx, tx, v.id, event)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("delete %s: %w", v.id, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	log.Printf("🔥 Purged %s (%d versions) from the trash", logicalID, len(versions))
+	return len(versions), nil
+}
+
+// runTrashPurger purges files that have been in the trash for longer than
+// the retention period, including staged files that were abandoned. It
+// does nothing if trashed files are kept.
+func (g *GatewayService) runTrashPurger(ctx context.Context) {
+	retention := g.config.TrashRetention
+	if retention <= 0 {
+		return
+	}
+	log.Printf("✅ Trash purger removing files deleted more than %s ago", retention)
+
+	ticker := time.NewTicker(g.config.TrashPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := g.purgeExpired(ctx, retention); err != nil {
+			log.Printf("Trash purge failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (g *GatewayService) purgeExpired(ctx context.Context, retention time.Duration) error {
+	cutoff := time.Now().Add(-retention)
+
+	// S3 multipart uploads left unfinished for as long are dropped; their
+	// parts are staged files, purged below
+	if _, err := g.db.ExecContext(ctx, `DELETE FROM s3_multipart_uploads WHERE created_at < $1`, cutoff); err != nil {
+		return err
+	}
+
+	rows, err := g.db.QueryContext(ctx, `
+        SELECT file_id FROM files
+        WHERE file_id = logical_id AND deleted_at < $1
+    `, cutoff)
+	if err != nil {
+		return err
+	}
+	var logicalIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			logicalIDs = append(logicalIDs, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range logicalIDs {
+		if _, err := g.purgeFile(ctx, id); err != nil {
+			log.Printf("Failed to purge %s: %v", id, err)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+// services/gateway/uploads.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"atlasfs/services/common/storage"
+)
+
+const uploadServiceURL = "http://upload:8081"
+
+type createUploadRequest struct {
+	FileName      string `json:"file_name" binding:"required"`
+	FileSize      *int64 `json:"file_size" binding:"required"`
+	ChunkSize     int64  `json:"chunk_size,omitempty"`
+	StoragePolicy string `json:"storage_policy,omitempty"`
+	FileID        string `json:"file_id,omitempty"` // upload a new version of this file
+}
+
+// createUpload registers a new file, or a new version of file_id, and
+// opens a resumable upload session for it on the upload service.
+func (g *GatewayService) createUpload(c *gin.Context) {
+	var req createUploadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file_name and file_size are required"})
+		return
+	}
+	policy, err := storage.ResolvePolicy(g.config, req.StoragePolicy)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	logicalID := ""
+	if req.FileID != "" {
+		if logicalID = g.logicalFile(c, req.FileID); logicalID == "" {
+			return
+		}
+	}
+	if !g.checkQuota(c, uploadTarget{logicalID: logicalID}, *req.FileSize) {
+		return
+	}
+
+	fileID := fmt.Sprintf("file_%d", time.Now().UnixNano())
+
+	if g.db != nil {
+		principal := currentPrincipal(c)
+		dbErr := g.insertFile(c.Request.Context(), g.db, newFile{
+			fileID:    fileID,
+			name:      req.FileName,
+			size:      *req.FileSize,
+			userID:    principal.Subject,
+			tenantID:  principal.Tenant,
+			logicalID: logicalID,
+			policy:    policy,
+		})
+		if dbErr != nil {
+			log.Printf("Failed to insert into PostgreSQL: %v", dbErr)
+			if logicalID != "" {
+				c.JSON(http.StatusConflict, gin.H{"error": "Another version is being created, try again"})
+				return
+			}
+		}
+	}
+
+	body, _ := json.Marshal(gin.H{
+		"file_id":        fileID,
+		"file_name":      req.FileName,
+		"file_size":      *req.FileSize,
+		"chunk_size":     req.ChunkSize,
+		"storage_policy": policy.String(),
+	})
+	g.proxyToUpload(c, http.MethodPost, "/sessions", bytes.NewReader(body), "application/json")
+}
+
+func (g *GatewayService) getUpload(c *gin.Context) {
+	if !g.authorizeSession(c, c.Param("id")) {
+		return
+	}
+	g.proxyToUpload(c, http.MethodGet, "/sessions/"+c.Param("id"), nil, "")
+}
+
+func (g *GatewayService) uploadChunk(c *gin.Context) {
+	if !g.authorizeSession(c, c.Param("id")) {
+		return
+	}
+	path := fmt.Sprintf("/sessions/%s/chunks/%s", c.Param("id"), c.Param("index"))
+	g.proxyToUpload(c, http.MethodPut, path, c.Request.Body, "application/octet-stream")
+}
+
+func (g *GatewayService) completeUpload(c *gin.Context) {
+	if !g.authorizeSession(c, c.Param("id")) {
+		return
+	}
+	g.proxyToUpload(c, http.MethodPost, "/sessions/"+c.Param("id")+"/complete", nil, "")
+}
+
+// authorizeSession checks that the caller owns the file an upload session
+// is for.
+func (g *GatewayService) authorizeSession(c *gin.Context, sessionID string) bool {
+	principal := currentPrincipal(c)
+	if principal.Admin {
+		return true
+	}
+	if g.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database not available"})
+		return false
+	}
+
+	var owner string
+	err := g.db.QueryRow(`
+        SELECT COALESCE(f.user_id, '')
+        FROM upload_sessions s JOIN files f ON f.file_id = s.file_id
+        WHERE s.session_id = $1
+    `, sessionID).Scan(&owner)
+	if err != nil || !principal.CanAccess(owner) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return false
+	}
+	return true
+}
+
+// proxyToUpload forwards a session request to the upload service and relays
+// its status and JSON body unchanged.
+func (g *GatewayService) proxyToUpload(c *gin.Context, method, path string, body io.Reader, contentType string) {
+	req, err := http.NewRequestWithContext(c.Request.Context(), method, uploadServiceURL+path, body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create request"})
+		return
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if checksum := c.GetHeader("X-Chunk-SHA256"); checksum != "" {
+		req.Header.Set("X-Chunk-SHA256", checksum)
+	}
+	if method == http.MethodPut {
+		req.ContentLength = c.Request.ContentLength
+	}
+
+	client := &http.Client{Timeout: 60 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("Failed to forward to upload service: %v", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Upload service unavailable"})
+		return
+	}
+	defer resp.Body.Close()
+
+	c.Header("Content-Type", resp.Header.Get("Content-Type"))
+	c.Status(resp.StatusCode)
+	io.Copy(c.Writer, resp.Body)
+}
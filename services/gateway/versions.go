@@ -0,0 +1,477 @@
+// services/gateway/versions.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"atlasfs/services/common/events"
+	"atlasfs/services/common/models"
+	"atlasfs/services/common/outbox"
+)
+
+// Every version of a file is a files row of its own. They share the file's
+// logical_id, which is the file_id of its first version and the ID clients
+// use; version numbers them from 1.
+
+// isHeadVersion limits a query on files to the version each file is read
+// as: its newest complete version, or its newest if none is complete yet.
+const isHeadVersion = `files.version = (
+            SELECT COALESCE(MAX(v.version) FILTER (WHERE v.status IN ('completed', 'degraded')), MAX(v.version))
+            FROM files v WHERE v.logical_id = files.logical_id)`
+
+type pruneVersionsRequest struct {
+	Keep      int    `json:"keep"`
+	OlderThan string `json:"older_than"`
+}
+
+// currentVersion returns the file_id of the newest complete version of the
+// file fileID belongs to, or fileID itself if there is none.
+func (g *GatewayService) currentVersion(fileID string) string {
+	if g.db == nil {
+		return fileID
+	}
+	var versionID string
+	err := g.db.QueryRow(`
+        SELECT h.file_id
+        FROM files f JOIN files h ON h.logical_id = f.logical_id
+        WHERE f.file_id = $1 AND h.status IN ($2, $3)
+        ORDER BY h.version DESC
+        LIMIT 1
+    `, fileID, models.StatusCompleted, models.StatusDegraded).Scan(&versionID)
+	if err != nil {
+		return fileID
+	}
+	return versionID
+}
+
+// logicalFile checks that the caller may access a file, which is not in
+// the trash, and returns the ID its versions share. It responds itself and
+// returns "" if not.
+func (g *GatewayService) logicalFile(c *gin.Context, fileID string) string {
+	if g.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database not available"})
+		return ""
+	}
+
+	var logicalID, owner, status string
+	err := g.db.QueryRow(`
+        SELECT f.logical_id, COALESCE(f.user_id, ''), l.status
+        FROM files f JOIN files l ON l.file_id = f.logical_id
+        WHERE f.file_id = $1 AND l.deleted_at IS NULL
+    `, fileID).Scan(&logicalID, &owner, &status)
+	if err != nil || status == string(models.StatusFailed) || !currentPrincipal(c).CanAccess(owner) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return ""
+	}
+	return logicalID
+}
+
+// listVersions returns a file's versions, newest first. A version's sha256
+// is the SHA-256 of its content, or null if it was uploaded in separate
+// chunks (resumable and S3 multipart uploads). chunks_digest, which every
+// version has, is the SHA-256 of its chunk checksums in order and not a
+// content hash: versions with the same digest hold the same bytes, but the
+// same bytes chunked another way (fixed or content-defined) get another
+// digest.
+func (g *GatewayService) listVersions(c *gin.Context) {
+	logicalID := g.logicalFile(c, c.Param("id"))
+	if logicalID == "" {
+		return
+	}
+	current := g.currentVersion(logicalID)
+
+	rows, err := g.db.Query(`
+        SELECT f.file_id, f.version, f.file_size, f.status, f.chunk_count, f.created_at, f.updated_at, f.content_sha256,
+               COALESCE((SELECT encode(sha256(convert_to(string_agg(ch.checksum, '' ORDER BY ch.chunk_index), 'UTF8')), 'hex')
+                         FROM chunks ch WHERE ch.file_id = f.file_id), '')
+        FROM files f
+        WHERE f.logical_id = $1
+        ORDER BY f.version DESC
+    `, logicalID)
+	if err != nil {
+		log.Printf("Failed to list versions of %s: %v", logicalID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list versions"})
+		return
+	}
+	defer rows.Close()
+
+	versions := []gin.H{}
+	for rows.Next() {
+		var versionID, status, chunksDigest string
+		var version, chunkCount int
+		var size int64
+		var createdAt, updatedAt time.Time
+		var contentSHA256 *string
+		if err := rows.Scan(&versionID, &version, &size, &status, &chunkCount, &createdAt, &updatedAt, &contentSHA256, &chunksDigest); err != nil {
+			continue
+		}
+		versions = append(versions, gin.H{
+			"version":       version,
+			"version_id":    versionID,
+			"size":          size,
+			"status":        status,
+			"chunk_count":   chunkCount,
+			"sha256":        contentSHA256,
+			"chunks_digest": chunksDigest,
+			"current":       versionID == current,
+			"created_at":    createdAt,
+			"updated_at":    updatedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"file_id":  logicalID,
+		"versions": versions,
+		"count":    len(versions),
+	})
+}
+
+// versionRow finds one version of a file by its number. It responds itself
+// and returns false if there is no such version.
+func (g *GatewayService) versionRow(c *gin.Context, logicalID string) (versionID string, status models.FileStatus, ok bool) {
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil || version < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "version must be a positive number"})
+		return "", "", false
+	}
+	err = g.db.QueryRow(`
+        SELECT file_id, status FROM files WHERE logical_id = $1 AND version = $2
+    `, logicalID, version).Scan(&versionID, &status)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+		return "", "", false
+	}
+	return versionID, status, true
+}
+
+// getVersion downloads a specific version of a file.
+func (g *GatewayService) getVersion(c *gin.Context) {
+	logicalID := g.logicalFile(c, c.Param("id"))
+	if logicalID == "" {
+		return
+	}
+	versionID, status, ok := g.versionRow(c, logicalID)
+	if !ok {
+		return
+	}
+	if status == models.StatusPruned {
+		c.JSON(http.StatusGone, gin.H{"error": "Version was pruned"})
+		return
+	}
+	g.proxyDownload(c, versionID)
+}
+
+// uploadVersion uploads a new version of a file. The body is the same
+// multipart form as POST /api/v1/files; the name stays the file's.
+func (g *GatewayService) uploadVersion(c *gin.Context) {
+	logicalID := g.logicalFile(c, c.Param("id"))
+	if logicalID == "" {
+		return
+	}
+	g.streamUpload(c, uploadTarget{logicalID: logicalID})
+}
+
+// restoreVersion makes an old version current again by adding a new
+// version with the same content. No data is copied: the new version's
+// chunks point at the same chunk objects.
+func (g *GatewayService) restoreVersion(c *gin.Context) {
+	logicalID := g.logicalFile(c, c.Param("id"))
+	if logicalID == "" {
+		return
+	}
+	sourceID, status, ok := g.versionRow(c, logicalID)
+	if !ok {
+		return
+	}
+	switch {
+	case status == models.StatusPruned:
+		c.JSON(http.StatusGone, gin.H{"error": "Version was pruned"})
+		return
+	case status != models.StatusCompleted && status != models.StatusDegraded:
+		c.JSON(http.StatusConflict, gin.H{"error": "Version is not complete"})
+		return
+	case sourceID == g.currentVersion(logicalID):
+		c.JSON(http.StatusConflict, gin.H{"error": "Version is already current"})
+		return
+	}
+
+	var size int64
+	if err := g.db.QueryRow(`SELECT file_size FROM files WHERE file_id = $1`, sourceID).Scan(&size); err == nil {
+		if !g.checkQuota(c, uploadTarget{logicalID: logicalID}, size) {
+			return
+		}
+	}
+
+	ctx := c.Request.Context()
+	tx, err := g.db.BeginTx(ctx, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the version being restored so it cannot be pruned meanwhile
+	var fileName string
+	var chunkCount int
+	err = tx.QueryRowContext(ctx, `
+        SELECT file_name, file_size, chunk_count FROM files
+        WHERE file_id = $1 AND status IN ($2, $3)
+        FOR UPDATE
+    `, sourceID, models.StatusCompleted, models.StatusDegraded).Scan(&fileName, &size, &chunkCount)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Version is no longer available"})
+		return
+	}
+
+	fileID := fmt.Sprintf("file_%d", time.Now().UnixNano())
+	var version int
+	err = tx.QueryRowContext(ctx, `
+        INSERT INTO files (file_id, file_name, file_size, status, chunk_count, user_id, tenant_id, dir_id,
+                           logical_id, version, storage_policy, content_sha256, created_at, updated_at)
+        SELECT $1, file_name, file_size, status, chunk_count, user_id, tenant_id, dir_id, logical_id,
+               (SELECT MAX(version) + 1 FROM files WHERE logical_id = $3), storage_policy, content_sha256, $4, $4
+        FROM files WHERE file_id = $2
+        RETURNING version
+    `, fileID, sourceID, logicalID, time.Now()).Scan(&version)
+	if err != nil {
+		log.Printf("Failed to restore %s: %v", sourceID, err)
+		if isUniqueViolation(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Another version is being created, try again"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore version"})
+		}
+		return
+	}
+
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO chunks (chunk_id, file_id, chunk_index, chunk_size, checksum, created_at)
+        SELECT $1 || '_chunk_' || chunk_index, $1, chunk_index, chunk_size, checksum, NOW()
+        FROM chunks WHERE file_id = $2
+    `, fileID, sourceID)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `
+            UPDATE chunk_objects co
+            SET ref_count = co.ref_count + r.refs
+            FROM (SELECT checksum, COUNT(*) AS refs FROM chunks WHERE file_id = $1 GROUP BY checksum) r
+            WHERE co.checksum = r.checksum
+        `, fileID)
+	}
+	if err == nil {
+		err = outbox.Add(ctx, tx, fileID, events.NewEvent("gateway", events.UploadCompletedData{
+			FileID:       fileID,
+			FileName:     fileName,
+			Size:         size,
+			ChunkCount:   chunkCount,
+			LogicalID:    logicalID,
+			RestoredFrom: sourceID,
+		}))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Failed to restore %s: %v", sourceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore version"})
+		return
+	}
+
+	log.Printf("⏪ Restored %s version %s as version %d", logicalID, c.Param("version"), version)
+	c.JSON(http.StatusCreated, gin.H{
+		"file_id":       logicalID,
+		"version":       version,
+		"version_id":    fileID,
+		"restored_from": sourceID,
+		"message":       "Version restored",
+	})
+}
+
+// pruneVersions prunes a file's old versions on request: those beyond the
+// newest keep, and those older than older_than.
+func (g *GatewayService) pruneVersions(c *gin.Context) {
+	var req pruneVersionsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	var maxAge time.Duration
+	if req.OlderThan != "" {
+		d, err := time.ParseDuration(req.OlderThan)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "older_than must be a positive duration, like 720h"})
+			return
+		}
+		maxAge = d
+	}
+	if req.Keep < 0 || (req.Keep == 0 && maxAge == 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "keep or older_than is required"})
+		return
+	}
+
+	logicalID := g.logicalFile(c, c.Param("id"))
+	if logicalID == "" {
+		return
+	}
+	pruned, err := g.pruneOldVersions(c.Request.Context(), logicalID, req.Keep, maxAge)
+	if err != nil {
+		log.Printf("Failed to prune versions of %s: %v", logicalID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prune versions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"file_id":         logicalID,
+		"versions_pruned": pruned,
+	})
+}
+
+// pruneOldVersions prunes the complete versions of a file beyond the newest
+// keep, and those created more than maxAge ago; 0 disables either rule.
+// The current version is never pruned, nor are uploads in progress. A
+// pruned version keeps its row, so version numbers are not reused, but
+// its chunks are released for the collector.
+func (g *GatewayService) pruneOldVersions(ctx context.Context, logicalID string, keep int, maxAge time.Duration) (int, error) {
+	tx, err := g.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+        SELECT file_id, file_name, file_size, COALESCE(user_id, ''), version, created_at
+        FROM files
+        WHERE logical_id = $1 AND status IN ($2, $3)
+        ORDER BY version DESC
+        FOR UPDATE
+    `, logicalID, models.StatusCompleted, models.StatusDegraded)
+	if err != nil {
+		return 0, err
+	}
+	type candidate struct {
+		id, name, userID string
+		size             int64
+		version          int
+		createdAt        time.Time
+	}
+	var versions []candidate
+	for rows.Next() {
+		var v candidate
+		if err := rows.Scan(&v.id, &v.name, &v.size, &v.userID, &v.version, &v.createdAt); err == nil {
+			versions = append(versions, v)
+		}
+	}
+	rows.Close()
+
+	var pruned []candidate
+	for i, v := range versions {
+		if i == 0 {
+			continue // current
+		}
+		tooMany := keep > 0 && i >= keep
+		tooOld := maxAge > 0 && time.Since(v.createdAt) > maxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+
+		checksums, err := releaseChunks(tx, v.id)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM chunks WHERE file_id = $1`, v.id); err != nil {
+			return 0, err
+		}
+		_, err = tx.ExecContext(ctx, `
+            UPDATE files SET status = $1, chunk_count = 0, updated_at = NOW() WHERE file_id = $2
+        `, models.StatusPruned, v.id)
+		if err != nil {
+			return 0, err
+		}
+		// The upload service's collector removes the now unreferenced objects
+		event := fileDeletedEvent(events.FileDeletedData{
+			FileID:    v.id,
+			FileName:  v.name,
+			Size:      v.size,
+			UserID:    v.userID,
+			Checksums: checksums,
+			LogicalID: logicalID,
+			Version:   v.version,
+			Pruned:    true,
+		})
+		if err := outbox.Add(ctx, tx, v.id, event); err != nil {
+			return 0, err
+		}
+		pruned = append(pruned, v)
+	}
+	if len(pruned) == 0 {
+		return 0, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	log.Printf("✂️ Pruned %d old versions of %s", len(pruned), logicalID)
+	return len(pruned), nil
+}
+
+// runVersionPruner applies the configured version retention to every file
+// with old versions. It does nothing if no retention is configured.
+func (g *GatewayService) runVersionPruner(ctx context.Context) {
+	keep, maxAge := g.config.VersionRetentionCount, g.config.VersionRetentionAge
+	if keep <= 0 && maxAge <= 0 {
+		return
+	}
+	log.Printf("✅ Version pruner keeping %d versions, max age %s", keep, maxAge)
+
+	ticker := time.NewTicker(g.config.VersionPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := g.pruneAllVersions(ctx, keep, maxAge); err != nil {
+			log.Printf("Version pruning failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (g *GatewayService) pruneAllVersions(ctx context.Context, keep int, maxAge time.Duration) error {
+	// Only files with more than one complete version have anything to prune
+	rows, err := g.db.QueryContext(ctx, `
+        SELECT logical_id FROM files
+        WHERE status IN ($1, $2)
+        GROUP BY logical_id
+        HAVING COUNT(*) > 1
+    `, models.StatusCompleted, models.StatusDegraded)
+	if err != nil {
+		return err
+	}
+	var logicalIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			logicalIDs = append(logicalIDs, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range logicalIDs {
+		if _, err := g.pruneOldVersions(ctx, id, keep, maxAge); err != nil {
+			log.Printf("Failed to prune versions of %s: %v", id, err)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return nil
+}
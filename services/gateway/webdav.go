@@ -0,0 +1,642 @@
+// services/gateway/webdav.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/webdav"
+
+	"atlasfs/services/common/models"
+	"atlasfs/services/common/storage"
+)
+
+// WebDAV is served under /webdav on the caller's directory tree, the same
+// tree /api/v1/fs works on, so it can be mounted as a network drive. The
+// webdav package speaks the protocol; webdavFS maps it onto the tree,
+// streaming file data from the download service and through the upload
+// service's chunking path. Overwriting a file adds a new version of it and
+// deleting moves files to the trash, as through the API.
+
+const webdavPrefix = "/webdav"
+
+// webdavScopes are the methods WebDAV clients use, with the scope each
+// needs.
+var webdavScopes = map[string]string{
+	http.MethodOptions: ScopeFilesRead,
+	http.MethodGet:     ScopeFilesRead,
+	http.MethodHead:    ScopeFilesRead,
+	"PROPFIND":         ScopeFilesRead,
+	http.MethodPut:     ScopeFilesWrite,
+	"MKCOL":            ScopeFilesWrite,
+	"COPY":             ScopeFilesWrite,
+	"MOVE":             ScopeFilesWrite,
+	"PROPPATCH":        ScopeFilesWrite,
+	"LOCK":             ScopeFilesWrite,
+	"UNLOCK":           ScopeFilesWrite,
+	http.MethodDelete:  ScopeFilesDelete,
+}
+
+// webdavAuthenticate is authenticate for WebDAV clients, most of which
+// only speak Basic auth: the password is an API key or a JWT and the user
+// name is ignored. Bearer tokens work too.
+func (g *GatewayService) webdavAuthenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if _, password, basic := c.Request.BasicAuth(); basic {
+			token, ok = password, true
+		}
+		g.authenticateToken(c, token, ok, `Basic realm="atlasfs"`)
+	}
+}
+
+// davLocks holds each user's WebDAV locks. They live in this gateway's
+// memory, so with more than one replica clients that lock files need
+// sticky sessions.
+type davLocks struct {
+	mu     sync.Mutex
+	byUser map[string]webdav.LockSystem
+}
+
+func (l *davLocks) forUser(userID string) webdav.LockSystem {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.byUser == nil {
+		l.byUser = map[string]webdav.LockSystem{}
+	}
+	ls, ok := l.byUser[userID]
+	if !ok {
+		ls = webdav.NewMemLS()
+		l.byUser[userID] = ls
+	}
+	return ls
+}
+
+// serveWebDAV handles a WebDAV request on the caller's tree, or any user's
+// tree for an admin with ?user_id=.
+func (g *GatewayService) serveWebDAV(c *gin.Context) {
+	if g.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database not available"})
+		return
+	}
+
+	fs := &webdavFS{g: g, c: c, owner: treeOwner(c)}
+	c.Request.Body = &webdavBody{ReadCloser: c.Request.Body, fs: fs}
+	handler := &webdav.Handler{
+		Prefix:     webdavPrefix,
+		FileSystem: fs,
+		LockSystem: g.davLocks.forUser(fs.owner),
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("WebDAV %s %s for %s failed: %v", r.Method, r.URL.Path, fs.owner, err)
+			}
+		},
+	}
+	handler.ServeHTTP(&webdavResponse{ResponseWriter: c.Writer, fs: fs}, c.Request)
+}
+
+// webdavResponse lets a write refused for a reason the webdav package
+// does not know, such as a full quota, respond with the right status
+// rather than the generic one the package picks.
+type webdavResponse struct {
+	http.ResponseWriter
+	fs       *webdavFS
+	replaced bool
+}
+
+func (w *webdavResponse) WriteHeader(status int) {
+	if status >= http.StatusBadRequest && w.fs.status != 0 {
+		status = w.fs.status
+		w.replaced = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+	if w.replaced {
+		w.ResponseWriter.Write([]byte(webdav.StatusText(status)))
+	}
+}
+
+func (w *webdavResponse) Write(p []byte) (int, error) {
+	if w.replaced {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// webdavBody records why reading a request body failed.
+type webdavBody struct {
+	io.ReadCloser
+	fs *webdavFS
+}
+
+func (b *webdavBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.fs.err = err
+	}
+	return n, err
+}
+
+// webdavFS is a webdav.FileSystem over one user's directory tree, for the
+// length of one request.
+type webdavFS struct {
+	g     *GatewayService
+	c     *gin.Context
+	owner string
+
+	// err is why reading the request body or a file failed, so that a
+	// write fed from it is not stored cut short. status replaces the
+	// response status when a write is refused.
+	err    error
+	status int
+}
+
+// davError turns a path error into the os error the webdav package picks
+// its response status by.
+func davError(err error) error {
+	switch {
+	case errors.Is(err, errPathNotFound), errors.Is(err, errNotDirectory):
+		return os.ErrNotExist
+	case errors.Is(err, errPathExists), isUniqueViolation(err):
+		return os.ErrExist
+	}
+	return err
+}
+
+func (fs *webdavFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	names, err := splitPath(name)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return os.ErrExist
+	}
+	if _, err := fs.g.makeDirs(ctx, fs.owner, names, false); err != nil {
+		return davError(err)
+	}
+	log.Printf("📁 Created %s for %s over WebDAV", joinPath(names), fs.owner)
+	return nil
+}
+
+// OpenFile opens a file or directory for reading. Opening a file for
+// writing uploads what is written to it when it is closed, as a new file
+// or as a new version of the file that is there.
+func (fs *webdavFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	names, err := splitPath(name)
+	if err != nil {
+		return nil, err
+	}
+	write := flag&(os.O_WRONLY|os.O_RDWR) != 0
+
+	entry, err := resolvePath(ctx, fs.g.db, fs.owner, names)
+	switch {
+	case err == nil && !write:
+		info, err := fs.stat(ctx, entry, name)
+		if err != nil {
+			return nil, davError(err)
+		}
+		return &webdavFile{fs: fs, entry: entry, info: info}, nil
+	case err == nil && (entry.isDir || flag&os.O_EXCL != 0):
+		return nil, os.ErrExist
+	case err == nil:
+		return fs.create(name, uploadTarget{logicalID: entry.id})
+	case err != errPathNotFound || flag&os.O_CREATE == 0:
+		return nil, davError(err)
+	}
+
+	parent, err := resolveDir(ctx, fs.g.db, fs.owner, names[:len(names)-1])
+	if err != nil {
+		return nil, davError(err)
+	}
+	return fs.create(name, uploadTarget{dirID: parent.id, name: names[len(names)-1], userID: fs.owner})
+}
+
+// create starts uploading a file as target describes. What is written to
+// it is piped to the upload service, so nothing is buffered here.
+func (fs *webdavFS) create(name string, target uploadTarget) (webdav.File, error) {
+	// A PUT says how much is coming; a COPY is as large as its source
+	size := int64(-1)
+	switch fs.c.Request.Method {
+	case http.MethodPut:
+		size = fs.c.Request.ContentLength
+	case "COPY":
+		source, err := fs.copySource(name)
+		if err != nil {
+			return nil, davError(err)
+		}
+		size = source.size
+	}
+	if status, response := fs.g.quotaExceeded(fs.c, target, size); status != 0 {
+		fs.status = status
+		return nil, fmt.Errorf("%v", response["error"])
+	}
+	policy, err := storage.ResolvePolicy(fs.g.config, "")
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	f := &webdavFile{
+		fs:     fs,
+		info:   &webdavInfo{name: path.Base(name), modTime: time.Now()},
+		upload: pw,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(f.done)
+		f.fileID, f.status, f.response = fs.g.sendUpload(fs.c, target, f.info.name, policy, pr, size)
+		// Writes after a failed upload fail rather than block
+		pr.Close()
+	}()
+	return f, nil
+}
+
+// copySource returns the file a COPY writing to name copies from: the one
+// the request names, or when it copies a directory the one at the same
+// place under it.
+func (fs *webdavFS) copySource(name string) (*webdavInfo, error) {
+	destination, err := url.Parse(fs.c.GetHeader("Destination"))
+	if err != nil {
+		return nil, err
+	}
+	dstRoot := path.Clean("/" + strings.TrimPrefix(destination.Path, webdavPrefix))
+	srcRoot := path.Clean("/" + strings.TrimPrefix(fs.c.Request.URL.Path, webdavPrefix))
+	rel, ok := strings.CutPrefix(path.Clean("/"+name), dstRoot)
+	if !ok || (rel != "" && !strings.HasPrefix(rel, "/") && dstRoot != "/") {
+		return nil, fmt.Errorf("COPY to %s does not write %s", dstRoot, name)
+	}
+
+	names, err := splitPath(srcRoot + "/" + rel)
+	if err != nil {
+		return nil, err
+	}
+	ctx := fs.c.Request.Context()
+	entry, err := resolvePath(ctx, fs.g.db, fs.owner, names)
+	if err != nil {
+		return nil, err
+	}
+	if entry.isDir {
+		return nil, errPathExists
+	}
+	return fs.stat(ctx, entry, joinPath(names))
+}
+
+// RemoveAll deletes a file or a directory and everything in it. Files go
+// to the trash, remembering where they were.
+func (fs *webdavFS) RemoveAll(ctx context.Context, name string) error {
+	names, err := splitPath(name)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return os.ErrPermission
+	}
+
+	files, _, err := fs.g.removePath(ctx, fs.owner, names, true)
+	if err == errPathNotFound {
+		return nil
+	}
+	if err != nil {
+		return davError(err)
+	}
+	log.Printf("🗑️ Deleted %s for %s over WebDAV: %d files moved to the trash", joinPath(names), fs.owner, files)
+	return nil
+}
+
+// Rename moves a file or directory. The webdav package has already
+// removed whatever was at newName if it was to be overwritten.
+func (fs *webdavFS) Rename(ctx context.Context, oldName, newName string) error {
+	from, err := splitPath(oldName)
+	if err != nil {
+		return err
+	}
+	to, err := splitPath(newName)
+	if err != nil {
+		return err
+	}
+	if len(from) == 0 || len(to) == 0 {
+		return os.ErrPermission
+	}
+
+	tx, err := fs.g.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	entry, err := resolvePath(ctx, tx, fs.owner, from)
+	if err != nil {
+		return davError(err)
+	}
+	if err := renameEntry(ctx, tx, fs.owner, entry, to); err != nil {
+		return davError(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return davError(err)
+	}
+	log.Printf("📁 Moved %s to %s for %s over WebDAV", joinPath(from), joinPath(to), fs.owner)
+	return nil
+}
+
+func (fs *webdavFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	names, err := splitPath(name)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := resolvePath(ctx, fs.g.db, fs.owner, names)
+	if err != nil {
+		return nil, davError(err)
+	}
+	info, err := fs.stat(ctx, entry, name)
+	if err != nil {
+		return nil, davError(err)
+	}
+	return info, nil
+}
+
+func (fs *webdavFS) stat(ctx context.Context, entry fsEntry, name string) (*webdavInfo, error) {
+	if entry.isDir {
+		info := &webdavInfo{name: path.Base(name), isDir: true}
+		err := fs.g.db.QueryRowContext(ctx, `
+            SELECT updated_at FROM directories WHERE dir_id = $1
+        `, entry.id).Scan(&info.modTime)
+		return info, err
+	}
+
+	files, err := fs.files(ctx, `l.file_id = $1`, entry.id)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, errPathNotFound
+	}
+	return files[0], nil
+}
+
+// files returns the files matching where, in which $1 is arg. A file is
+// seen as its newest complete version; one still being uploaded for the
+// first time is empty.
+func (fs *webdavFS) files(ctx context.Context, where, arg string) ([]*webdavInfo, error) {
+	rows, err := fs.g.db.QueryContext(ctx, `
+        SELECT l.file_name, COALESCE(h.file_id, l.file_id), COALESCE(h.file_size, 0),
+               COALESCE(h.updated_at, l.updated_at)
+        FROM files l
+        LEFT JOIN LATERAL (
+            SELECT v.file_id, v.file_size, v.updated_at FROM files v
+            WHERE v.logical_id = l.file_id AND v.status IN ($2, $3)
+            ORDER BY v.version DESC
+            LIMIT 1
+        ) h ON true
+        WHERE `+where+` AND l.file_id = l.logical_id AND l.status <> 'failed' AND l.deleted_at IS NULL
+        ORDER BY l.file_name
+    `, arg, models.StatusCompleted, models.StatusDegraded)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []*webdavInfo
+	for rows.Next() {
+		info := &webdavInfo{}
+		if err := rows.Scan(&info.name, &info.versionID, &info.size, &info.modTime); err != nil {
+			continue
+		}
+		files = append(files, info)
+	}
+	return files, rows.Err()
+}
+
+// readDir lists a directory, directories first.
+func (fs *webdavFS) readDir(ctx context.Context, dir fsEntry) ([]os.FileInfo, error) {
+	rows, err := fs.g.db.QueryContext(ctx, `
+        SELECT name, updated_at FROM directories WHERE parent_id = $1
+        ORDER BY name
+    `, dir.id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	infos := []os.FileInfo{}
+	for rows.Next() {
+		info := &webdavInfo{isDir: true}
+		if err := rows.Scan(&info.name, &info.modTime); err != nil {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	files, err := fs.files(ctx, `l.dir_id = $1`, dir.id)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range files {
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// webdavInfo describes a directory, or a file as one of its versions.
+type webdavInfo struct {
+	name      string
+	size      int64
+	modTime   time.Time
+	isDir     bool
+	versionID string // the version the file's data is read from
+}
+
+func (i *webdavInfo) Name() string       { return i.name }
+func (i *webdavInfo) Size() int64        { return i.size }
+func (i *webdavInfo) ModTime() time.Time { return i.modTime }
+func (i *webdavInfo) IsDir() bool        { return i.isDir }
+func (i *webdavInfo) Sys() interface{}   { return nil }
+
+func (i *webdavInfo) Mode() os.FileMode {
+	if i.isDir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// ETag is the version's ID, so it changes whenever a new version is
+// uploaded.
+func (i *webdavInfo) ETag(ctx context.Context) (string, error) {
+	if i.versionID == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return `"` + i.versionID + `"`, nil
+}
+
+// ContentType goes by the file's extension, saving the webdav package
+// from reading the start of every file listed to sniff it.
+func (i *webdavInfo) ContentType(ctx context.Context) (string, error) {
+	if ctype := mime.TypeByExtension(path.Ext(i.name)); ctype != "" {
+		return ctype, nil
+	}
+	return "application/octet-stream", nil
+}
+
+// webdavFile is an open directory, a file being read or a file being
+// written.
+type webdavFile struct {
+	fs    *webdavFS
+	entry fsEntry
+	info  *webdavInfo
+
+	// Reading, from the download service starting at offset
+	offset int64
+	body   io.ReadCloser
+	listed bool
+
+	// Writing, to the upload service
+	upload   *io.PipeWriter
+	done     chan struct{}
+	fileID   string
+	status   int
+	response gin.H
+}
+
+func (f *webdavFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// Readdir lists the whole directory on the first call.
+func (f *webdavFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.info.isDir {
+		return nil, errNotDirectory
+	}
+	var infos []os.FileInfo
+	if !f.listed {
+		var err error
+		if infos, err = f.fs.readDir(f.fs.c.Request.Context(), f.entry); err != nil {
+			return nil, err
+		}
+		f.listed = true
+	}
+	if count > 0 && len(infos) == 0 {
+		return nil, io.EOF
+	}
+	return infos, nil
+}
+
+func (f *webdavFile) Read(p []byte) (int, error) {
+	if f.info.isDir || f.upload != nil {
+		return 0, os.ErrInvalid
+	}
+	if f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		body, err := f.open()
+		if err != nil {
+			f.fs.err = err
+			return 0, err
+		}
+		f.body = body
+	}
+
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	if err == io.EOF && f.offset < f.info.size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil && err != io.EOF {
+		f.fs.err = err
+	}
+	return n, err
+}
+
+// open requests the version's data from the download service, from the
+// current offset on.
+func (f *webdavFile) open() (io.ReadCloser, error) {
+	downloadURL := fmt.Sprintf("http://download:8085/stream/%s", f.info.versionID)
+	req, err := http.NewRequestWithContext(f.fs.c.Request.Context(), http.MethodGet, downloadURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", f.offset))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("download service returned %s for %s", resp.Status, f.info.versionID)
+	}
+	return resp.Body, nil
+}
+
+// Seek only moves the offset; the next read requests the data from there.
+func (f *webdavFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	default:
+		return f.offset, os.ErrInvalid
+	}
+	if offset < 0 {
+		return f.offset, os.ErrInvalid
+	}
+	if offset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *webdavFile) Write(p []byte) (int, error) {
+	if f.upload == nil {
+		return 0, os.ErrPermission
+	}
+	n, err := f.upload.Write(p)
+	f.info.size += int64(n)
+	return n, err
+}
+
+// Close finishes an upload and waits for the upload service to store it.
+// An upload fed from a request or file that could not be read in full is
+// abandoned.
+func (f *webdavFile) Close() error {
+	if f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	if f.upload == nil {
+		return nil
+	}
+	f.upload.CloseWithError(f.fs.err)
+	f.upload = nil
+	<-f.done
+
+	if f.fs.err != nil {
+		f.fs.g.markUploadFailed(f.fileID)
+		return f.fs.err
+	}
+	if f.status >= http.StatusMultipleChoices {
+		f.fs.status = f.status
+		return fmt.Errorf("upload of %s failed with %d: %v", f.fileID, f.status, f.response["error"])
+	}
+	f.info.versionID = f.fileID
+	f.info.modTime = time.Now()
+	log.Printf("📤 Stored %s for %s over WebDAV as %s", f.info.name, f.fs.owner, f.fileID)
+	return nil
+}
@@ -0,0 +1,230 @@
+// services/upload/gc.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+
+	"atlasfs/services/common/events"
+	"atlasfs/services/common/storage"
+)
+
+// gcLockID is the Postgres advisory lock that keeps the sweep to a single
+// upload replica at a time.
+const gcLockID = 0x61746c6173 // "atlas"
+
+// runCollector consumes file.deleted events and removes the chunk objects
+// the deleted file left without references. Every replica joins the same
+// consumer group, so each event is handled once.
+func (u *UploadService) runCollector(ctx context.Context) {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:  u.config.KafkaBrokers,
+		GroupID:  "atlasfs-gc",
+		Topic:    "file.events",
+		MinBytes: 1,
+		MaxBytes: 10e6,
+	})
+	defer reader.Close()
+
+	log.Printf("✅ Chunk collector consuming file.events")
+
+	for {
+		msg, err := reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Collector failed to fetch event: %v", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		event, err := events.Decode(msg.Value)
+		if err != nil {
+			log.Printf("Collector skipped event at offset %d it cannot decode: %v", msg.Offset, err)
+		} else if data, ok := event.Payload().(events.FileDeletedData); ok {
+			for _, checksum := range data.Checksums {
+				if _, err := u.collectChunkObject(ctx, checksum); err != nil {
+					log.Printf("Failed to collect chunk object %s: %v", checksum, err)
+				}
+			}
+		}
+
+		if err := reader.CommitMessages(ctx, msg); err != nil {
+			log.Printf("Collector failed to commit offset: %v", err)
+		}
+	}
+}
+
+// collectChunkObject removes a chunk object, its chunk_objects row and its
+// chunk_locations rows if nothing references it any more. The row stays
+// locked while the object is removed so an upload of the same data waits
+// and then writes a fresh copy.
+func (u *UploadService) collectChunkObject(ctx context.Context, checksum string) (bool, error) {
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var refCount int
+	err = tx.QueryRowContext(ctx, `
+        SELECT ref_count FROM chunk_objects WHERE checksum = $1 FOR UPDATE
+    `, checksum).Scan(&refCount)
+	if err == sql.ErrNoRows || (err == nil && refCount > 0) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// Remove every recorded copy and shard; objects from before replication
+	// have no rows and may be on any node.
+	locations, err := u.chunkLocations(ctx, tx, checksum)
+	if err != nil {
+		return false, err
+	}
+	if len(locations) == 0 {
+		for _, node := range u.cluster.Nodes {
+			locations = append(locations, location{placement: placement{node: node, shard: storage.NoShard}})
+		}
+	}
+	for _, loc := range locations {
+		err := loc.node.Delete(ctx, loc.key(checksum))
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return false, fmt.Errorf("remove %s from %s: %w", loc.key(checksum), loc.node.ID, err)
+		}
+	}
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM chunk_locations WHERE chunk_id = $1`, checksum); err != nil {
+		return false, err
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM chunk_objects WHERE checksum = $1`, checksum); err != nil {
+		return false, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+
+	log.Printf("🗑️ Collected chunk object %s", checksum)
+	return true, nil
+}
+
+// runSweeper periodically collects unreferenced chunk objects the event
+// path missed and removes objects on any node that no chunks row points at.
+func (u *UploadService) runSweeper(ctx context.Context) {
+	ticker := time.NewTicker(u.config.GCSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := u.sweep(ctx); err != nil {
+				log.Printf("GC sweep failed: %v", err)
+			}
+		}
+	}
+}
+
+func (u *UploadService) sweep(ctx context.Context) error {
+	// A session-level advisory lock needs a dedicated connection.
+	conn, err := u.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, gcLockID).Scan(&locked); err != nil {
+		return err
+	}
+	if !locked {
+		return nil
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, gcLockID)
+
+	started := time.Now()
+	collected, orphans := 0, 0
+
+	// Objects whose last reference went away without an event reaching us
+	rows, err := u.db.QueryContext(ctx, `SELECT checksum FROM chunk_objects WHERE ref_count <= 0`)
+	if err != nil {
+		return err
+	}
+	var unreferenced []string
+	for rows.Next() {
+		var checksum string
+		if err := rows.Scan(&checksum); err != nil {
+			rows.Close()
+			return err
+		}
+		unreferenced = append(unreferenced, checksum)
+	}
+	rows.Close()
+
+	for _, checksum := range unreferenced {
+		ok, err := u.collectChunkObject(ctx, checksum)
+		if err != nil {
+			log.Printf("Failed to collect chunk object %s: %v", checksum, err)
+			continue
+		}
+		if ok {
+			collected++
+		}
+	}
+
+	// Objects with no row at all, on any node. Uploads insert the row
+	// before writing the object, but skip recent objects anyway so that an
+	// upload whose transaction has not committed yet is left alone.
+	cutoff := time.Now().Add(-u.config.GCGracePeriod)
+	for _, node := range u.cluster.Nodes {
+		err := node.List(ctx, func(obj storage.ObjectInfo) error {
+			if obj.LastModified.After(cutoff) {
+				return nil
+			}
+
+			// Only objects named by a checksum are ours to judge. Chunks
+			// from before content addressing are stored under their
+			// chunk_id, and anything else in the bucket is not ours at all.
+			checksum, shard, ok := storage.ParseKey(obj.Key)
+			if !ok {
+				return nil
+			}
+			var referenced bool
+			err := u.db.QueryRowContext(ctx, `
+                SELECT EXISTS(SELECT 1 FROM chunk_objects WHERE checksum = $1)
+                    OR EXISTS(SELECT 1 FROM chunks WHERE checksum = $1)
+            `, checksum).Scan(&referenced)
+			if err != nil || referenced {
+				return err
+			}
+
+			if err := node.Delete(ctx, obj.Key); err != nil {
+				log.Printf("Failed to remove orphaned object %s from %s: %v", obj.Key, node.ID, err)
+				return nil
+			}
+			u.db.ExecContext(ctx, `
+                DELETE FROM chunk_locations WHERE chunk_id = $1 AND node_id = $2 AND shard_index = $3
+            `, checksum, node.ID, shard)
+			orphans++
+			return nil
+		})
+		if err != nil {
+			// One unreachable node should not hold up the others.
+			log.Printf("Failed to sweep node %s: %v", node.ID, err)
+		}
+	}
+
+	log.Printf("🧹 GC sweep finished in %s: %d unreferenced objects collected, %d orphans removed",
+		time.Since(started).Round(time.Millisecond), collected, orphans)
+	return nil
+}
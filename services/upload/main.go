@@ -2,7 +2,6 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"crypto/sha256"
 	"database/sql"
@@ -10,64 +9,42 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	_ "github.com/lib/pq"
-	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
-	"github.com/segmentio/kafka-go"
 
+	"atlasfs/services/common/chunker"
 	"atlasfs/services/common/config"
 	"atlasfs/services/common/events"
 	"atlasfs/services/common/models"
+	"atlasfs/services/common/outbox"
+	"atlasfs/services/common/storage"
 )
 
-const (
-	ChunkSize  = 4 * 1024 * 1024 // 4MB chunks
-	BucketName = "atlasfs-chunks"
-)
+const ChunkSize = 4 * 1024 * 1024 // 4MB chunks
 
 type UploadService struct {
-	config      *config.Config
-	minioClient *minio.Client
-	kafkaWriter *kafka.Writer
-	db          *sql.DB
-	router      *gin.Engine
+	config     *config.Config
+	cluster    *storage.Cluster
+	db         *sql.DB
+	router     *gin.Engine
+	bufferPool *sync.Pool
 }
 
 func NewUploadService() *UploadService {
 	cfg := config.Load()
 
-	// Initialize MinIO client
-	minioClient, err := minio.New(cfg.MinioEndpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(cfg.MinioAccessKey, cfg.MinioSecretKey, ""),
-		Secure: cfg.MinioUseSSL,
-	})
+	// Initialize storage nodes
+	cluster, err := storage.NewCluster(cfg)
 	if err != nil {
-		log.Printf("Warning: Could not connect to MinIO: %v", err)
+		log.Printf("Warning: Could not configure storage nodes: %v", err)
 	} else {
-		log.Printf("✅ MinIO client initialized for %s", cfg.MinioEndpoint)
-
-		// Create bucket if it doesn't exist
-		ctx := context.Background()
-		exists, _ := minioClient.BucketExists(ctx, BucketName)
-		if !exists {
-			err = minioClient.MakeBucket(ctx, BucketName, minio.MakeBucketOptions{})
-			if err != nil {
-				log.Printf("Failed to create bucket: %v", err)
-			} else {
-				log.Printf("✅ Created bucket: %s", BucketName)
-			}
-		}
-	}
-
-	// Initialize Kafka writer
-	kafkaWriter := &kafka.Writer{
-		Addr:     kafka.TCP(cfg.KafkaBrokers...),
-		Topic:    "file.events",
-		Balancer: &kafka.LeastBytes{},
+		log.Printf("✅ %d storage nodes, replication factor %d", len(cluster.Nodes), cluster.Replicas())
+		cluster.EnsureBuckets(context.Background())
 	}
 
 	// Initialize PostgreSQL
@@ -83,31 +60,74 @@ func NewUploadService() *UploadService {
 		}
 	}
 
-	return &UploadService{
-		config:      cfg,
-		minioClient: minioClient,
-		kafkaWriter: kafkaWriter,
-		db:          db,
-		router:      gin.Default(),
+	service := &UploadService{
+		config:  cfg,
+		cluster: cluster,
+		db:      db,
+		router:  gin.Default(),
 	}
+	service.bufferPool = newBufferPool(service.chunkerOptions().MaxChunkSize())
+	log.Printf("✅ Chunking mode %s, %d concurrent chunk writers", cfg.ChunkingMode, cfg.UploadConcurrency)
+
+	return service
 }
 
 func (u *UploadService) setupRoutes() {
 	u.router.GET("/health", u.healthCheck)
 	u.router.POST("/upload", u.handleUpload)
-	u.router.POST("/chunk", u.handleChunk)
+
+	// Resumable uploads: create a session, PUT chunks by index, then complete
+	u.router.POST("/sessions", u.createSession)
+	u.router.GET("/sessions/:id", u.getSession)
+	u.router.PUT("/sessions/:id/chunks/:index", u.handleChunk)
+	u.router.POST("/sessions/:id/complete", u.completeSession)
+
 	u.router.GET("/status/:id", u.getUploadStatus)
 }
 
+// handleUpload chunks a multipart upload as it arrives rather than
+// spooling it first. Fields must come before the file part to be seen; the
+// gateway always sends file_id first.
 func (u *UploadService) handleUpload(c *gin.Context) {
-	file, header, err := c.Request.FormFile("file")
+	reader, err := c.Request.MultipartReader()
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "No file provided"})
 		return
 	}
+
+	fileID := ""
+	requestedPolicy := ""
+	var file *multipart.Part
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Malformed multipart body"})
+			return
+		}
+		if part.FormName() == "file" && part.FileName() != "" {
+			file = part
+			break
+		}
+		switch part.FormName() {
+		case "file_id":
+			value, _ := io.ReadAll(io.LimitReader(part, 255))
+			fileID = string(value)
+		case "storage_policy":
+			value, _ := io.ReadAll(io.LimitReader(part, 20))
+			requestedPolicy = string(value)
+		}
+		part.Close()
+	}
+	if file == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No file provided"})
+		return
+	}
 	defer file.Close()
+	fileName := file.FileName()
 
-	fileID := c.PostForm("file_id")
 	if fileID == "" {
 		// Fallback to generating one if not provided (for backward compatibility)
 		fileID = fmt.Sprintf("file_%d", time.Now().UnixNano())
@@ -116,142 +136,114 @@ func (u *UploadService) handleUpload(c *gin.Context) {
 		log.Printf("📥 Using file_id from gateway: %s", fileID)
 	}
 
-	log.Printf("📥 Processing upload for file: %s (size: %d)", header.Filename, header.Size)
+	log.Printf("📥 Processing upload for file: %s", fileName)
 
-	// Process file in chunks
-	chunkIndex := 0
-	chunks := []models.Chunk{}
-
-	for {
-		// Read chunk
-		buffer := make([]byte, ChunkSize)
-		n, err := file.Read(buffer)
-		if err != nil && err != io.EOF {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
-			return
-		}
-		if n == 0 {
-			break
-		}
-
-		// Calculate checksum
-		hash := sha256.Sum256(buffer[:n])
-		checksum := hex.EncodeToString(hash[:])
-
-		// Create chunk ID
-		chunkID := fmt.Sprintf("%s_chunk_%d", fileID, chunkIndex)
-
-		// Store chunk in MinIO
-		ctx := context.Background()
-		_, err = u.minioClient.PutObject(ctx, BucketName, chunkID,
-			bytes.NewReader(buffer[:n]), int64(n),
-			minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	chunkOpts := u.chunkerOptions()
+	content := sha256.New()
+	splitter, err := chunker.New(io.TeeReader(file, content), chunkOpts)
+	if err != nil {
+		log.Printf("Invalid chunking configuration: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid chunking configuration"})
+		return
+	}
 
-		if err != nil {
-			log.Printf("Failed to store chunk %s: %v", chunkID, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store chunk"})
-			return
-		}
+	policy, err := u.filePolicy(fileID, requestedPolicy)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-		// Record chunk info
-		chunk := models.Chunk{
-			ID:        chunkID,
-			FileID:    fileID,
-			Index:     chunkIndex,
-			Size:      int64(n),
-			Checksum:  checksum,
-			CreatedAt: time.Now(),
-		}
-		chunks = append(chunks, chunk)
-
-		// Store chunk metadata in PostgreSQL
-		if u.db != nil {
-			query := `
-                INSERT INTO chunks (chunk_id, file_id, chunk_index, chunk_size, checksum, created_at)
-                VALUES ($1, $2, $3, $4, $5, $6)
-            `
-			_, dbErr := u.db.Exec(query, chunk.ID, chunk.FileID, chunk.Index,
-				chunk.Size, chunk.Checksum, chunk.CreatedAt)
-			if dbErr != nil {
-				log.Printf("Failed to store chunk metadata: %v", dbErr)
-			}
-		}
+	// Process file in chunks
+	stored, err := u.storeChunks(context.Background(), fileID, splitter, policy)
+	if err != nil {
+		log.Printf("Failed to store chunks of %s: %v", fileID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store chunk"})
+		return
+	}
 
-		// Publish chunk created event
-		event := events.NewEvent(
-			events.FileChunkCreated,
-			"upload",
-			map[string]interface{}{
-				"file_id":  fileID,
-				"chunk_id": chunkID,
-				"index":    chunkIndex,
-				"size":     n,
-				"checksum": checksum,
-			},
-		)
-
-		if eventData, _ := event.ToJSON(); eventData != nil {
-			u.kafkaWriter.WriteMessages(context.Background(),
-				kafka.Message{
-					Key:   []byte(chunkID),
-					Value: eventData,
-				},
-			)
+	chunks := make([]models.Chunk, len(stored))
+	totalSize := int64(0)
+	dedupChunks := 0
+	dedupBytes := int64(0)
+	for i, sc := range stored {
+		chunks[i] = sc.chunk
+		totalSize += sc.chunk.Size
+		if sc.deduplicated {
+			dedupChunks++
+			dedupBytes += sc.chunk.Size
 		}
-
-		log.Printf("✅ Stored chunk %d for file %s (size: %d bytes)", chunkIndex, fileID, n)
-		chunkIndex++
 	}
 
-	// Update file status in PostgreSQL
+	// Update file status in PostgreSQL, recording the event with it
 	if u.db != nil {
-		query := `
-            UPDATE files 
-            SET chunk_count = $1, status = $2, updated_at = $3
-            WHERE file_id = $4
-        `
-		_, err = u.db.Exec(query, len(chunks), "completed", time.Now(), fileID)
-		if err != nil {
+		contentSHA256 := hex.EncodeToString(content.Sum(nil))
+		if err := u.completeFile(fileID, fileName, len(chunks), totalSize, contentSHA256); err != nil {
 			log.Printf("Failed to update file status: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete upload"})
+			return
 		}
 	}
 
-	// Publish upload completed event
-	event := events.NewEvent(
-		events.FileUploadCompleted,
-		"upload",
-		map[string]interface{}{
-			"file_id":     fileID,
-			"filename":    header.Filename,
-			"size":        header.Size,
-			"chunk_count": len(chunks),
-		},
-	)
-
-	if eventData, _ := event.ToJSON(); eventData != nil {
-		u.kafkaWriter.WriteMessages(context.Background(),
-			kafka.Message{
-				Key:   []byte(fileID),
-				Value: eventData,
-			},
-		)
-	}
-
-	log.Printf("✅ Upload completed for %s: %d chunks stored", fileID, len(chunks))
+	log.Printf("✅ Upload completed for %s: %d chunks stored, %d deduplicated (%d bytes saved)",
+		fileID, len(chunks), dedupChunks, dedupBytes)
 
 	c.JSON(http.StatusOK, gin.H{
 		"file_id":     fileID,
-		"filename":    header.Filename,
-		"size":        header.Size,
+		"filename":    fileName,
+		"size":        totalSize,
 		"chunk_count": len(chunks),
+		"chunking":    chunkOpts.Mode,
+		"policy":      policy.String(),
 		"status":      "completed",
 		"chunks":      chunks,
+		"dedup": gin.H{
+			"deduplicated_chunks": dedupChunks,
+			"deduplicated_bytes":  dedupBytes,
+			"stored_bytes":        totalSize - dedupBytes,
+		},
 	})
 }
 
-func (u *UploadService) handleChunk(c *gin.Context) {
-	// For handling individual chunk uploads (future enhancement)
-	c.JSON(http.StatusNotImplemented, gin.H{"message": "Individual chunk upload not yet implemented"})
+// completeFile marks a file completed with its size, chunk count and the
+// SHA-256 of its content, and records its upload completed event in the
+// same transaction.
+func (u *UploadService) completeFile(fileID, fileName string, chunkCount int, size int64, contentSHA256 string) error {
+	ctx := context.Background()
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+        UPDATE files
+        SET chunk_count = $1, file_size = $2, status = $3, content_sha256 = $4, updated_at = $5
+        WHERE file_id = $6
+    `, chunkCount, size, "completed", contentSHA256, time.Now(), fileID)
+	if err != nil {
+		return err
+	}
+	event := events.NewEvent("upload", events.UploadCompletedData{
+		FileID:     fileID,
+		FileName:   fileName,
+		Size:       size,
+		ChunkCount: chunkCount,
+	})
+	if err := outbox.Add(ctx, tx, fileID, event); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// chunkerOptions returns how handleUpload splits files, from config.
+func (u *UploadService) chunkerOptions() chunker.Options {
+	return chunker.Options{
+		Mode:    chunker.Mode(u.config.ChunkingMode),
+		Size:    ChunkSize,
+		MinSize: u.config.CDCMinSize,
+		AvgSize: u.config.CDCAvgSize,
+		MaxSize: u.config.CDCMaxSize,
+	}
 }
 
 func (u *UploadService) getUploadStatus(c *gin.Context) {
@@ -283,15 +275,12 @@ func (u *UploadService) healthCheck(c *gin.Context) {
 		"timestamp": time.Now().Unix(),
 	}
 
-	// Check MinIO
-	if u.minioClient != nil {
-		ctx := context.Background()
-		_, err := u.minioClient.ListBuckets(ctx)
-		if err != nil {
-			health["minio"] = "unhealthy"
-		} else {
-			health["minio"] = "healthy"
-		}
+	// Check storage nodes
+	if u.cluster != nil {
+		nodes := u.cluster.Health(context.Background())
+		health["storage"] = storage.Summarize(nodes)
+		health["minio"] = health["storage"] // the key existing monitors check
+		health["storage_nodes"] = nodes
 	}
 
 	// Check PostgreSQL
@@ -308,11 +297,24 @@ func main() {
 	log.Println("🚀 Starting AtlasFS Upload Service...")
 
 	service := NewUploadService()
-	defer service.kafkaWriter.Close()
 	defer service.db.Close()
 
 	service.setupRoutes()
 
+	// Background garbage collection of unreferenced chunk objects and
+	// re-replication of chunks that lost copies
+	if service.db != nil && service.cluster != nil {
+		go service.runCollector(context.Background())
+		go service.runSweeper(context.Background())
+		go service.runRepairer(context.Background())
+	}
+
+	// Events recorded in the outbox are published to Kafka by whichever
+	// service's relay holds the lock
+	if service.db != nil {
+		go outbox.NewRelay(service.config, service.db).Run(context.Background())
+	}
+
 	port := "8081"
 	log.Printf("✅ Upload Service listening on port %s", port)
 
@@ -0,0 +1,132 @@
+// services/upload/pipeline.go
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"atlasfs/services/common/chunker"
+	"atlasfs/services/common/models"
+	"atlasfs/services/common/storage"
+)
+
+// storedChunk is the outcome of storing one chunk.
+type storedChunk struct {
+	chunk        models.Chunk
+	deduplicated bool
+}
+
+type chunkJob struct {
+	index int
+	buf   *[]byte
+	data  []byte
+}
+
+// newBufferPool returns a pool of byte slices of the given size, reused
+// across chunks and uploads instead of allocating one per chunk.
+func newBufferPool(size int) *sync.Pool {
+	return &sync.Pool{
+		New: func() interface{} {
+			buf := make([]byte, size)
+			return &buf
+		},
+	}
+}
+
+// storeChunks reads chunks from splitter and hashes and stores them on
+// UploadConcurrency workers. Reading stays sequential so indexes follow the
+// stream; at most UploadConcurrency chunks are in flight plus the one being
+// read, which bounds memory. The result is ordered by index.
+func (u *UploadService) storeChunks(ctx context.Context, fileID string, splitter chunker.Chunker, policy storage.Policy) ([]storedChunk, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := max(u.config.UploadConcurrency, 1)
+	jobs := make(chan chunkJob)
+
+	var (
+		mu       sync.Mutex
+		results  = make(map[int]storedChunk)
+		firstErr error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+		mu.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if ctx.Err() == nil {
+					hash := sha256.Sum256(job.data)
+					checksum := hex.EncodeToString(hash[:])
+
+					chunk, deduplicated, err := u.storeChunk(ctx, fileID, "", job.index, job.data, checksum, policy)
+					if err != nil {
+						fail(fmt.Errorf("chunk %d: %w", job.index, err))
+					} else {
+						mu.Lock()
+						results[job.index] = storedChunk{chunk: chunk, deduplicated: deduplicated}
+						mu.Unlock()
+						log.Printf("✅ Stored chunk %d for file %s (size: %d bytes, deduplicated: %t)",
+							job.index, fileID, chunk.Size, deduplicated)
+					}
+				}
+				u.bufferPool.Put(job.buf)
+			}
+		}()
+	}
+
+	count := 0
+read:
+	for {
+		data, err := splitter.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fail(fmt.Errorf("read file: %w", err))
+			break
+		}
+
+		buf := u.bufferPool.Get().(*[]byte)
+		if len(*buf) < len(data) {
+			grown := make([]byte, len(data))
+			buf = &grown
+		}
+		n := copy(*buf, data)
+
+		select {
+		case jobs <- chunkJob{index: count, buf: buf, data: (*buf)[:n]}:
+			count++
+		case <-ctx.Done():
+			u.bufferPool.Put(buf)
+			break read
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	stored := make([]storedChunk, count)
+	for i := range stored {
+		stored[i] = results[i]
+	}
+
+	return stored, nil
+}
@@ -0,0 +1,444 @@
+// services/upload/repair.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+
+	"atlasfs/services/common/storage"
+)
+
+const (
+	// repairLockID keeps re-replication to a single upload replica at a time.
+	repairLockID = 0x7265706c6963 // "replic"
+	repairBatch  = 500
+)
+
+// location is one recorded copy or shard of a chunk object.
+type location struct {
+	placement
+	primary bool
+}
+
+// chunkLocations returns the configured nodes recorded as holding a copy
+// or shard of a chunk object, primary first. Rows for nodes no longer
+// configured are ignored.
+func (u *UploadService) chunkLocations(ctx context.Context, q queryer, checksum string) ([]location, error) {
+	rows, err := q.QueryContext(ctx, `
+        SELECT node_id, shard_index, COALESCE(shard_checksum, ''), is_primary
+        FROM chunk_locations
+        WHERE chunk_id = $1
+        ORDER BY is_primary DESC, shard_index, created_at
+    `, checksum)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var locations []location
+	for rows.Next() {
+		var nodeID string
+		var loc location
+		if err := rows.Scan(&nodeID, &loc.shard, &loc.shardChecksum, &loc.primary); err != nil {
+			return nil, err
+		}
+		if loc.node = u.cluster.Node(nodeID); loc.node != nil {
+			locations = append(locations, loc)
+		}
+	}
+	return locations, rows.Err()
+}
+
+// objectPolicy returns the layout a chunk object was stored with.
+func (u *UploadService) objectPolicy(ctx context.Context, q queryRower, checksum string) (storage.Policy, error) {
+	var p storage.Policy
+	err := q.QueryRowContext(ctx, `
+        SELECT data_shards, parity_shards FROM chunk_objects WHERE checksum = $1
+    `, checksum).Scan(&p.DataShards, &p.ParityShards)
+	return p, err
+}
+
+// queryer and queryRower are satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// chunkStored reports whether a chunk object can be read back: a complete
+// copy on at least one node or, when erasure-coded, at least DataShards
+// shards of the right size. Objects written before replication have no
+// chunk_locations rows, so for those every node is checked.
+func (u *UploadService) chunkStored(ctx context.Context, checksum string, size int64) bool {
+	var locations []location
+	policy := storage.Policy{}
+	if u.db != nil {
+		locations, _ = u.chunkLocations(ctx, u.db, checksum)
+		policy, _ = u.objectPolicy(ctx, u.db, checksum)
+	}
+
+	if !policy.Erasure() {
+		nodes := u.cluster.Nodes
+		if len(locations) > 0 {
+			nodes = nodes[:0:0]
+			for _, loc := range locations {
+				nodes = append(nodes, loc.node)
+			}
+		}
+		for _, node := range nodes {
+			if info, err := node.Stat(ctx, checksum); err == nil && info.Size == size {
+				return true
+			}
+		}
+		return false
+	}
+
+	present := make(map[int]bool)
+	for _, loc := range locations {
+		if present[loc.shard] {
+			continue
+		}
+		info, err := loc.node.Stat(ctx, loc.key(checksum))
+		if err == nil && info.Size == policy.ShardSize(size) {
+			present[loc.shard] = true
+		}
+	}
+	return len(present) >= policy.DataShards
+}
+
+// runRepairer periodically re-copies chunk objects that have fewer copies
+// than the replication factor, e.g. after a node failed during an upload
+// or the scrubber dropped a bad copy.
+func (u *UploadService) runRepairer(ctx context.Context) {
+	ticker := time.NewTicker(u.config.RepairInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := u.repair(ctx); err != nil {
+				log.Printf("Replica repair failed: %v", err)
+			}
+		}
+	}
+}
+
+func (u *UploadService) repair(ctx context.Context) error {
+	conn, err := u.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, repairLockID).Scan(&locked); err != nil {
+		return err
+	}
+	if !locked {
+		return nil
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, repairLockID)
+
+	nodeIDs := make([]string, len(u.cluster.Nodes))
+	for i, node := range u.cluster.Nodes {
+		nodeIDs[i] = node.ID
+	}
+
+	started := time.Now()
+	checked, copies, failed := 0, 0, 0
+	cursor := ""
+	for {
+		// Whole copies are counted against the replication factor and
+		// erasure-coded objects against their number of distinct shards.
+		rows, err := u.db.QueryContext(ctx, `
+            SELECT co.checksum, co.chunk_size, co.data_shards, co.parity_shards
+            FROM chunk_objects co
+            WHERE co.checksum > $1 AND co.ref_count > 0
+              AND (SELECT COUNT(DISTINCT (cl.node_id, cl.shard_index)) FILTER (WHERE co.data_shards = 0)
+                        + COUNT(DISTINCT cl.shard_index) FILTER (WHERE co.data_shards > 0)
+                   FROM chunk_locations cl
+                   WHERE cl.chunk_id = co.checksum AND cl.node_id = ANY($2))
+                  < CASE WHEN co.data_shards > 0 THEN co.data_shards + co.parity_shards ELSE $3 END
+            ORDER BY co.checksum
+            LIMIT $4
+        `, cursor, pq.Array(nodeIDs), u.cluster.Replicas(), repairBatch)
+		if err != nil {
+			return err
+		}
+
+		type pending struct {
+			checksum string
+			size     int64
+			policy   storage.Policy
+		}
+		var batch []pending
+		for rows.Next() {
+			var p pending
+			if err := rows.Scan(&p.checksum, &p.size, &p.policy.DataShards, &p.policy.ParityShards); err != nil {
+				rows.Close()
+				return err
+			}
+			batch = append(batch, p)
+		}
+		rows.Close()
+		if len(batch) == 0 {
+			break
+		}
+
+		for _, p := range batch {
+			cursor = p.checksum
+			checked++
+			var added int
+			var err error
+			if p.policy.Erasure() {
+				added, err = u.repairShards(ctx, p.checksum, p.size, p.policy)
+			} else {
+				added, err = u.repairChunk(ctx, p.checksum, p.size)
+			}
+			if err != nil {
+				failed++
+				log.Printf("❌ Failed to re-replicate chunk object %s: %v", p.checksum, err)
+				continue
+			}
+			copies += added
+		}
+	}
+
+	if checked > 0 {
+		log.Printf("🔁 Replica repair finished in %s: %d under-replicated objects, %d copies or shards added, %d failed",
+			time.Since(started).Round(time.Millisecond), checked, copies, failed)
+	}
+	return nil
+}
+
+// lockChunkObject starts a transaction holding the chunk_objects row, so
+// the collector cannot remove the object while it is being repaired. It
+// returns a nil transaction if the object is no longer referenced.
+func (u *UploadService) lockChunkObject(ctx context.Context, checksum string) (*sql.Tx, error) {
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var refCount int
+	err = tx.QueryRowContext(ctx, `
+        SELECT ref_count FROM chunk_objects WHERE checksum = $1 FOR UPDATE
+    `, checksum).Scan(&refCount)
+	if err == sql.ErrNoRows || (err == nil && refCount <= 0) {
+		tx.Rollback()
+		return nil, nil
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return tx, nil
+}
+
+// repairChunk brings a replicated chunk object back to the replication
+// factor. The source copy is verified against its checksum before it is
+// copied, so a corrupt replica is never spread.
+func (u *UploadService) repairChunk(ctx context.Context, checksum string, size int64) (int, error) {
+	tx, err := u.lockChunkObject(ctx, checksum)
+	if tx == nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	holders, err := u.chunkLocations(ctx, tx, checksum)
+	if err != nil {
+		return 0, err
+	}
+	if len(holders) == 0 {
+		// Written before replication: find the copies and record them.
+		for _, node := range u.cluster.Nodes {
+			if info, err := node.Stat(ctx, checksum); err == nil && info.Size == size {
+				loc := location{placement: placement{node: node, shard: storage.NoShard}, primary: len(holders) == 0}
+				if err := recordLocation(ctx, tx, checksum, loc.placement, loc.primary); err != nil {
+					return 0, err
+				}
+				holders = append(holders, loc)
+			}
+		}
+	}
+	if len(holders) > 0 && !holders[0].primary {
+		// The primary copy was dropped; promote the oldest remaining one.
+		if err := recordLocation(ctx, tx, checksum, holders[0].placement, true); err != nil {
+			return 0, err
+		}
+	}
+
+	data, err := u.readVerifiedCopy(ctx, holders, checksum, size)
+	if err != nil {
+		return 0, err
+	}
+
+	held := make(map[string]bool, len(holders))
+	for _, loc := range holders {
+		held[loc.node.ID] = true
+	}
+
+	added := 0
+	for _, node := range u.cluster.Placement(checksum) {
+		if len(holders)+added >= u.cluster.Replicas() {
+			break
+		}
+		if held[node.ID] {
+			continue
+		}
+		if err := node.Put(ctx, checksum, data); err != nil {
+			log.Printf("Failed to copy chunk object %s to node %s: %v", checksum, node.ID, err)
+			continue
+		}
+		if err := recordLocation(ctx, tx, checksum, placement{node: node, shard: storage.NoShard}, false); err != nil {
+			return 0, err
+		}
+		added++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	if len(holders)+added < u.cluster.Replicas() {
+		return added, fmt.Errorf("only %d of %d copies available", len(holders)+added, u.cluster.Replicas())
+	}
+	return added, nil
+}
+
+// readVerifiedCopy returns the data of the first copy whose SHA-256 and
+// size match.
+func (u *UploadService) readVerifiedCopy(ctx context.Context, holders []location, checksum string, size int64) ([]byte, error) {
+	for _, loc := range holders {
+		data, err := readObject(ctx, loc.node, checksum, size)
+		if err != nil {
+			log.Printf("Failed to read chunk object %s from node %s: %v", checksum, loc.node.ID, err)
+			continue
+		}
+		if int64(len(data)) == size && sha256Hex(data) == checksum {
+			return data, nil
+		}
+		log.Printf("⚠️ Copy of chunk object %s on node %s is corrupt, not copying it", checksum, loc.node.ID)
+	}
+	return nil, errors.New("no intact copy to replicate from")
+}
+
+// repairShards rebuilds the missing shards of an erasure-coded chunk object
+// from the surviving ones. Each shard is checked against its recorded
+// checksum, and the rebuilt chunk against the object's checksum, before
+// anything is written. Rebuilt shards go to nodes that hold no shard of
+// the object yet where possible.
+func (u *UploadService) repairShards(ctx context.Context, checksum string, size int64, policy storage.Policy) (int, error) {
+	tx, err := u.lockChunkObject(ctx, checksum)
+	if tx == nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	holders, err := u.chunkLocations(ctx, tx, checksum)
+	if err != nil {
+		return 0, err
+	}
+
+	shards := make([][]byte, policy.Shards())
+	used := make(map[string]int)
+	available := 0
+	for _, loc := range holders {
+		used[loc.node.ID]++
+		if loc.shard < 0 || loc.shard >= len(shards) || shards[loc.shard] != nil {
+			continue
+		}
+		data, err := readObject(ctx, loc.node, loc.key(checksum), policy.ShardSize(size))
+		if err != nil {
+			log.Printf("Failed to read shard %d of %s from node %s: %v", loc.shard, checksum, loc.node.ID, err)
+			continue
+		}
+		if int64(len(data)) != policy.ShardSize(size) || sha256Hex(data) != loc.shardChecksum {
+			log.Printf("⚠️ Shard %d of %s on node %s is corrupt, not using it", loc.shard, checksum, loc.node.ID)
+			continue
+		}
+		shards[loc.shard] = data
+		available++
+	}
+	if available < policy.DataShards {
+		return 0, fmt.Errorf("only %d intact shards, %d needed to rebuild", available, policy.DataShards)
+	}
+
+	recorded := make(map[int]bool)
+	for _, loc := range holders {
+		recorded[loc.shard] = true
+	}
+	if err := policy.Reconstruct(shards); err != nil {
+		return 0, err
+	}
+
+	// Check the rebuilt data before spreading it.
+	var chunk bytes.Buffer
+	if err := policy.Decode(&chunk, shards, size); err != nil {
+		return 0, err
+	}
+	if sha256Hex(chunk.Bytes()) != checksum {
+		return 0, errors.New("rebuilt chunk does not match its checksum")
+	}
+
+	nodes := u.cluster.Placement(checksum)
+	added := 0
+	for i, shard := range shards {
+		if recorded[i] {
+			continue
+		}
+		sort.SliceStable(nodes, func(a, b int) bool { return used[nodes[a].ID] < used[nodes[b].ID] })
+
+		for _, node := range nodes {
+			if err := node.Put(ctx, storage.ShardKey(checksum, i), shard); err != nil {
+				log.Printf("Failed to store shard %d of %s on node %s: %v", i, checksum, node.ID, err)
+				continue
+			}
+			p := placement{node: node, shard: i, shardChecksum: sha256Hex(shard)}
+			if err := recordLocation(ctx, tx, checksum, p, false); err != nil {
+				return 0, err
+			}
+			used[node.ID]++
+			added++
+			break
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	if missing := policy.Shards() - len(recorded) - added; missing > 0 {
+		return added, fmt.Errorf("%d shards could not be stored", missing)
+	}
+	return added, nil
+}
+
+// readObject reads an object, stopping one byte past size so oversized
+// objects are detected without being read in full.
+func readObject(ctx context.Context, node *storage.Node, key string, size int64) ([]byte, error) {
+	obj, err := node.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	return io.ReadAll(io.LimitReader(obj, size+1))
+}
+
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
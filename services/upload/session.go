@@ -0,0 +1,469 @@
+// services/upload/session.go
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"atlasfs/services/common/events"
+	"atlasfs/services/common/models"
+	"atlasfs/services/common/outbox"
+	"atlasfs/services/common/storage"
+)
+
+const (
+	SessionActive    = "active"
+	SessionCompleted = "completed"
+
+	// MaxSessionChunkSize bounds the chunk size a client may ask for, since
+	// every chunk PUT is held in memory while it is hashed.
+	MaxSessionChunkSize = 64 * 1024 * 1024
+)
+
+// errSessionClosed is returned by storeChunk for a chunk of a session that
+// was completed while the chunk was being received.
+var errSessionClosed = errors.New("upload session is no longer active")
+
+type UploadSession struct {
+	ID          string    `json:"session_id"`
+	FileID      string    `json:"file_id"`
+	FileSize    int64     `json:"file_size"`
+	ChunkSize   int64     `json:"chunk_size"`
+	TotalChunks int       `json:"total_chunks"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type createSessionRequest struct {
+	FileID        string `json:"file_id" binding:"required"`
+	FileName      string `json:"file_name"`
+	FileSize      *int64 `json:"file_size" binding:"required"`
+	ChunkSize     int64  `json:"chunk_size"`
+	StoragePolicy string `json:"storage_policy"`
+}
+
+// expectedChunkSize returns the size chunk index must have: every chunk is
+// ChunkSize bytes except the last, which holds the remainder.
+func (s *UploadSession) expectedChunkSize(index int) int64 {
+	if index == s.TotalChunks-1 {
+		return s.FileSize - int64(s.TotalChunks-1)*s.ChunkSize
+	}
+	return s.ChunkSize
+}
+
+func (u *UploadService) loadSession(sessionID string) (*UploadSession, error) {
+	var s UploadSession
+	err := u.db.QueryRow(`
+        SELECT s.session_id, s.file_id, f.file_size, s.chunk_size, s.total_chunks, s.status, s.created_at, s.updated_at
+        FROM upload_sessions s
+        JOIN files f ON f.file_id = s.file_id
+        WHERE s.session_id = $1
+    `, sessionID).Scan(&s.ID, &s.FileID, &s.FileSize, &s.ChunkSize, &s.TotalChunks,
+		&s.Status, &s.CreatedAt, &s.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// receivedChunks returns the chunk rows recorded for a file, keyed by index.
+func (u *UploadService) receivedChunks(fileID string) (map[int]models.Chunk, error) {
+	rows, err := u.db.Query(`
+        SELECT chunk_id, chunk_index, chunk_size, checksum
+        FROM chunks
+        WHERE file_id = $1
+    `, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	received := make(map[int]models.Chunk)
+	for rows.Next() {
+		chunk := models.Chunk{FileID: fileID}
+		if err := rows.Scan(&chunk.ID, &chunk.Index, &chunk.Size, &chunk.Checksum); err != nil {
+			return nil, err
+		}
+		received[chunk.Index] = chunk
+	}
+	return received, rows.Err()
+}
+
+func missingIndexes(total int, received map[int]models.Chunk) []int {
+	missing := []int{}
+	for i := 0; i < total; i++ {
+		if _, ok := received[i]; !ok {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+// createSession starts (or resumes) a resumable upload for a file_id. If the
+// file has an active session already it is returned as-is so that a client
+// that lost its session ID can pick up where it left off.
+func (u *UploadService) createSession(c *gin.Context) {
+	if u.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database not available"})
+		return
+	}
+
+	var req createSessionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file_id and file_size are required"})
+		return
+	}
+	if *req.FileSize < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file_size must not be negative"})
+		return
+	}
+	if req.ChunkSize == 0 {
+		req.ChunkSize = ChunkSize
+	}
+	if req.ChunkSize < 0 || req.ChunkSize > MaxSessionChunkSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("chunk_size must be between 1 and %d", MaxSessionChunkSize)})
+		return
+	}
+	policy, err := storage.ResolvePolicy(u.config, req.StoragePolicy)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := u.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// The gateway normally creates the files row; create it here when a
+	// client talks to the upload service directly.
+	var status string
+	var fileSize int64
+	err = tx.QueryRow(`SELECT status, file_size FROM files WHERE file_id = $1 FOR UPDATE`, req.FileID).
+		Scan(&status, &fileSize)
+	switch {
+	case err == sql.ErrNoRows:
+		if req.FileName == "" {
+			req.FileName = req.FileID
+		}
+		_, err = tx.Exec(`
+            INSERT INTO files (file_id, file_name, file_size, status, user_id, logical_id, storage_policy, created_at, updated_at)
+            VALUES ($1, $2, $3, $4, $5, $1, $6, $7, $8)
+        `, req.FileID, req.FileName, *req.FileSize, models.StatusUploading, "anonymous", policy.String(), time.Now(), time.Now())
+		if err != nil {
+			log.Printf("Failed to create file %s: %v", req.FileID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create file"})
+			return
+		}
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	case status != string(models.StatusUploading):
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("File is %s, not uploading", status)})
+		return
+	case fileSize != *req.FileSize:
+		_, err = tx.Exec(`UPDATE files SET file_size = $1, updated_at = $2 WHERE file_id = $3`,
+			*req.FileSize, time.Now(), req.FileID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update file"})
+			return
+		}
+	}
+
+	var existingID string
+	err = tx.QueryRow(`
+        SELECT session_id FROM upload_sessions WHERE file_id = $1 AND status = $2
+    `, req.FileID, SessionActive).Scan(&existingID)
+	if err == nil {
+		if err = tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit session"})
+			return
+		}
+		u.respondWithSession(c, http.StatusOK, existingID)
+		return
+	}
+	if err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	totalChunks := int((*req.FileSize + req.ChunkSize - 1) / req.ChunkSize)
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	_, err = tx.Exec(`
+        INSERT INTO upload_sessions (session_id, file_id, chunk_size, total_chunks, status, created_at, updated_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+    `, sessionID, req.FileID, req.ChunkSize, totalChunks, SessionActive, time.Now(), time.Now())
+	if err != nil {
+		log.Printf("Failed to create upload session for %s: %v", req.FileID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+		return
+	}
+
+	event := events.NewEvent("upload", events.UploadStartedData{
+		FileID:      req.FileID,
+		SessionID:   sessionID,
+		Size:        *req.FileSize,
+		TotalChunks: totalChunks,
+	})
+	if err = outbox.Add(c.Request.Context(), tx, req.FileID, event); err != nil {
+		log.Printf("Failed to record upload started event for %s: %v", req.FileID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit session"})
+		return
+	}
+
+	log.Printf("📥 Created upload session %s for %s (%d chunks)", sessionID, req.FileID, totalChunks)
+
+	u.respondWithSession(c, http.StatusCreated, sessionID)
+}
+
+func (u *UploadService) respondWithSession(c *gin.Context, code int, sessionID string) {
+	session, err := u.loadSession(sessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load session"})
+		return
+	}
+
+	received, err := u.receivedChunks(session.FileID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load chunks"})
+		return
+	}
+
+	c.JSON(code, gin.H{
+		"session":         session,
+		"received_chunks": len(received),
+		"missing_chunks":  missingIndexes(session.TotalChunks, received),
+	})
+}
+
+// getSession reports which chunk indexes the client still has to send.
+func (u *UploadService) getSession(c *gin.Context) {
+	if u.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database not available"})
+		return
+	}
+
+	if _, err := u.loadSession(c.Param("id")); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	u.respondWithSession(c, http.StatusOK, c.Param("id"))
+}
+
+// handleChunk stores one chunk of a session. The body is the raw chunk and
+// the X-Chunk-SHA256 header carries its hex SHA-256, which must match.
+func (u *UploadService) handleChunk(c *gin.Context) {
+	if u.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database not available"})
+		return
+	}
+
+	session, err := u.loadSession(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	if session.Status != SessionActive {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Session is %s", session.Status)})
+		return
+	}
+
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil || index < 0 || index >= session.TotalChunks {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Chunk index must be between 0 and %d", session.TotalChunks-1)})
+		return
+	}
+
+	expectedChecksum := strings.ToLower(c.GetHeader("X-Chunk-SHA256"))
+	if expectedChecksum == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "X-Chunk-SHA256 header is required"})
+		return
+	}
+
+	expectedSize := session.expectedChunkSize(index)
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, expectedSize+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read chunk"})
+		return
+	}
+	if int64(len(data)) != expectedSize {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":         "Chunk has the wrong size",
+			"expected_size": expectedSize,
+		})
+		return
+	}
+
+	hash := sha256.Sum256(data)
+	checksum := hex.EncodeToString(hash[:])
+	if checksum != expectedChecksum {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":    "Checksum mismatch",
+			"checksum": checksum,
+		})
+		return
+	}
+
+	policy, err := u.filePolicy(session.FileID, "")
+	if err != nil {
+		log.Printf("File %s has an invalid storage policy: %v", session.FileID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid storage policy"})
+		return
+	}
+
+	chunk, deduplicated, err := u.storeChunk(c.Request.Context(), session.FileID, session.ID, index, data, checksum, policy)
+	if errors.Is(err, errSessionClosed) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Session is no longer active"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to store chunk %d of session %s: %v", index, session.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store chunk"})
+		return
+	}
+
+	log.Printf("✅ Stored chunk %d/%d for session %s (deduplicated: %t)", index+1, session.TotalChunks, session.ID, deduplicated)
+
+	c.JSON(http.StatusOK, gin.H{
+		"chunk":        chunk,
+		"deduplicated": deduplicated,
+	})
+}
+
+// completeSession finalizes a session. The file only moves to completed
+// once every expected chunk has a row and its object exists in MinIO with
+// the recorded size. The session row is locked throughout, so no chunk can
+// be replaced between the checks and the commit.
+func (u *UploadService) completeSession(c *gin.Context) {
+	if u.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database not available"})
+		return
+	}
+
+	session, err := u.loadSession(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	if session.Status != SessionActive {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Session is %s", session.Status)})
+		return
+	}
+
+	tx, err := u.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`SELECT status FROM upload_sessions WHERE session_id = $1 FOR UPDATE`, session.ID).
+		Scan(&session.Status)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to lock session"})
+		return
+	}
+	if session.Status != SessionActive {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Session is %s", session.Status)})
+		return
+	}
+
+	received, err := u.receivedChunks(session.FileID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load chunks"})
+		return
+	}
+
+	if missing := missingIndexes(session.TotalChunks, received); len(missing) > 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":          "Upload is incomplete",
+			"missing_chunks": missing,
+		})
+		return
+	}
+
+	// Every row must be backed by an object; anything absent or truncated on
+	// every storage node is reported as missing so the client can re-send it.
+	ctx := c.Request.Context()
+	missing := []int{}
+	for i := 0; i < session.TotalChunks; i++ {
+		chunk := received[i]
+		if !u.chunkStored(ctx, chunk.Checksum, chunk.Size) {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) > 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":          "Chunks are missing from storage",
+			"missing_chunks": missing,
+		})
+		return
+	}
+
+	var fileName string
+	err = tx.QueryRow(`
+        UPDATE files
+        SET chunk_count = $1, status = $2, updated_at = $3
+        WHERE file_id = $4 AND status = $5
+        RETURNING file_name
+    `, session.TotalChunks, models.StatusCompleted, time.Now(), session.FileID, models.StatusUploading).Scan(&fileName)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "File is no longer uploading"})
+		return
+	}
+
+	_, err = tx.Exec(`UPDATE upload_sessions SET status = $1, updated_at = $2 WHERE session_id = $3`,
+		SessionCompleted, time.Now(), session.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update session"})
+		return
+	}
+
+	event := events.NewEvent("upload", events.UploadCompletedData{
+		FileID:     session.FileID,
+		FileName:   fileName,
+		Size:       session.FileSize,
+		ChunkCount: session.TotalChunks,
+	})
+	if err = outbox.Add(c.Request.Context(), tx, session.FileID, event); err != nil {
+		log.Printf("Failed to record upload completed event for %s: %v", session.FileID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit upload"})
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit upload"})
+		return
+	}
+
+	log.Printf("✅ Upload session %s completed for %s: %d chunks", session.ID, session.FileID, session.TotalChunks)
+
+	c.JSON(http.StatusOK, gin.H{
+		"file_id":     session.FileID,
+		"session_id":  session.ID,
+		"filename":    fileName,
+		"size":        session.FileSize,
+		"chunk_count": session.TotalChunks,
+		"status":      models.StatusCompleted,
+	})
+}
@@ -0,0 +1,307 @@
+// services/upload/store.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"atlasfs/services/common/events"
+	"atlasfs/services/common/models"
+	"atlasfs/services/common/outbox"
+	"atlasfs/services/common/storage"
+)
+
+// chunkID returns the chunks-table ID for a file's chunk. Chunk data itself
+// is stored content-addressed under its checksum, see storeChunk.
+func chunkID(fileID string, index int) string {
+	return fmt.Sprintf("%s_chunk_%d", fileID, index)
+}
+
+// storeChunk records chunk index of fileID and makes sure its data is on the
+// storage nodes under its checksum, laid out according to policy.
+// Identical chunks are written once and shared through the ref_count in
+// chunk_objects, keeping the layout of whichever upload wrote them first;
+// deduplicated reports whether an existing object was reused. Re-sending
+// the same index replaces the previous row, so retries are safe. A chunk
+// sent through an upload session is stored only while the session is
+// active, with the session row locked until commit so that it cannot be
+// completed meanwhile; otherwise errSessionClosed is returned. The
+// file.chunk.created event is recorded with the row; without a database
+// nothing is recorded, and no event published.
+func (u *UploadService) storeChunk(ctx context.Context, fileID, sessionID string, index int, data []byte, checksum string, policy storage.Policy) (chunk models.Chunk, deduplicated bool, err error) {
+	chunk = models.Chunk{
+		ID:        chunkID(fileID, index),
+		FileID:    fileID,
+		Index:     index,
+		Size:      int64(len(data)),
+		Checksum:  checksum,
+		CreatedAt: time.Now(),
+	}
+
+	if u.db == nil {
+		_, err = u.placeChunkObject(ctx, checksum, data, policy)
+		return chunk, false, err
+	}
+
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return chunk, false, err
+	}
+	defer tx.Rollback()
+
+	if sessionID != "" {
+		var status string
+		err = tx.QueryRowContext(ctx, `
+            SELECT status FROM upload_sessions WHERE session_id = $1 FOR UPDATE
+        `, sessionID).Scan(&status)
+		if err != nil {
+			return chunk, false, fmt.Errorf("lock session %s: %w", sessionID, err)
+		}
+		if status != SessionActive {
+			return chunk, false, errSessionClosed
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE upload_sessions SET updated_at = $1 WHERE session_id = $2`,
+			chunk.CreatedAt, sessionID)
+		if err != nil {
+			return chunk, false, fmt.Errorf("touch session %s: %w", sessionID, err)
+		}
+	}
+
+	var previous string
+	err = tx.QueryRowContext(ctx, `SELECT checksum FROM chunks WHERE chunk_id = $1 FOR UPDATE`, chunk.ID).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		return chunk, false, fmt.Errorf("look up chunk %s: %w", chunk.ID, err)
+	}
+	if previous == checksum {
+		// A retry of a chunk we already hold; nothing changes.
+		return chunk, true, tx.Commit()
+	}
+
+	// Take a reference on the object. The upsert locks the chunk_objects row
+	// until commit, so a concurrent upload of the same data waits here and
+	// then finds the object already written.
+	var inserted bool
+	err = tx.QueryRowContext(ctx, `
+        INSERT INTO chunk_objects (checksum, chunk_size, ref_count, data_shards, parity_shards, created_at)
+        VALUES ($1, $2, 1, $3, $4, $5)
+        ON CONFLICT (checksum) DO UPDATE SET ref_count = chunk_objects.ref_count + 1
+        RETURNING (xmax = 0)
+    `, checksum, chunk.Size, policy.DataShards, policy.ParityShards, chunk.CreatedAt).Scan(&inserted)
+	if err != nil {
+		return chunk, false, fmt.Errorf("reference chunk object %s: %w", checksum, err)
+	}
+
+	if inserted {
+		placed, err := u.placeChunkObject(ctx, checksum, data, policy)
+		if err != nil {
+			return chunk, false, err
+		}
+		for i, p := range placed {
+			primary := i == 0 && !policy.Erasure()
+			if err = recordLocation(ctx, tx, checksum, p, primary); err != nil {
+				return chunk, false, err
+			}
+		}
+	}
+
+	if previous != "" {
+		_, err = tx.ExecContext(ctx, `
+            UPDATE chunk_objects SET ref_count = ref_count - 1 WHERE checksum = $1
+        `, previous)
+		if err != nil {
+			return chunk, false, fmt.Errorf("release chunk object %s: %w", previous, err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO chunks (chunk_id, file_id, chunk_index, chunk_size, checksum, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        ON CONFLICT (chunk_id) DO UPDATE
+        SET chunk_size = EXCLUDED.chunk_size, checksum = EXCLUDED.checksum, created_at = EXCLUDED.created_at
+    `, chunk.ID, chunk.FileID, chunk.Index, chunk.Size, chunk.Checksum, chunk.CreatedAt)
+	if err != nil {
+		return chunk, false, fmt.Errorf("store chunk metadata %s: %w", chunk.ID, err)
+	}
+	if err = outbox.Add(ctx, tx, chunk.ID, chunkCreatedEvent(chunk)); err != nil {
+		return chunk, false, fmt.Errorf("record event for chunk %s: %w", chunk.ID, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return chunk, false, err
+	}
+	return chunk, !inserted, nil
+}
+
+func chunkCreatedEvent(chunk models.Chunk) *events.Event {
+	return events.NewEvent("upload", events.ChunkCreatedData{
+		FileID:   chunk.FileID,
+		ChunkID:  chunk.ID,
+		Index:    chunk.Index,
+		Size:     chunk.Size,
+		Checksum: chunk.Checksum,
+	})
+}
+
+// filePolicy returns a file's storage policy: the one on its files row if
+// it has one, otherwise requested, otherwise the configured default.
+func (u *UploadService) filePolicy(fileID, requested string) (storage.Policy, error) {
+	name := requested
+	if u.db != nil {
+		var recorded string
+		err := u.db.QueryRow(`SELECT storage_policy FROM files WHERE file_id = $1`, fileID).Scan(&recorded)
+		if err == nil {
+			name = recorded
+		}
+	}
+	return storage.ResolvePolicy(u.config, name)
+}
+
+// placement is one whole copy or shard of a chunk object on a node.
+type placement struct {
+	node          *storage.Node
+	shard         int // storage.NoShard for a whole copy
+	shardChecksum string
+}
+
+func (p placement) key(checksum string) string {
+	return storage.ShardKey(checksum, p.shard)
+}
+
+// placeChunkObject writes a new chunk object to the storage nodes according
+// to policy and returns where it went.
+func (u *UploadService) placeChunkObject(ctx context.Context, checksum string, data []byte, policy storage.Policy) ([]placement, error) {
+	if policy.Erasure() {
+		return u.placeShards(ctx, checksum, data, policy)
+	}
+	return u.placeCopies(ctx, checksum, data)
+}
+
+// placeCopies writes Replicas() whole copies, to nodes taken in placement
+// order, and returns them with the primary first. A node that fails is
+// replaced by the next one in the placement. Ending up with fewer copies
+// than the replication factor is accepted as long as one was written; the
+// repairer tops the object up later.
+func (u *UploadService) placeCopies(ctx context.Context, checksum string, data []byte) ([]placement, error) {
+	candidates := u.cluster.Placement(checksum)
+	want := u.cluster.Replicas()
+
+	var placed []placement
+	var lastErr error
+	for len(placed) < want && len(candidates) > 0 {
+		batch := candidates[:min(want-len(placed), len(candidates))]
+		candidates = candidates[len(batch):]
+
+		errs := make([]error, len(batch))
+		var wg sync.WaitGroup
+		for i, node := range batch {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = node.Put(ctx, checksum, data)
+			}()
+		}
+		wg.Wait()
+
+		for i, node := range batch {
+			if errs[i] != nil {
+				log.Printf("Failed to store chunk object %s on node %s: %v", checksum, node.ID, errs[i])
+				lastErr = errs[i]
+				continue
+			}
+			placed = append(placed, placement{node: node, shard: storage.NoShard})
+		}
+	}
+
+	if len(placed) == 0 {
+		return nil, fmt.Errorf("store chunk object %s: %w", checksum, lastErr)
+	}
+	if len(placed) < want {
+		log.Printf("⚠️ Chunk object %s stored on %d of %d nodes", checksum, len(placed), want)
+	}
+	return placed, nil
+}
+
+// placeShards erasure-codes data and writes shard i to the i-th node in
+// placement order, wrapping around when there are fewer nodes than shards.
+// A shard whose node fails is written to the next node that takes it. The
+// object is accepted once DataShards shards are stored, since that is
+// enough to read it back; the repairer rebuilds the rest later.
+func (u *UploadService) placeShards(ctx context.Context, checksum string, data []byte, policy storage.Policy) ([]placement, error) {
+	shards, err := policy.Encode(data)
+	if err != nil {
+		return nil, fmt.Errorf("encode chunk object %s: %w", checksum, err)
+	}
+	nodes := u.cluster.Placement(checksum)
+
+	placed := make([]placement, len(shards))
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for i := range shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			node := nodes[i%len(nodes)]
+			key := storage.ShardKey(checksum, i)
+			for attempt := 1; ; attempt++ {
+				if errs[i] = node.Put(ctx, key, shards[i]); errs[i] == nil {
+					placed[i] = placement{node: node, shard: i, shardChecksum: sha256Hex(shards[i])}
+					return
+				}
+				log.Printf("Failed to store shard %d of %s on node %s: %v", i, checksum, node.ID, errs[i])
+				if attempt == len(nodes) || ctx.Err() != nil {
+					return
+				}
+				node = nodes[(i+attempt)%len(nodes)]
+			}
+		}()
+	}
+	wg.Wait()
+
+	stored := placed[:0]
+	var lastErr error
+	for i, p := range placed {
+		if errs[i] != nil {
+			lastErr = errs[i]
+			continue
+		}
+		stored = append(stored, p)
+	}
+
+	if len(stored) < policy.DataShards {
+		return nil, fmt.Errorf("store chunk object %s: only %d of %d shards written: %w",
+			checksum, len(stored), policy.Shards(), lastErr)
+	}
+	if len(stored) < policy.Shards() {
+		log.Printf("⚠️ Chunk object %s stored with %d of %d shards", checksum, len(stored), policy.Shards())
+	}
+	return stored, nil
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// recordLocation notes in chunk_locations that a node holds a copy or
+// shard of the chunk object.
+func recordLocation(ctx context.Context, db execer, checksum string, p placement, primary bool) error {
+	var shardChecksum interface{}
+	if p.shardChecksum != "" {
+		shardChecksum = p.shardChecksum
+	}
+	_, err := db.ExecContext(ctx, `
+        INSERT INTO chunk_locations (chunk_id, node_id, shard_index, storage_path, shard_checksum, is_primary, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        ON CONFLICT (chunk_id, node_id, shard_index) DO UPDATE
+        SET storage_path = EXCLUDED.storage_path, shard_checksum = EXCLUDED.shard_checksum,
+            is_primary = EXCLUDED.is_primary
+    `, checksum, p.node.ID, p.shard, p.node.StoragePath(p.key(checksum)), shardChecksum, primary, time.Now())
+	if err != nil {
+		return fmt.Errorf("record location of %s on %s: %w", p.key(checksum), p.node.ID, err)
+	}
+	return nil
+}